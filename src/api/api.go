@@ -4,13 +4,18 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"io"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/gabriel-vasile/mimetype"
 	"github.com/gin-gonic/gin"
+	uuid "github.com/gofrs/uuid"
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 
@@ -29,6 +34,18 @@ const (
 	pingPeriod = (pongWait * 9) / 10
 )
 
+// maximum number of stored messages that are replayed when a client reconnects to the event stream
+const receiveEventsReplayLimit = 1000
+
+// websocket close code that is sent in case the messages after the cursor aren't buffered anymore
+const wsCloseCursorExpired = 4410
+
+// formats of the received messages: v1 passes the envelopes of signal-cli through, v2 is the normalized format
+const (
+	receiveFormatV1 = "v1"
+	receiveFormatV2 = "v2"
+)
+
 type UpdateContactRequest struct {
 	Recipient           string  `json:"recipient"`
 	Name                *string `json:"name"`
@@ -99,17 +116,46 @@ type SendMessageV1 struct {
 }
 
 type SendMessageV2 struct {
-	Number            string                  `json:"number"`
-	Recipients        []string                `json:"recipients"`
-	Message           string                  `json:"message"`
-	Base64Attachments []string                `json:"base64_attachments" example:"<BASE64 ENCODED DATA>,data:<MIME-TYPE>;base64<comma><BASE64 ENCODED DATA>,data:<MIME-TYPE>;filename=<FILENAME>;base64<comma><BASE64 ENCODED DATA>"`
-	Sticker           string                  `json:"sticker"`
-	Mentions          []client.MessageMention `json:"mentions"`
-	QuoteTimestamp    *int64                  `json:"quote_timestamp"`
-	QuoteAuthor       *string                 `json:"quote_author"`
-	QuoteMessage      *string                 `json:"quote_message"`
-	QuoteMentions     []client.MessageMention `json:"quote_mentions"`
-	TextMode          *string                 `json:"text_mode" enums:"normal,styled"`
+	Number            string                 `json:"number"`
+	Recipients        []string               `json:"recipients"`
+	Message           string                 `json:"message"`
+	Base64Attachments []string               `json:"base64_attachments" example:"<BASE64 ENCODED DATA>,data:<MIME-TYPE>;base64<comma><BASE64 ENCODED DATA>,data:<MIME-TYPE>;filename=<FILENAME>;base64<comma><BASE64 ENCODED DATA>"`
+	AttachmentUrls    []string               `json:"attachment_urls" example:"https://grafana.example.com/render/d-solo/abc/panel.png"`
+	Sticker           string                 `json:"sticker"`
+	Mentions          client.MessageMentions `json:"mentions" swaggertype:"array,object"`
+	QuoteTimestamp    *int64                 `json:"quote_timestamp"`
+	QuoteAuthor       *string                `json:"quote_author"`
+	QuoteMessage      *string                `json:"quote_message"`
+	QuoteMentions     client.MessageMentions `json:"quote_mentions" swaggertype:"array,object"`
+	TextMode          *string                `json:"text_mode" enums:"normal,styled"`
+	LinkPreview       *client.LinkPreview    `json:"link_preview"`
+	TemplateId        string                 `json:"template_id"`
+	Variables         map[string]interface{} `json:"variables"`
+}
+
+type EditMessageRequest struct {
+	Recipients []string               `json:"recipients"`
+	Message    string                 `json:"message"`
+	Mentions   client.MessageMentions `json:"mentions" swaggertype:"array,object"`
+	TextMode   *string                `json:"text_mode" enums:"normal,styled"`
+}
+
+type RemoteDeleteRequest struct {
+	Recipient string `json:"recipient"`
+}
+
+type ReceiptRequest struct {
+	Recipient  string  `json:"recipient"`
+	Timestamps []int64 `json:"timestamps"`
+	Type       string  `json:"type" enums:"read,viewed"`
+}
+
+type AddStickerPackRequest struct {
+	Url string `json:"url" example:"https://signal.art/addstickers/#pack_id=<PACK ID>&pack_key=<PACK KEY>"`
+}
+
+type UploadStickerPackResponse struct {
+	Url string `json:"url"`
 }
 
 type TypingIndicatorRequest struct {
@@ -117,7 +163,26 @@ type TypingIndicatorRequest struct {
 }
 
 type Error struct {
-	Msg string `json:"error"`
+	Msg  string `json:"error"`
+	Code string `json:"code,omitempty"`
+}
+
+type RateLimitError struct {
+	Msg            string `json:"error"`
+	Code           string `json:"code,omitempty"`
+	ChallengeToken string `json:"challenge_token,omitempty"`
+	RetryAfter     int    `json:"retry_after,omitempty"`
+}
+
+type UntrustedIdentityError struct {
+	Msg        string                     `json:"error"`
+	Code       string                     `json:"code,omitempty"`
+	Identities []client.UntrustedIdentity `json:"untrusted_identities"`
+}
+
+type RateLimitChallengeRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Captcha        string `json:"captcha"`
 }
 
 type CreateGroupResponse struct {
@@ -138,12 +203,131 @@ type SendMessageResponse struct {
 	Timestamp string `json:"timestamp"`
 }
 
+type BatchSendResult struct {
+	Index    int                    `json:"index"`
+	Number   string                 `json:"number"`
+	Status   int                    `json:"status"`
+	Response *[]client.SendResponse `json:"response,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+	Code     string                 `json:"code,omitempty"`
+	// set in case the message was rate limited (status 429)
+	ChallengeToken string `json:"challenge_token,omitempty"`
+	RetryAfter     int    `json:"retry_after,omitempty"`
+	// set in case the identity of a recipient isn't trusted (status 409)
+	UntrustedIdentities []client.UntrustedIdentity `json:"untrusted_identities,omitempty"`
+}
+
+type SendJobCreatedResponse struct {
+	Id string `json:"id"`
+}
+
+type SendJobResponse struct {
+	Id        string                 `json:"id"`
+	Number    string                 `json:"number"`
+	Status    string                 `json:"status" enums:"queued,sending,retrying,sent,failed"`
+	Attempts  int                    `json:"attempts"`
+	LastError string                 `json:"last_error,omitempty"`
+	Response  *[]client.SendResponse `json:"response,omitempty"`
+	CreatedAt time.Time              `json:"created_at"`
+	UpdatedAt time.Time              `json:"updated_at"`
+}
+
+type ScheduleRequest struct {
+	Message SendMessageV2 `json:"message"`
+	SendAt  *time.Time    `json:"send_at" example:"2024-01-01T08:00:00Z"`
+	Cron    *string       `json:"cron" example:"0 8 * * 1-5"`
+}
+
+type ScheduleResponse struct {
+	Id        string        `json:"id"`
+	Number    string        `json:"number"`
+	Message   SendMessageV2 `json:"message"`
+	SendAt    *time.Time    `json:"send_at,omitempty"`
+	Cron      string        `json:"cron,omitempty"`
+	Active    bool          `json:"active"`
+	NextRun   *time.Time    `json:"next_run,omitempty"`
+	CreatedAt time.Time     `json:"created_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+}
+
+type ScheduleRunResponse struct {
+	RunAt    time.Time              `json:"run_at"`
+	Success  bool                   `json:"success"`
+	Error    string                 `json:"error,omitempty"`
+	Response *[]client.SendResponse `json:"response,omitempty"`
+}
+
+type TemplateRequest struct {
+	Name              string                 `json:"name"`
+	Body              string                 `json:"body" example:"Alert {{.name}} is {{.state}}"`
+	TextMode          *string                `json:"text_mode" enums:"normal,styled"`
+	Mentions          client.MessageMentions `json:"mentions" swaggertype:"array,object"`
+	Base64Attachments []string               `json:"base64_attachments"`
+	AttachmentUrls    []string               `json:"attachment_urls"`
+}
+
+type TemplateResponse struct {
+	Id                string                 `json:"id"`
+	Name              string                 `json:"name"`
+	Body              string                 `json:"body"`
+	TextMode          *string                `json:"text_mode,omitempty"`
+	Mentions          client.MessageMentions `json:"mentions" swaggertype:"array,object"`
+	Base64Attachments []string               `json:"base64_attachments"`
+	AttachmentUrls    []string               `json:"attachment_urls"`
+	CreatedAt         time.Time              `json:"created_at"`
+	UpdatedAt         time.Time              `json:"updated_at"`
+}
+
 type TrustModeRequest struct {
-	TrustMode string `json:"trust_mode"`
+	TrustMode            string `json:"trust_mode"`
+	MessageRetentionDays *int   `json:"message_retention_days,omitempty"`
 }
 
 type TrustModeResponse struct {
-	TrustMode string `json:"trust_mode"`
+	TrustMode            string `json:"trust_mode"`
+	MessageRetentionDays *int   `json:"message_retention_days,omitempty"`
+}
+
+type StoredMessageResponse struct {
+	Id        uint            `json:"id"`
+	Account   string          `json:"account"`
+	Sender    string          `json:"sender"`
+	GroupId   string          `json:"group_id,omitempty"`
+	Type      string          `json:"type"`
+	Timestamp int64           `json:"timestamp"`
+	Message   string          `json:"message,omitempty"`
+	Envelope  json.RawMessage `json:"envelope" swaggertype:"object"`
+}
+
+type MessagesResponse struct {
+	Messages   []StoredMessageResponse `json:"messages"`
+	NextCursor string                  `json:"next_cursor,omitempty"`
+}
+
+type WebhookRequest struct {
+	Url          string   `json:"url" example:"https://example.com/signal"`
+	Secret       string   `json:"secret"`
+	MessageTypes []string `json:"message_types" example:"message,reaction"`
+}
+
+type WebhookResponse struct {
+	Id           string    `json:"id"`
+	Number       string    `json:"number"`
+	Url          string    `json:"url"`
+	Secret       string    `json:"secret,omitempty"`
+	MessageTypes []string  `json:"message_types"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type WebhookDeliveryResponse struct {
+	Id             string          `json:"id"`
+	MessageType    string          `json:"message_type"`
+	Attempts       int             `json:"attempts"`
+	LastError      string          `json:"last_error,omitempty"`
+	LastStatusCode int             `json:"last_status_code,omitempty"`
+	Payload        json.RawMessage `json:"payload" swaggertype:"object"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
 }
 
 var connectionUpgrader = websocket.Upgrader{
@@ -162,15 +346,42 @@ type AddDeviceRequest struct {
 }
 
 type Api struct {
-	signalClient  *client.SignalClient
-	signalCliMode client.SignalCliMode
+	signalClient     *client.SignalClient
+	signalCliMode    client.SignalCliMode
+	sendQueue        *SendQueue
+	scheduler        *Scheduler
+	templateStorage  *utils.TemplateStorage
+	maxUploadSize    int64
+	batchParallelism int
+	subStorage       *utils.SubStorage
+	// how long the responses of requests with an Idempotency-Key header are kept
+	idempotencyKeyTtl time.Duration
+	numberRateLimiter *RateLimiter
+	subRateLimiter    *RateLimiter
+	webhookDispatcher *WebhookDispatcher
 }
 
-func NewApi(signalClient *client.SignalClient, signalCliMode client.SignalCliMode) *Api {
-	return &Api{
-		signalClient:  signalClient,
-		signalCliMode: signalCliMode,
-	}
+func NewApi(signalClient *client.SignalClient, signalCliMode client.SignalCliMode, sendQueue *SendQueue, scheduler *Scheduler,
+	templateStorage *utils.TemplateStorage, maxUploadSize int64, batchParallelism int, subStorage *utils.SubStorage,
+	idempotencyKeyTtl time.Duration, numberRateLimiter *RateLimiter, subRateLimiter *RateLimiter,
+	webhookDispatcher *WebhookDispatcher) *Api {
+	a := &Api{
+		signalClient:      signalClient,
+		signalCliMode:     signalCliMode,
+		sendQueue:         sendQueue,
+		scheduler:         scheduler,
+		templateStorage:   templateStorage,
+		maxUploadSize:     maxUploadSize,
+		batchParallelism:  batchParallelism,
+		subStorage:        subStorage,
+		idempotencyKeyTtl: idempotencyKeyTtl,
+		numberRateLimiter: numberRateLimiter,
+		subRateLimiter:    subRateLimiter,
+		webhookDispatcher: webhookDispatcher,
+	}
+	sendQueue.deliver = a.deliverSendJob
+	scheduler.dispatch = a.dispatchSchedule
+	return a
 }
 
 // @Summary Lists general information about the API
@@ -311,30 +522,70 @@ func (a *Api) About(c *gin.Context) {
 
 // @Summary Send a signal message.
 // @Tags Messages
-// @Description Send a signal message. Set the text_mode to 'styled' in case you want to add formatting to your text message. Styling Options: *italic text*, **bold text**, ~strikethrough text~.
+// @Description Send a signal message. Instead of the message, a template_id together with the variables to render the template with can be provided. Set the text_mode to 'styled' in case you want to add formatting to your text message. Styling Options: *italic text*, **bold text**, ~strikethrough text~, ||spoiler||, `monospace`. Styles can be nested and a backslash escapes a formatting character (e.g. \*). In styled mode (or if mentions is set to 'auto'), placeholders like @{+431212131491291} or @{<uuid>} in the message and the quote are replaced with the name of the contact (in normal and native mode with the number/uuid, as the contacts are only looked up in json-rpc mode) and sent as mentions. Phone numbers and group ids can be mixed freely in the recipients; the message is sent to all phone numbers at once (with the same timestamp) and to every group separately. The response contains one entry per recipient (in the order of the request, duplicates removed) with the recipient, the timestamp and the results, or the error if sending to it failed. If sending fails for some of the recipients only, the status is still 201 and the failed entries contain the error; an error response is only returned if sending failed for all recipients (with the status of the error if all of them failed the same way). If async is set to 'true', the message is put into a persistent queue and the id of the send job is returned instead.
+// @Description Instead of base64 encoding attachments, the request can also be sent as multipart/form-data: the message (as JSON) goes into a part named 'message' and every file part is sent as attachment. File names and mime types are taken from the part headers. Multipart requests can't be sent asynchronously.
 // @Accept  json
+// @Accept  mpfd
 // @Produce  json
-// @Success 201 {object} SendMessageResponse
+// @Success 201 {object} []client.SendResponse
+// @Success 202 {object} SendJobCreatedResponse
 // @Failure 400 {object} Error
+// @Failure 413 {object} Error
+// @Failure 409 {object} UntrustedIdentityError
+// @Failure 429 {object} RateLimitError
 // @Param data body SendMessageV2 true "Input Data"
+// @Param Idempotency-Key header string false "Unique key of the request; a retry with the same key returns the response of the original request instead of sending the message again"
+// @Param async query string false "Queue the message and deliver it in the background (default: false). A queued message is sent at most once: if the API is shut down while it is being sent, it is marked as failed instead of being sent again."
 // @Router /v2/send [post]
 func (a *Api) SendV2(c *gin.Context) {
 	sub := c.MustGet("sub").(string)
 	var req SendMessageV2
-	err := c.BindJSON(&req)
-	if err != nil {
-		c.JSON(400, gin.H{"error": "Couldn't process request - invalid request"})
-		log.Error(err.Error())
+	var attachments []client.AttachmentEntry
+	var err error
+	isMultipart := c.ContentType() == "multipart/form-data"
+	if isMultipart {
+		attachments, err = a.readMultipartSendRequest(c, &req)
+		defer a.signalClient.CleanupAttachments(attachments)
+		if err != nil {
+			var maxBytesError *http.MaxBytesError
+			var attachmentTooLargeError *client.AttachmentTooLargeError
+			if errors.As(err, &maxBytesError) || errors.As(err, &attachmentTooLargeError) {
+				c.JSON(413, Error{Msg: "Couldn't process request - upload exceeds the maximum size of " + strconv.FormatInt(a.maxUploadSize, 10) + " bytes"})
+				return
+			}
+			c.JSON(400, Error{Msg: "Couldn't process request - invalid request"})
+			log.Error(err.Error())
+			return
+		}
+	} else {
+		err = c.BindJSON(&req)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Couldn't process request - invalid request"})
+			log.Error(err.Error())
+			return
+		}
+	}
+
+	async := c.DefaultQuery("async", "false")
+	if async != "true" && async != "false" {
+		c.JSON(400, Error{Msg: "Couldn't process request - async parameter needs to be either 'true' or 'false'"})
 		return
 	}
 
-	if len(req.Recipients) == 0 {
-		c.JSON(400, gin.H{"error": "Couldn't process request - please provide at least one recipient"})
+	if isMultipart && StringToBool(async) {
+		c.JSON(400, Error{Msg: "Couldn't process request - multipart requests can't be sent asynchronously"})
 		return
 	}
 
-	if req.Number == "" {
-		c.JSON(400, gin.H{"error": "Couldn't process request - please provide a valid number"})
+	err = a.renderTemplate(sub, &req)
+	if err != nil {
+		clientError(c, err)
+		return
+	}
+
+	err = validateSendMessageV2(&req)
+	if err != nil {
+		clientError(c, err)
 		return
 	}
 
@@ -344,35 +595,435 @@ func (a *Api) SendV2(c *gin.Context) {
 		return
 	}
 
-	if req.Sticker != "" && !strings.Contains(req.Sticker, ":") {
-		c.JSON(400, gin.H{"error": "Couldn't process request - please provide valid sticker delimiter"})
+	if StringToBool(async) {
+		// the limit of the number is applied once the job is sent
+		if ok, retryAfter := a.subRateLimiter.Take(sub); !ok {
+			rateLimited(c, retryAfter)
+			return
+		}
+
+		job, err := a.sendQueue.Enqueue(sub, req.Number, req)
+		if err != nil {
+			c.JSON(500, Error{Msg: "Couldn't queue message: " + err.Error()})
+			return
+		}
+		c.JSON(202, SendJobCreatedResponse{Id: job.ID})
+		return
+	}
+
+	if ok, retryAfter := a.takeSendToken(sub, req.Number); !ok {
+		rateLimited(c, retryAfter)
 		return
 	}
 
-	response, err := a.signalClient.SendV2(
-		req.Number, req.Message, req.Recipients, req.Base64Attachments, req.Sticker,
-		req.Mentions, req.QuoteTimestamp, req.QuoteAuthor, req.QuoteMessage, req.QuoteMentions, req.TextMode)
+	response, err := a.sendV2(&req, attachments)
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 
 	c.JSON(201, response)
 }
 
-func (a *Api) handleSignalReceive(ws *websocket.Conn, number string, stop chan struct{}) {
-	receiveChannel, err := a.signalClient.GetReceiveChannel(number)
+// takeSendToken checks the rate limits of the number and the sub. In case one of them is exceeded,
+// false and the time after which it can be tried again are returned.
+func (a *Api) takeSendToken(sub string, number string) (bool, time.Duration) {
+	ok, retryAfter := a.numberRateLimiter.Take(number)
+	if !ok {
+		return false, retryAfter
+	}
+	ok, retryAfter = a.subRateLimiter.Take(sub)
+	if !ok {
+		a.numberRateLimiter.Return(number)
+		return false, retryAfter
+	}
+	return true, 0
+}
+
+func retryAfterSeconds(retryAfter time.Duration) int {
+	return int((retryAfter + time.Second - 1) / time.Second)
+}
+
+func rateLimited(c *gin.Context, retryAfter time.Duration) {
+	seconds := retryAfterSeconds(retryAfter)
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(429, RateLimitError{Msg: "Couldn't process request - rate limit exceeded", Code: ErrorCodeRateLimited, RetryAfter: seconds})
+}
+
+// readMultipartSendRequest parses a multipart/form-data send request. The message is expected as JSON
+// in the 'message' part, all file parts are streamed into the attachment tmp directory. The returned
+// attachments need to be cleaned up by the caller (also in case of an error).
+func (a *Api) readMultipartSendRequest(c *gin.Context, req *SendMessageV2) ([]client.AttachmentEntry, error) {
+	attachments := []client.AttachmentEntry{}
+	if a.maxUploadSize > 0 {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, a.maxUploadSize)
+	}
+
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		return attachments, err
+	}
+
+	foundMessage := false
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return attachments, err
+		}
+
+		if part.FormName() == "message" {
+			err = json.NewDecoder(part).Decode(req)
+			part.Close()
+			if err != nil {
+				return attachments, err
+			}
+			foundMessage = true
+			continue
+		}
+
+		if part.FileName() == "" {
+			part.Close()
+			continue
+		}
+
+		mimeType := part.Header.Get("Content-Type")
+		if mimeType == "application/octet-stream" {
+			mimeType = ""
+		}
+		attachment, err := a.signalClient.StoreAttachment(part, part.FileName(), mimeType, a.maxUploadSize)
+		part.Close()
+		if err != nil {
+			return attachments, err
+		}
+		attachments = append(attachments, *attachment)
+	}
+
+	if !foundMessage {
+		return attachments, errors.New("multipart request doesn't contain a message part")
+	}
+	return attachments, nil
+}
+
+// @Summary Edit a previously sent signal message.
+// @Tags Messages
+// @Description Replace the text of a previously sent message (identified by its timestamp). Set the text_mode to 'styled' in case you want to add formatting to your text message. Like for /v2/send, the response contains one entry per recipient with the new timestamp or the error if editing failed for it; an error response is only returned if editing failed for all recipients.
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} []client.SendResponse
+// @Failure 400 {object} Error
+// @Failure 409 {object} UntrustedIdentityError
+// @Failure 429 {object} RateLimitError
+// @Param number path string true "Registered Phone Number"
+// @Param timestamp path string true "Timestamp of the message that should be edited"
+// @Param data body EditMessageRequest true "Input Data"
+// @Param Idempotency-Key header string false "Unique key of the request; a retry with the same key returns the response of the original request instead of sending the message again"
+// @Router /v2/send/{number}/{timestamp} [put]
+func (a *Api) EditMessage(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+	number := c.Param("number")
+	if number == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - number missing"})
+		return
+	}
+
+	timestamp, err := strconv.ParseInt(c.Param("timestamp"), 10, 64)
+	if err != nil || timestamp <= 0 {
+		c.JSON(400, Error{Msg: "Couldn't process request - invalid timestamp"})
+		return
+	}
+
+	err = a.signalClient.CheckAccess(sub, number)
+	if err != nil {
+		c.JSON(403, Error{Msg: err.Error()})
+		return
+	}
+
+	var req EditMessageRequest
+	err = c.BindJSON(&req)
+	if err != nil {
+		c.JSON(400, Error{Msg: "Couldn't process request - invalid request"})
+		log.Error(err.Error())
+		return
+	}
+
+	if len(req.Recipients) == 0 {
+		c.JSON(400, Error{Msg: "Couldn't process request - please provide at least one recipient"})
+		return
+	}
+
+	if ok, retryAfter := a.takeSendToken(sub, number); !ok {
+		rateLimited(c, retryAfter)
+		return
+	}
+
+	response, err := a.signalClient.EditMessage(number, timestamp, req.Message, req.Recipients, req.Mentions, req.TextMode)
+	if err != nil {
+		clientError(c, err)
+		return
+	}
+
+	c.JSON(200, response)
+}
+
+// @Summary Send a batch of signal messages.
+// @Tags Messages
+// @Description Send a list of messages in one request. The messages are sent in parallel (the number of messages that are sent at the same time per number is limited) and the results are streamed back as newline delimited JSON as soon as each message is done, so the results aren't necessarily in the order of the request. The messages are read while the batch is sent, so the size of a batch isn't limited. A failing message doesn't affect the others; the status of each result corresponds to the status code /v2/send would have returned.
+// @Accept  json
+// @Produce  application/x-ndjson
+// @Success 200 {object} BatchSendResult
+// @Failure 400 {object} Error
+// @Param data body []SendMessageV2 true "Input Data"
+// @Param Idempotency-Key header string false "Unique key of the request; a retry with the same key returns the response of the original request instead of sending the message again"
+// @Router /v2/send/batch [post]
+func (a *Api) SendBatch(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+	decoder := json.NewDecoder(c.Request.Body)
+	token, err := decoder.Token()
+	if delim, ok := token.(json.Delim); err != nil || !ok || delim != '[' {
+		c.JSON(400, Error{Msg: "Couldn't process request - invalid request"})
+		return
+	}
+
+	if !decoder.More() {
+		c.JSON(400, Error{Msg: "Couldn't process request - please provide at least one message"})
+		return
+	}
+
+	// the messages are read while the results are written
+	err = http.NewResponseController(c.Writer).EnableFullDuplex()
+	if err != nil {
+		log.Debug("Couldn't enable full duplex for batch send: ", err.Error())
+	}
+
+	runner := newBatchRunner(a.batchParallelism,
+		func(index int, req *SendMessageV2) *BatchSendResult {
+			return a.prepareBatchItem(sub, index, req)
+		},
+		func(index int, req *SendMessageV2) BatchSendResult {
+			return a.sendBatchItem(sub, index, req)
+		})
+	go runner.run(decoder)
+
+	c.Writer.Header().Set("Content-Type", "application/x-ndjson")
+	c.Status(200)
+	encoder := json.NewEncoder(c.Writer)
+	for result := range runner.results {
+		err = encoder.Encode(result)
+		if err != nil {
+			// the client is gone, the remaining messages are still sent
+			log.Error("Couldn't write batch send result: ", err.Error())
+			continue
+		}
+		c.Writer.Flush()
+	}
+}
+
+// prepareBatchItem checks a message of a batch before it is queued. In case it can't be sent, the result is returned.
+func (a *Api) prepareBatchItem(sub string, index int, req *SendMessageV2) *BatchSendResult {
+	result := BatchSendResult{Index: index, Number: req.Number}
+
+	err := a.renderTemplate(sub, req)
+	if err == nil {
+		err = validateSendMessageV2(req)
+	}
+	if err != nil {
+		result.Status = 400
+		result.Error = err.Error()
+		return &result
+	}
+
+	err = a.signalClient.CheckAccess(sub, req.Number)
+	if err != nil {
+		result.Status = 403
+		result.Error = err.Error()
+		return &result
+	}
+	return nil
+}
+
+func (a *Api) sendBatchItem(sub string, index int, req *SendMessageV2) BatchSendResult {
+	result := BatchSendResult{Index: index, Number: req.Number}
+
+	if ok, retryAfter := a.takeSendToken(sub, req.Number); !ok {
+		result.Status = 429
+		result.Error = "Couldn't process request - rate limit exceeded"
+		result.Code = ErrorCodeRateLimited
+		result.RetryAfter = retryAfterSeconds(retryAfter)
+		return result
+	}
+
+	response, err := a.sendV2(req, nil)
+	if err != nil {
+		result.Status, result.Code = errorStatus(err, 400)
+		result.Error = err.Error()
+		var rateLimitError *client.RateLimitError
+		if errors.As(err, &rateLimitError) {
+			result.ChallengeToken = rateLimitError.ChallengeToken
+			result.RetryAfter = rateLimitError.RetryAfter
+		}
+		var untrustedIdentityError *client.UntrustedIdentityError
+		if errors.As(err, &untrustedIdentityError) {
+			result.UntrustedIdentities = untrustedIdentityError.Identities
+		}
+		return result
+	}
+
+	result.Status = 201
+	result.Response = response
+	return result
+}
+
+func validateSendMessageV2(req *SendMessageV2) error {
+	if len(req.Recipients) == 0 {
+		return errors.New("Couldn't process request - please provide at least one recipient")
+	}
+
+	if req.Number == "" {
+		return errors.New("Couldn't process request - please provide a valid number")
+	}
+
+	if req.Sticker != "" && !strings.Contains(req.Sticker, ":") {
+		return errors.New("Couldn't process request - please provide valid sticker delimiter")
+	}
+
+	return nil
+}
+
+func (a *Api) sendV2(req *SendMessageV2, attachments []client.AttachmentEntry) (*[]client.SendResponse, error) {
+	return a.signalClient.SendV2(
+		req.Number, req.Message, req.Recipients, req.Base64Attachments, req.AttachmentUrls, attachments, req.Sticker,
+		req.Mentions, req.QuoteTimestamp, req.QuoteAuthor, req.QuoteMessage, req.QuoteMentions, req.TextMode, req.LinkPreview)
+}
+
+// sendPayload sends a serialized SendMessageV2 request on behalf of the given sub. Errors of the
+// request itself are reported as permanentError, as retrying won't help. As it is used for queued
+// and scheduled messages, it waits for the rate limit of the number instead of failing.
+func (a *Api) sendPayload(sub string, number string, payload string) (*[]client.SendResponse, error) {
+	err := a.signalClient.CheckAccess(sub, number)
+	if err != nil {
+		return nil, &permanentError{err}
+	}
+
+	var req SendMessageV2
+	err = json.Unmarshal([]byte(payload), &req)
+	if err != nil {
+		return nil, &permanentError{err}
+	}
+
+	err = a.renderTemplate(sub, &req)
 	if err != nil {
-		log.Error("Couldn't get receive channel: ", err.Error())
+		return nil, &permanentError{err}
+	}
+
+	a.numberRateLimiter.Wait(number)
+	return a.sendV2(&req, nil)
+}
+
+func (a *Api) deliverSendJob(job *utils.SendJob) (*[]client.SendResponse, error) {
+	return a.sendPayload(job.Sub, job.Number, job.Payload)
+}
+
+func (a *Api) dispatchSchedule(schedule *utils.Schedule) (*[]client.SendResponse, error) {
+	return a.sendPayload(schedule.Sub, schedule.Number, schedule.Payload)
+}
+
+// @Summary Get the status of a send job.
+// @Tags Messages
+// @Description Get the status, the number of delivery attempts, the last error and the final response of a message that was sent with async=true. A message that was being sent while the API was shut down is marked as failed (and not sent again), as it is unknown whether it went out; its last error says so.
+// @Produce  json
+// @Success 200 {object} SendJobResponse
+// @Failure 404 {object} Error
+// @Param id path string true "Send Job ID"
+// @Router /v1/send/jobs/{id} [get]
+func (a *Api) GetSendJob(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+	id := c.Param("id")
+
+	job, ok := a.sendQueue.GetJob(id)
+	if !ok || job.Sub != sub {
+		c.JSON(404, Error{Msg: "No send job with that id found"})
 		return
 	}
 
+	resp := SendJobResponse{
+		Id:        job.ID,
+		Number:    job.Number,
+		Status:    job.Status,
+		Attempts:  job.Attempts,
+		LastError: job.LastError,
+		CreatedAt: job.CreatedAt,
+		UpdatedAt: job.UpdatedAt,
+	}
+	if job.Response != "" {
+		var sendResponse []client.SendResponse
+		err := json.Unmarshal([]byte(job.Response), &sendResponse)
+		if err != nil {
+			c.JSON(500, Error{Msg: "Couldn't parse response of send job"})
+			log.Error("Couldn't parse response of send job ", id, ": ", err.Error())
+			return
+		}
+		resp.Response = &sendResponse
+	}
+
+	c.JSON(200, resp)
+}
+
+// formatReceivedMessage applies the filter to a received envelope and converts it into the requested format.
+// It returns false if the envelope doesn't pass the filter or can't be represented in that format.
+func formatReceivedMessage(number string, data []byte, format string, filter *receiveFilter) ([]byte, bool) {
+	if format != receiveFormatV2 && filter.isEmpty() {
+		return data, true
+	}
+
+	received, err := client.ParseReceivedMessage(data)
+	if err != nil {
+		log.Debug("Couldn't parse received data of ", number, ": ", err.Error())
+		return nil, false
+	}
+	if !filter.matches(&received.Envelope) {
+		return nil, false
+	}
+	if format != receiveFormatV2 {
+		return data, true
+	}
+
+	messageBytes, err := json.Marshal(received.ToV2(number))
+	if err != nil {
+		log.Error("Couldn't serialize received message: ", err.Error())
+		return nil, false
+	}
+	return messageBytes, true
+}
+
+// parseReceiveFormat returns the format of the received messages the request asks for.
+func parseReceiveFormat(c *gin.Context) (string, bool) {
+	format := c.DefaultQuery("format", receiveFormatV1)
+	if format != receiveFormatV1 && format != receiveFormatV2 {
+		c.JSON(400, Error{Msg: "Couldn't process request - format needs to be either 'v1' or 'v2'"})
+		return "", false
+	}
+	return format, true
+}
+
+func (a *Api) handleSignalReceive(ws *websocket.Conn, number string, format string, filter *receiveFilter, subscription *client.ReceiveSubscription, stop chan struct{}) {
 	for {
 		select {
 		case <-stop:
 			ws.Close()
 			return
-		case msg := <-receiveChannel:
+		case event, ok := <-subscription.Events:
+			if !ok {
+				if subscription.Dropped() {
+					closeMsg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "Couldn't keep up with the received messages")
+					ws.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(writeWait))
+				}
+				ws.Close()
+				return
+			}
+			msg := event.Message
 			var data string = string(msg.Params)
 			var err error = nil
 			if msg.Err.Code != 0 {
@@ -381,7 +1032,11 @@ func (a *Api) handleSignalReceive(ws *websocket.Conn, number string, stop chan s
 
 			if err == nil {
 				if data != "" {
-					err = ws.WriteMessage(websocket.TextMessage, []byte(data))
+					formatted, ok := formatReceivedMessage(number, msg.Params, format, filter)
+					if !ok {
+						continue
+					}
+					err = ws.WriteMessage(websocket.TextMessage, formatted)
 					if err != nil {
 						if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 							log.Error("Couldn't write message: " + err.Error())
@@ -437,13 +1092,255 @@ func wsPing(ws *websocket.Conn, stop chan struct{}) {
 	}
 }
 
-func StringToBool(input string) bool {
-	return input == "true"
+// parseReceiveCursor parses the cursor a receiver wants to resume from; an empty string means no cursor.
+func parseReceiveCursor(value string) (*uint64, error) {
+	if value == "" {
+		return nil, nil
+	}
+	cursor, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
+
+// parseEventId parses the id of a Server-Sent Event: the timestamp of the envelope, optionally followed
+// by the cursor of the message ("<timestamp>-<cursor>") or, for replayed messages, by the id of the
+// stored message ("<timestamp>-s<id>").
+func parseEventId(id string) (int64, *uint64, uint, error) {
+	parts := strings.SplitN(id, "-", 2)
+	timestamp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || timestamp < 0 {
+		return 0, nil, 0, errors.New("invalid event id")
+	}
+	if len(parts) == 1 {
+		return timestamp, nil, 0, nil
+	}
+	if strings.HasPrefix(parts[1], "s") {
+		storedId, err := strconv.ParseUint(parts[1][1:], 10, 32)
+		if err != nil {
+			return 0, nil, 0, errors.New("invalid event id")
+		}
+		return timestamp, nil, uint(storedId), nil
+	}
+	cursor, err := parseReceiveCursor(parts[1])
+	if err != nil || cursor == nil {
+		return 0, nil, 0, errors.New("invalid event id")
+	}
+	return timestamp, cursor, 0, nil
+}
+
+// storedEventId returns the id of the Server-Sent Event of a replayed message.
+func storedEventId(message *utils.StoredMessage) string {
+	return strconv.FormatInt(message.Timestamp, 10) + "-s" + strconv.FormatUint(uint64(message.ID), 10)
+}
+
+// envelopeTimestamp returns the timestamp of a received envelope, which is used in the event id.
+func envelopeTimestamp(data []byte) int64 {
+	var received struct {
+		Envelope struct {
+			Timestamp int64 `json:"timestamp"`
+		} `json:"envelope"`
+	}
+	json.Unmarshal(data, &received)
+	return received.Envelope.Timestamp
+}
+
+// writeEvent writes a Server-Sent Event. The event name and the id are omitted if they are empty.
+func writeEvent(w gin.ResponseWriter, event string, id string, data []byte) error {
+	var buf bytes.Buffer
+	if event != "" {
+		buf.WriteString("event: " + event + "\n")
+	}
+	if id != "" {
+		buf.WriteString("id: " + id + "\n")
+	}
+	buf.WriteString("data: ")
+	buf.Write(data)
+	buf.WriteString("\n\n")
+
+	_, err := w.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
+
+// @Summary Receive Signal Messages as Server-Sent Events.
+// @Tags Messages
+// @Description Only works in json-rpc mode. Streams the received messages as text/event-stream; every event carries the same payload as the websocket of /v1/receive/{number} (errors are sent as 'error' events). The id of an event consists of the timestamp of the envelope and the cursor of the message (<timestamp>-<cursor>; <timestamp>-s<id> for messages replayed from the message store). When reconnecting with the Last-Event-ID header (or the last_event_id query parameter), the messages received in the meantime are replayed first: from the replay buffer if they are all still buffered, otherwise the stored messages that follow the event (unless the event was replayed from the message store itself, messages with the same timestamp as the event may be delivered again). At most 1000 stored messages are replayed; if there are more, a 'replay_truncated' event is sent after them, whose id can be used to replay the next ones. Clients that can't keep up are disconnected.
+// @Produce  text/event-stream
+// @Success 200 {string} string "Stream of events"
+// @Failure 400 {object} Error
+// @Param number path string true "Registered Phone Number"
+// @Param Last-Event-ID header string false "Id of the last event the client received"
+// @Param last_event_id query string false "Same as the Last-Event-ID header, for clients that can't set headers"
+// @Param format query string false "Format of the messages: 'v1' (default) passes the envelopes of signal-cli through, 'v2' returns them in a normalized format (see client.ReceivedMessageV2)" Enums(v1, v2)
+// @Param type query string false "Only deliver messages of these types (comma-separated: message, edit, reaction, remote_delete, sync, receipt, typing, story, call, other)"
+// @Param sender query string false "Only deliver messages of these senders (comma-separated phone numbers or uuids)"
+// @Param group_id query string false "Only deliver messages of these groups (comma-separated group ids)"
+// @Param has_text query string false "Only deliver messages with ('true') or without ('false') text"
+// @Param has_attachment query string false "Only deliver messages with ('true') or without ('false') attachments"
+// @Router /v1/receive/{number}/events [get]
+func (a *Api) ReceiveEvents(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+	number := c.Param("number")
+	if number == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - number missing"})
+		return
+	}
+
+	err := a.signalClient.CheckAccess(sub, number)
+	if err != nil {
+		c.JSON(403, Error{Msg: err.Error()})
+		return
+	}
+
+	if a.signalCliMode != client.JsonRpc {
+		c.JSON(400, Error{Msg: "Server-Sent Events are only supported in JSON-RPC mode"})
+		return
+	}
+
+	format, ok := parseReceiveFormat(c)
+	if !ok {
+		return
+	}
+
+	filter, err := parseReceiveFilter(c)
+	if err != nil {
+		c.JSON(400, Error{Msg: "Couldn't process request - " + err.Error()})
+		return
+	}
+
+	lastEventId := c.GetHeader("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = c.Query("last_event_id")
+	}
+	var lastTimestamp int64
+	var cursor *uint64
+	var lastStoredId uint
+	if lastEventId != "" {
+		lastTimestamp, cursor, lastStoredId, err = parseEventId(lastEventId)
+		if err != nil {
+			c.JSON(400, Error{Msg: "Couldn't process request - invalid Last-Event-ID"})
+			return
+		}
+	}
+
+	subscription, complete, err := a.signalClient.SubscribeReceive(number, cursor)
+	if err != nil {
+		clientError(c, err)
+		return
+	}
+	defer subscription.Close()
+
+	// if the messages after the cursor aren't buffered anymore, the stored messages are replayed instead
+	replay := []utils.StoredMessage{}
+	replayed := make(map[string]bool)
+	truncated := false
+	if lastEventId != "" && (cursor == nil || !complete) {
+		replay, err = a.signalClient.GetMessagesSince(number, lastTimestamp, lastStoredId, receiveEventsReplayLimit+1)
+		if err != nil {
+			clientError(c, err)
+			return
+		}
+		if len(replay) > receiveEventsReplayLimit {
+			replay = replay[:receiveEventsReplayLimit]
+			truncated = true
+		}
+		for _, message := range replay {
+			replayed[message.Envelope] = true
+		}
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// don't let nginx buffer the stream
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(200)
+	c.Writer.Flush()
+
+	for _, message := range replay {
+		formatted, ok := formatReceivedMessage(number, []byte(message.Envelope), format, filter)
+		if !ok {
+			continue
+		}
+		err = writeEvent(c.Writer, "", storedEventId(&message), formatted)
+		if err != nil {
+			return
+		}
+	}
+	if truncated {
+		lastReplayedId := storedEventId(&replay[len(replay)-1])
+		truncatedMsgBytes, err := json.Marshal(Error{Msg: "Only the first " + strconv.Itoa(receiveEventsReplayLimit) +
+			" missed messages were replayed; reconnect with the last event id " + lastReplayedId + " to replay the next ones"})
+		if err != nil {
+			log.Error("Couldn't serialize replay_truncated message: " + err.Error())
+			return
+		}
+		err = writeEvent(c.Writer, "replay_truncated", lastReplayedId, truncatedMsgBytes)
+		if err != nil {
+			return
+		}
+	}
+
+	pingTicker := time.NewTicker(pingPeriod)
+	defer pingTicker.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-pingTicker.C:
+			// a comment keeps proxies from closing the idle connection
+			_, err = c.Writer.Write([]byte(": ping\n\n"))
+			if err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case event, ok := <-subscription.Events:
+			if !ok {
+				return
+			}
+
+			msg := event.Message
+			if msg.Err.Code != 0 {
+				errorMsgBytes, err := json.Marshal(Error{Msg: msg.Err.Message})
+				if err != nil {
+					log.Error("Couldn't serialize error message: " + err.Error())
+					return
+				}
+				err = writeEvent(c.Writer, "error", "", errorMsgBytes)
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			if len(msg.Params) == 0 || replayed[string(msg.Params)] {
+				continue
+			}
+			formatted, ok := formatReceivedMessage(number, msg.Params, format, filter)
+			if !ok {
+				continue
+			}
+			id := strconv.FormatInt(envelopeTimestamp(msg.Params), 10) + "-" + strconv.FormatUint(event.Cursor, 10)
+			err = writeEvent(c.Writer, "", id, formatted)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func StringToBool(input string) bool {
+	return input == "true"
 }
 
 // @Summary Receive Signal Messages.
 // @Tags Messages
-// @Description Receives Signal Messages from the Signal Network. If you are running the docker container in normal/native mode, this is a GET endpoint. In json-rpc mode this is a websocket endpoint.
+// @Description Receives Signal Messages from the Signal Network. In json-rpc mode this is also a websocket endpoint; messages that arrive while no websocket is connected are buffered and can be fetched with a plain GET request. Any number of websockets can be connected at the same time, every one of them receives all messages. A websocket can resume from the cursor of a message (see the event ids of /v1/receive/{number}/events) as long as the following messages are still in the replay buffer; otherwise it is closed with code 4410. Websockets that can't keep up are closed.
 // @Accept  json
 // @Produce  json
 // @Success 200 {object} []string
@@ -452,7 +1349,14 @@ func StringToBool(input string) bool {
 // @Param timeout query string false "Receive timeout in seconds (default: 1)"
 // @Param ignore_attachments query string false "Specify whether the attachments of the received message should be ignored" (default: false)"
 // @Param ignore_stories query string false "Specify whether stories should be ignored when receiving messages" (default: false)"
-// @Param max_messages query string false "Specify the maximum number of messages to receive (default: unlimited)". Not available in json-rpc mode.
+// @Param max_messages query string false "Specify the maximum number of messages to receive (default: unlimited). In json-rpc mode, only the messages that match the filters are counted; in the other modes, the filters are applied afterwards. Messages that don't match the filters are consumed as well."
+// @Param cursor query string false "Only for websockets: replay the buffered messages after this cursor. If they aren't all buffered anymore, the websocket is closed with code 4410; the missed messages can be fetched with /v1/messages/{number} or /v1/receive/{number}/events instead."
+// @Param format query string false "Format of the messages: 'v1' (default) passes the envelopes of signal-cli through, 'v2' returns them in a normalized format that doesn't change with the signal-cli version (see client.ReceivedMessageV2)" Enums(v1, v2)
+// @Param type query string false "Only deliver messages of these types (comma-separated: message, edit, reaction, remote_delete, sync, receipt, typing, story, call, other)"
+// @Param sender query string false "Only deliver messages of these senders (comma-separated phone numbers or uuids)"
+// @Param group_id query string false "Only deliver messages of these groups (comma-separated group ids)"
+// @Param has_text query string false "Only deliver messages with ('true') or without ('false') text"
+// @Param has_attachment query string false "Only deliver messages with ('true') or without ('false') attachments"
 // @Router /v1/receive/{number} [get]
 func (a *Api) Receive(c *gin.Context) {
 	sub := c.MustGet("sub").(string)
@@ -468,15 +1372,46 @@ func (a *Api) Receive(c *gin.Context) {
 		return
 	}
 
-	if a.signalClient.GetSignalCliMode() == client.JsonRpc {
+	format, ok := parseReceiveFormat(c)
+	if !ok {
+		return
+	}
+
+	filter, err := parseReceiveFilter(c)
+	if err != nil {
+		c.JSON(400, Error{Msg: "Couldn't process request - " + err.Error()})
+		return
+	}
+
+	if a.signalClient.GetSignalCliMode() == client.JsonRpc && websocket.IsWebSocketUpgrade(c.Request) {
+		cursor, err := parseReceiveCursor(c.Query("cursor"))
+		if err != nil {
+			c.JSON(400, Error{Msg: "Couldn't process request - invalid cursor"})
+			return
+		}
+
+		subscription, complete, err := a.signalClient.SubscribeReceive(number, cursor)
+		if err != nil {
+			clientError(c, err)
+			return
+		}
+		defer subscription.Close()
+
 		ws, err := connectionUpgrader.Upgrade(c.Writer, c.Request, nil)
 		if err != nil {
-			c.JSON(400, Error{Msg: err.Error()})
+			clientError(c, err)
 			return
 		}
 		defer ws.Close()
+
+		if cursor != nil && !complete {
+			// the client has to fetch the missed messages from the message store (or the event stream)
+			closeMsg := websocket.FormatCloseMessage(wsCloseCursorExpired, "The messages after the cursor aren't buffered anymore")
+			ws.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(writeWait))
+			return
+		}
 		var stop = make(chan struct{})
-		go a.handleSignalReceive(ws, number, stop)
+		go a.handleSignalReceive(ws, number, format, filter, subscription, stop)
 		go wsPing(ws, stop)
 		wsPong(ws, stop)
 	} else {
@@ -506,9 +1441,37 @@ func (a *Api) Receive(c *gin.Context) {
 			return
 		}
 
-		jsonStr, err := a.signalClient.Receive(number, timeoutInt, StringToBool(ignoreAttachments), StringToBool(ignoreStories), maxMessagesInt)
+		// the filter is applied while receiving, so that max_messages counts the matching messages only
+		var match func(data []byte) bool
+		if !filter.isEmpty() {
+			match = func(data []byte) bool {
+				received, err := client.ParseReceivedMessage(data)
+				return err == nil && filter.matches(&received.Envelope)
+			}
+		}
+
+		jsonStr, err := a.signalClient.Receive(c.Request.Context(), number, timeoutInt, StringToBool(ignoreAttachments), StringToBool(ignoreStories), maxMessagesInt, match)
 		if err != nil {
-			c.JSON(400, Error{Msg: err.Error()})
+			clientError(c, err)
+			return
+		}
+
+		if format == receiveFormatV2 || !filter.isEmpty() {
+			var envelopes []json.RawMessage
+			err = json.Unmarshal([]byte(jsonStr), &envelopes)
+			if err != nil {
+				c.JSON(500, Error{Msg: "Couldn't parse received messages: " + err.Error()})
+				return
+			}
+
+			messages := []json.RawMessage{}
+			for _, envelope := range envelopes {
+				formatted, ok := formatReceivedMessage(number, envelope, format, filter)
+				if ok {
+					messages = append(messages, formatted)
+				}
+			}
+			c.JSON(200, messages)
 			return
 		}
 
@@ -577,7 +1540,7 @@ func (a *Api) CreateGroup(c *gin.Context) {
 
 	groupId, err := a.signalClient.CreateGroup(number, req.Name, req.Members, req.Description, editGroupPermission, addMembersPermission, groupLinkState)
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 
@@ -623,14 +1586,8 @@ func (a *Api) AddMembersToGroup(c *gin.Context) {
 
 	err = a.signalClient.AddMembersToGroup(number, groupId, req.Members)
 	if err != nil {
-		switch err.(type) {
-		case *client.NotFoundError:
-			c.JSON(404, Error{Msg: err.Error()})
-			return
-		default:
-			c.JSON(400, Error{Msg: err.Error()})
-			return
-		}
+		clientError(c, err)
+		return
 	}
 	c.Status(http.StatusNoContent)
 }
@@ -674,14 +1631,8 @@ func (a *Api) RemoveMembersFromGroup(c *gin.Context) {
 
 	err = a.signalClient.RemoveMembersFromGroup(number, groupId, req.Members)
 	if err != nil {
-		switch err.(type) {
-		case *client.NotFoundError:
-			c.JSON(404, Error{Msg: err.Error()})
-			return
-		default:
-			c.JSON(400, Error{Msg: err.Error()})
-			return
-		}
+		clientError(c, err)
+		return
 	}
 	c.Status(http.StatusNoContent)
 }
@@ -725,14 +1676,8 @@ func (a *Api) AddAdminsToGroup(c *gin.Context) {
 
 	err = a.signalClient.AddAdminsToGroup(number, groupId, req.Admins)
 	if err != nil {
-		switch err.(type) {
-		case *client.NotFoundError:
-			c.JSON(404, Error{Msg: err.Error()})
-			return
-		default:
-			c.JSON(400, Error{Msg: err.Error()})
-			return
-		}
+		clientError(c, err)
+		return
 	}
 	c.Status(http.StatusNoContent)
 }
@@ -776,14 +1721,8 @@ func (a *Api) RemoveAdminsFromGroup(c *gin.Context) {
 
 	err = a.signalClient.RemoveAdminsFromGroup(number, groupId, req.Admins)
 	if err != nil {
-		switch err.(type) {
-		case *client.NotFoundError:
-			c.JSON(404, Error{Msg: err.Error()})
-			return
-		default:
-			c.JSON(400, Error{Msg: err.Error()})
-			return
-		}
+		clientError(c, err)
+		return
 	}
 	c.Status(http.StatusNoContent)
 }
@@ -809,7 +1748,7 @@ func (a *Api) GetGroups(c *gin.Context) {
 
 	groups, err := a.signalClient.GetGroups(number)
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 
@@ -844,7 +1783,7 @@ func (a *Api) GetGroup(c *gin.Context) {
 
 	groupEntry, err := a.signalClient.GetGroup(number, groupId)
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 
@@ -887,13 +1826,13 @@ func (a *Api) DeleteGroup(c *gin.Context) {
 
 	groupId, err := client.ConvertGroupIdToInternalGroupId(base64EncodedGroupId)
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 
 	err = a.signalClient.DeleteGroup(number, groupId)
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 }
@@ -921,7 +1860,7 @@ func (a *Api) GetDeviceLinkUri(c *gin.Context) {
 
 	signalLinkUri, err := a.signalClient.GetDeviceLink(deviceName)
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 
@@ -958,7 +1897,7 @@ func (a *Api) GetLinkQrCode(c *gin.Context) {
 
 	png, err := a.signalClient.GetLinkQrCode(strings.Replace(deviceLinkUri, "\\u0026", "&", -1), qrCodeVersionInt)
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 
@@ -984,7 +1923,7 @@ func (a *Api) GetDeviceLinkAwait(c *gin.Context) {
 
 	number, err := a.signalClient.GetDeviceLinkAwait(strings.Replace(deviceLinkUri, "\\u0026", "&", -1), sub, c.Request.Context())
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 
@@ -1021,20 +1960,8 @@ func (a *Api) RemoveAttachment(c *gin.Context) {
 
 	err := a.signalClient.RemoveAttachment(attachment)
 	if err != nil {
-		switch err.(type) {
-		case *client.InvalidNameError:
-			c.JSON(400, Error{Msg: err.Error()})
-			return
-		case *client.NotFoundError:
-			c.JSON(404, Error{Msg: err.Error()})
-			return
-		case *client.InternalError:
-			c.JSON(500, Error{Msg: err.Error()})
-			return
-		default:
-			c.JSON(500, Error{Msg: err.Error()})
-			return
-		}
+		clientErrorWithStatus(c, err, 500)
+		return
 	}
 
 	c.Status(http.StatusNoContent)
@@ -1053,20 +1980,8 @@ func (a *Api) ServeAttachment(c *gin.Context) {
 
 	attachmentBytes, err := a.signalClient.GetAttachment(attachment)
 	if err != nil {
-		switch err.(type) {
-		case *client.InvalidNameError:
-			c.JSON(400, Error{Msg: err.Error()})
-			return
-		case *client.NotFoundError:
-			c.JSON(404, Error{Msg: err.Error()})
-			return
-		case *client.InternalError:
-			c.JSON(500, Error{Msg: err.Error()})
-			return
-		default:
-			c.JSON(500, Error{Msg: err.Error()})
-			return
-		}
+		clientErrorWithStatus(c, err, 500)
+		return
 	}
 
 	mime, err := mimetype.DetectReader(bytes.NewReader(attachmentBytes))
@@ -1122,7 +2037,7 @@ func (a *Api) UpdateProfile(c *gin.Context) {
 
 	err = a.signalClient.UpdateProfile(number, req.Name, req.Base64Avatar)
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 
@@ -1223,7 +2138,7 @@ func (a *Api) TrustIdentity(c *gin.Context) {
 
 	err = a.signalClient.TrustIdentity(number, numberToTrust, req.VerifiedSafetyNumber, req.TrustAllKnownKeys)
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 
@@ -1312,13 +2227,13 @@ func (a *Api) BlockGroup(c *gin.Context) {
 	groupId := c.Param("groupid")
 	internalGroupId, err := client.ConvertGroupIdToInternalGroupId(groupId)
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 
 	err = a.signalClient.BlockGroup(number, internalGroupId)
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 
@@ -1352,13 +2267,13 @@ func (a *Api) JoinGroup(c *gin.Context) {
 	groupId := c.Param("groupid")
 	internalGroupId, err := client.ConvertGroupIdToInternalGroupId(groupId)
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 
 	err = a.signalClient.JoinGroup(number, internalGroupId)
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 
@@ -1392,13 +2307,13 @@ func (a *Api) QuitGroup(c *gin.Context) {
 	groupId := c.Param("groupid")
 	internalGroupId, err := client.ConvertGroupIdToInternalGroupId(groupId)
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 
 	err = a.signalClient.QuitGroup(number, internalGroupId)
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 	c.Status(http.StatusNoContent)
@@ -1432,7 +2347,7 @@ func (a *Api) UpdateGroup(c *gin.Context) {
 	groupId := c.Param("groupid")
 	internalGroupId, err := client.ConvertGroupIdToInternalGroupId(groupId)
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 
@@ -1446,22 +2361,24 @@ func (a *Api) UpdateGroup(c *gin.Context) {
 
 	err = a.signalClient.UpdateGroup(number, internalGroupId, req.Base64Avatar, req.Description)
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 	c.Status(http.StatusNoContent)
 }
 
-// @Summary Send a reaction.
-// @Tags Reactions
-// @Description React to a message
+// @Summary Delete a sent message.
+// @Tags Messages
+// @Description Delete a previously sent message (identified by its timestamp) for a contact or a group (remote delete).
 // @Accept  json
 // @Produce  json
 // @Success 204 {string} OK
 // @Failure 400 {object} Error
-// @Param data body Reaction true "Reaction"
-// @Router /v1/reactions/{number} [post]
-func (a *Api) SendReaction(c *gin.Context) {
+// @Param number path string true "Registered Phone Number"
+// @Param timestamp path string true "Timestamp of the message that should be deleted"
+// @Param data body RemoteDeleteRequest true "Input Data"
+// @Router /v1/messages/{number}/{timestamp} [delete]
+func (a *Api) RemoteDelete(c *gin.Context) {
 	sub := c.MustGet("sub").(string)
 	number := c.Param("number")
 	if number == "" {
@@ -1469,13 +2386,19 @@ func (a *Api) SendReaction(c *gin.Context) {
 		return
 	}
 
-	err := a.signalClient.CheckAccess(sub, number)
+	timestamp, err := strconv.ParseInt(c.Param("timestamp"), 10, 64)
+	if err != nil || timestamp <= 0 {
+		c.JSON(400, Error{Msg: "Couldn't process request - invalid timestamp"})
+		return
+	}
+
+	err = a.signalClient.CheckAccess(sub, number)
 	if err != nil {
 		c.JSON(403, Error{Msg: err.Error()})
 		return
 	}
 
-	var req Reaction
+	var req RemoteDeleteRequest
 	err = c.BindJSON(&req)
 	if err != nil {
 		c.JSON(400, Error{Msg: "Couldn't process request - invalid request"})
@@ -1488,39 +2411,31 @@ func (a *Api) SendReaction(c *gin.Context) {
 		return
 	}
 
-	if req.Reaction == "" {
-		c.JSON(400, Error{Msg: "Couldn't process request - reaction missing"})
-		return
-	}
-
-	if req.TargetAuthor == "" {
-		c.JSON(400, Error{Msg: "Couldn't process request - target_author missing"})
-		return
-	}
-
-	if req.Timestamp == 0 {
-		c.JSON(400, Error{Msg: "Couldn't process request - timestamp missing"})
-		return
-	}
-
-	err = a.signalClient.SendReaction(number, req.Recipient, req.Reaction, req.TargetAuthor, req.Timestamp, false)
+	err = a.signalClient.RemoteDelete(number, req.Recipient, timestamp)
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 	c.Status(http.StatusNoContent)
 }
 
-// @Summary Remove a reaction.
-// @Tags Reactions
-// @Description Remove a reaction
-// @Accept  json
+// @Summary List the stored messages.
+// @Tags Messages
+// @Description List the messages that were received by the number, newest first. Every received envelope is stored (how long it is kept can be configured per number with the message_retention_days setting). The messages can be filtered and searched; in case there are more messages than the limit, the response contains a cursor to fetch the next page with.
 // @Produce  json
-// @Success 204 {string} OK
+// @Success 200 {object} MessagesResponse
 // @Failure 400 {object} Error
-// @Param data body Reaction true "Reaction"
-// @Router /v1/reactions/{number} [delete]
-func (a *Api) RemoveReaction(c *gin.Context) {
+// @Param number path string true "Registered Phone Number"
+// @Param sender query string false "Only messages of this sender (phone number or uuid)"
+// @Param group_id query string false "Only messages of this group"
+// @Param type query string false "Only messages of this type (message, edit, reaction, remote_delete, sync, receipt, typing, story, call, other)"
+// @Param from query int false "Only messages with a timestamp (in milliseconds) >= from"
+// @Param to query int false "Only messages with a timestamp (in milliseconds) <= to"
+// @Param q query string false "Only messages whose text contains all of the given words"
+// @Param limit query int false "Maximum number of messages (default: 50, maximum: 500)"
+// @Param cursor query string false "Cursor of the page (as returned in next_cursor)"
+// @Router /v1/messages/{number} [get]
+func (a *Api) GetMessages(c *gin.Context) {
 	sub := c.MustGet("sub").(string)
 	number := c.Param("number")
 	if number == "" {
@@ -1534,46 +2449,255 @@ func (a *Api) RemoveReaction(c *gin.Context) {
 		return
 	}
 
-	var req Reaction
-	err = c.BindJSON(&req)
-	if err != nil {
-		c.JSON(400, Error{Msg: "Couldn't process request - invalid request"})
-		log.Error(err.Error())
-		return
+	filter := utils.MessageFilter{
+		Account: number,
+		Sender:  c.Query("sender"),
+		GroupId: c.Query("group_id"),
+		Type:    c.Query("type"),
+		Query:   c.Query("q"),
+		Cursor:  c.Query("cursor"),
 	}
 
-	if req.Recipient == "" {
-		c.JSON(400, Error{Msg: "Couldn't process request - recipient missing"})
+	if filter.Type != "" && !utils.IsValidMessageType(filter.Type) {
+		c.JSON(400, Error{Msg: "Couldn't process request - invalid type"})
 		return
 	}
 
-	if req.TargetAuthor == "" {
-		c.JSON(400, Error{Msg: "Couldn't process request - target_author missing"})
-		return
+	if from := c.Query("from"); from != "" {
+		filter.From, err = strconv.ParseInt(from, 10, 64)
+		if err != nil || filter.From < 0 {
+			c.JSON(400, Error{Msg: "Couldn't process request - from needs to be a timestamp in milliseconds"})
+			return
+		}
 	}
 
-	if req.Timestamp == 0 {
-		c.JSON(400, Error{Msg: "Couldn't process request - timestamp missing"})
+	if to := c.Query("to"); to != "" {
+		filter.To, err = strconv.ParseInt(to, 10, 64)
+		if err != nil || filter.To < 0 {
+			c.JSON(400, Error{Msg: "Couldn't process request - to needs to be a timestamp in milliseconds"})
+			return
+		}
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 || limit > 500 {
+		c.JSON(400, Error{Msg: "Couldn't process request - limit needs to be a number between 1 and 500"})
 		return
 	}
+	filter.Limit = limit
 
-	err = a.signalClient.SendReaction(number, req.Recipient, req.Reaction, req.TargetAuthor, req.Timestamp, true)
+	messages, nextCursor, err := a.signalClient.GetMessages(filter)
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
-	c.Status(http.StatusNoContent)
+
+	resp := MessagesResponse{Messages: []StoredMessageResponse{}, NextCursor: nextCursor}
+	for _, message := range messages {
+		resp.Messages = append(resp.Messages, StoredMessageResponse{
+			Id:        message.ID,
+			Account:   message.Account,
+			Sender:    message.Sender,
+			GroupId:   message.GroupId,
+			Type:      message.Type,
+			Timestamp: message.Timestamp,
+			Message:   message.Message,
+			Envelope:  json.RawMessage(message.Envelope),
+		})
+	}
+	c.JSON(200, resp)
 }
 
-// @Summary Show Typing Indicator.
-// @Tags Messages
-// @Description Show Typing Indicator.
+// @Summary Send a receipt.
+// @Tags Receipts
+// @Description Mark received messages (identified by their timestamps) as read or viewed.
 // @Accept  json
 // @Produce  json
 // @Success 204 {string} OK
 // @Failure 400 {object} Error
 // @Param number path string true "Registered Phone Number"
-// @Param data body TypingIndicatorRequest true "Type"
+// @Param data body ReceiptRequest true "Receipt"
+// @Router /v1/receipts/{number} [post]
+func (a *Api) SendReceipt(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+	number := c.Param("number")
+	if number == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - number missing"})
+		return
+	}
+
+	err := a.signalClient.CheckAccess(sub, number)
+	if err != nil {
+		c.JSON(403, Error{Msg: err.Error()})
+		return
+	}
+
+	var req ReceiptRequest
+	err = c.BindJSON(&req)
+	if err != nil {
+		c.JSON(400, Error{Msg: "Couldn't process request - invalid request"})
+		log.Error(err.Error())
+		return
+	}
+
+	err = validateReceiptRequest(&req)
+	if err != nil {
+		c.JSON(400, Error{Msg: err.Error()})
+		return
+	}
+
+	err = a.signalClient.SendReceipt(number, req.Recipient, req.Timestamps, req.Type)
+	if err != nil {
+		clientError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func validateReceiptRequest(req *ReceiptRequest) error {
+	if req.Recipient == "" {
+		return errors.New("Couldn't process request - recipient missing")
+	}
+
+	if len(req.Timestamps) == 0 {
+		return errors.New("Couldn't process request - timestamps missing")
+	}
+
+	for _, timestamp := range req.Timestamps {
+		if timestamp <= 0 {
+			return errors.New("Couldn't process request - invalid timestamp " + strconv.FormatInt(timestamp, 10))
+		}
+	}
+
+	if req.Type != "read" && req.Type != "viewed" {
+		return errors.New("Couldn't process request - type needs to be either 'read' or 'viewed'")
+	}
+
+	return nil
+}
+
+// @Summary Send a reaction.
+// @Tags Reactions
+// @Description React to a message
+// @Accept  json
+// @Produce  json
+// @Success 204 {string} OK
+// @Failure 400 {object} Error
+// @Param data body Reaction true "Reaction"
+// @Router /v1/reactions/{number} [post]
+func (a *Api) SendReaction(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+	number := c.Param("number")
+	if number == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - number missing"})
+		return
+	}
+
+	err := a.signalClient.CheckAccess(sub, number)
+	if err != nil {
+		c.JSON(403, Error{Msg: err.Error()})
+		return
+	}
+
+	var req Reaction
+	err = c.BindJSON(&req)
+	if err != nil {
+		c.JSON(400, Error{Msg: "Couldn't process request - invalid request"})
+		log.Error(err.Error())
+		return
+	}
+
+	if req.Recipient == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - recipient missing"})
+		return
+	}
+
+	if req.Reaction == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - reaction missing"})
+		return
+	}
+
+	if req.TargetAuthor == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - target_author missing"})
+		return
+	}
+
+	if req.Timestamp == 0 {
+		c.JSON(400, Error{Msg: "Couldn't process request - timestamp missing"})
+		return
+	}
+
+	err = a.signalClient.SendReaction(number, req.Recipient, req.Reaction, req.TargetAuthor, req.Timestamp, false)
+	if err != nil {
+		clientError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// @Summary Remove a reaction.
+// @Tags Reactions
+// @Description Remove a reaction
+// @Accept  json
+// @Produce  json
+// @Success 204 {string} OK
+// @Failure 400 {object} Error
+// @Param data body Reaction true "Reaction"
+// @Router /v1/reactions/{number} [delete]
+func (a *Api) RemoveReaction(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+	number := c.Param("number")
+	if number == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - number missing"})
+		return
+	}
+
+	err := a.signalClient.CheckAccess(sub, number)
+	if err != nil {
+		c.JSON(403, Error{Msg: err.Error()})
+		return
+	}
+
+	var req Reaction
+	err = c.BindJSON(&req)
+	if err != nil {
+		c.JSON(400, Error{Msg: "Couldn't process request - invalid request"})
+		log.Error(err.Error())
+		return
+	}
+
+	if req.Recipient == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - recipient missing"})
+		return
+	}
+
+	if req.TargetAuthor == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - target_author missing"})
+		return
+	}
+
+	if req.Timestamp == 0 {
+		c.JSON(400, Error{Msg: "Couldn't process request - timestamp missing"})
+		return
+	}
+
+	err = a.signalClient.SendReaction(number, req.Recipient, req.Reaction, req.TargetAuthor, req.Timestamp, true)
+	if err != nil {
+		clientError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// @Summary Show Typing Indicator.
+// @Tags Messages
+// @Description Show Typing Indicator.
+// @Accept  json
+// @Produce  json
+// @Success 204 {string} OK
+// @Failure 400 {object} Error
+// @Param number path string true "Registered Phone Number"
+// @Param data body TypingIndicatorRequest true "Type"
 // @Router /v1/typing-indicator/{number} [put]
 func (a *Api) SendStartTyping(c *gin.Context) {
 	sub := c.MustGet("sub").(string)
@@ -1599,7 +2723,7 @@ func (a *Api) SendStartTyping(c *gin.Context) {
 
 	err = a.signalClient.SendStartTyping(number, req.Recipient)
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 	c.Status(http.StatusNoContent)
@@ -1639,7 +2763,7 @@ func (a *Api) SendStopTyping(c *gin.Context) {
 
 	err = a.signalClient.SendStopTyping(number, req.Recipient)
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 	c.Status(http.StatusNoContent)
@@ -1666,7 +2790,7 @@ func (a *Api) SearchForNumbers(c *gin.Context) {
 
 	searchResults, err := a.signalClient.SearchForNumbers(number, query["numbers"])
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 
@@ -1704,7 +2828,7 @@ func (a *Api) GetContact(c *gin.Context) {
 
 	contacts, err := a.signalClient.GetContacts(number)
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 
@@ -1749,7 +2873,7 @@ func (a *Api) UpdateContact(c *gin.Context) {
 
 	err = a.signalClient.UpdateContact(number, req.Recipient, req.Name, req.ExpirationInSeconds)
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 	c.Status(http.StatusNoContent)
@@ -1788,7 +2912,7 @@ func (a *Api) AddDevice(c *gin.Context) {
 
 	err = a.signalClient.AddDevice(number, req.Uri)
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 	c.Status(http.StatusNoContent)
@@ -1796,7 +2920,7 @@ func (a *Api) AddDevice(c *gin.Context) {
 
 // @Summary Set account specific settings.
 // @Tags General
-// @Description Set account specific settings.
+// @Description Set account specific settings: the trust mode and the number of days received messages are stored (message_retention_days; 0 keeps them forever). Only the settings that are provided are changed.
 // @Accept json
 // @Produce json
 // @Param number path string true "Registered Phone Number"
@@ -1825,18 +2949,39 @@ func (a *Api) SetTrustMode(c *gin.Context) {
 		return
 	}
 
-	trustMode, err := utils.StringToTrustMode(req.TrustMode)
-	if err != nil {
-		c.JSON(400, Error{Msg: "Invalid trust mode"})
-		return
+	// all settings are checked before any of them is changed
+	setTrustMode := req.TrustMode != "" || req.MessageRetentionDays == nil
+	var trustMode utils.SignalCliTrustMode
+	if setTrustMode {
+		trustMode, err = utils.StringToTrustMode(req.TrustMode)
+		if err != nil {
+			c.JSON(400, Error{Msg: "Invalid trust mode"})
+			return
+		}
 	}
 
-	err = a.signalClient.SetTrustMode(number, trustMode)
-	if err != nil {
-		c.JSON(400, Error{Msg: "Couldn't set trust mode"})
-		log.Error("Couldn't set trust mode: ", err.Error())
+	if req.MessageRetentionDays != nil && *req.MessageRetentionDays < 0 {
+		c.JSON(400, Error{Msg: "Couldn't process request - message_retention_days needs to be a number >= 0"})
 		return
 	}
+
+	if setTrustMode {
+		err = a.signalClient.SetTrustMode(number, trustMode)
+		if err != nil {
+			c.JSON(400, Error{Msg: "Couldn't set trust mode"})
+			log.Error("Couldn't set trust mode: ", err.Error())
+			return
+		}
+	}
+
+	if req.MessageRetentionDays != nil {
+		err = a.signalClient.SetMessageRetention(number, *req.MessageRetentionDays)
+		if err != nil {
+			c.JSON(400, Error{Msg: "Couldn't set message retention"})
+			log.Error("Couldn't set message retention: ", err.Error())
+			return
+		}
+	}
 	c.Status(http.StatusNoContent)
 }
 
@@ -1872,6 +3017,10 @@ func (a *Api) GetTrustMode(c *gin.Context) {
 		return
 	}
 
+	if messageRetentionDays, ok := a.signalClient.GetMessageRetention(number); ok {
+		trustMode.MessageRetentionDays = &messageRetentionDays
+	}
+
 	c.JSON(200, trustMode)
 }
 
@@ -1900,7 +3049,7 @@ func (a *Api) SendContacts(c *gin.Context) {
 
 	err = a.signalClient.SendContacts(number)
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 	c.Status(http.StatusNoContent)
@@ -1923,7 +3072,7 @@ func (a *Api) Login(c *gin.Context) {
 
 	err := a.signalClient.Login(sub, number)
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 
@@ -1947,7 +3096,7 @@ func (a *Api) Logout(c *gin.Context) {
 
 	err := a.signalClient.Logout(sub, number)
 	if err != nil {
-		c.JSON(400, Error{Msg: err.Error()})
+		clientError(c, err)
 		return
 	}
 
@@ -1972,3 +3121,1298 @@ func (a *Api) GetNumbers(c *gin.Context) {
 
 	c.JSON(http.StatusOK, numbers)
 }
+
+func (a *Api) toScheduleResponse(schedule *utils.Schedule) (ScheduleResponse, error) {
+	resp := ScheduleResponse{
+		Id:        schedule.ID,
+		Number:    schedule.Number,
+		SendAt:    schedule.SendAt,
+		Cron:      schedule.Cron,
+		Active:    schedule.Active,
+		NextRun:   a.scheduler.NextRun(schedule),
+		CreatedAt: schedule.CreatedAt,
+		UpdatedAt: schedule.UpdatedAt,
+	}
+	err := json.Unmarshal([]byte(schedule.Payload), &resp.Message)
+	return resp, err
+}
+
+// applyScheduleRequest validates the request and copies it into the given schedule.
+func (a *Api) applyScheduleRequest(schedule *utils.Schedule, req *ScheduleRequest) error {
+	req.Message.Number = schedule.Number
+	err := validateSendMessageV2(&req.Message)
+	if err != nil {
+		return err
+	}
+
+	if (req.SendAt == nil) == (req.Cron == nil) {
+		return errors.New("Couldn't process request - please provide either send_at or cron")
+	}
+
+	if req.SendAt != nil {
+		if !req.SendAt.After(time.Now()) {
+			return errors.New("Couldn't process request - send_at needs to be in the future")
+		}
+		schedule.SendAt = req.SendAt
+		schedule.Cron = ""
+	} else {
+		_, err = a.scheduler.ParseCron(*req.Cron)
+		if err != nil {
+			return errors.New("Couldn't process request - invalid cron expression: " + err.Error())
+		}
+		schedule.SendAt = nil
+		schedule.Cron = *req.Cron
+	}
+
+	payload, err := json.Marshal(req.Message)
+	if err != nil {
+		return err
+	}
+	schedule.Payload = string(payload)
+	schedule.Active = true
+	return nil
+}
+
+// getSchedule returns the schedule with the id from the request path, if it belongs to the number from the request path.
+func (a *Api) getSchedule(c *gin.Context, number string) (*utils.Schedule, bool) {
+	schedule, ok := a.scheduler.scheduleStorage.GetSchedule(c.Param("id"))
+	if !ok || schedule.Number != number {
+		c.JSON(404, Error{Msg: "No schedule with that id found"})
+		return nil, false
+	}
+	return schedule, true
+}
+
+// @Summary Create a scheduled message.
+// @Tags Schedules
+// @Description Schedule a message. Either provide send_at to send the message once at the given time or a cron expression (minute, hour, day of month, month, day of week) to send it repeatedly.
+// @Accept  json
+// @Produce  json
+// @Success 201 {object} ScheduleResponse
+// @Failure 400 {object} Error
+// @Param number path string true "Registered Phone Number"
+// @Param data body ScheduleRequest true "Schedule"
+// @Router /v1/schedules/{number} [post]
+func (a *Api) CreateSchedule(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+	number := c.Param("number")
+	if number == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - number missing"})
+		return
+	}
+
+	err := a.signalClient.CheckAccess(sub, number)
+	if err != nil {
+		c.JSON(403, Error{Msg: err.Error()})
+		return
+	}
+
+	var req ScheduleRequest
+	err = c.BindJSON(&req)
+	if err != nil {
+		c.JSON(400, Error{Msg: "Couldn't process request - invalid request"})
+		log.Error(err.Error())
+		return
+	}
+
+	u, err := uuid.NewV4()
+	if err != nil {
+		c.JSON(500, Error{Msg: err.Error()})
+		return
+	}
+
+	schedule := utils.Schedule{ID: u.String(), Sub: sub, Number: number}
+	err = a.applyScheduleRequest(&schedule, &req)
+	if err != nil {
+		clientError(c, err)
+		return
+	}
+
+	err = a.scheduler.scheduleStorage.CreateSchedule(&schedule)
+	if err != nil {
+		c.JSON(500, Error{Msg: "Couldn't store schedule: " + err.Error()})
+		return
+	}
+
+	err = a.scheduler.Add(&schedule)
+	if err != nil {
+		c.JSON(500, Error{Msg: "Couldn't register schedule: " + err.Error()})
+		return
+	}
+
+	resp, err := a.toScheduleResponse(&schedule)
+	if err != nil {
+		c.JSON(500, Error{Msg: err.Error()})
+		return
+	}
+	c.JSON(201, resp)
+}
+
+// @Summary List all scheduled messages.
+// @Tags Schedules
+// @Description List all scheduled messages of the given number.
+// @Produce  json
+// @Success 200 {object} []ScheduleResponse
+// @Failure 400 {object} Error
+// @Param number path string true "Registered Phone Number"
+// @Router /v1/schedules/{number} [get]
+func (a *Api) GetSchedules(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+	number := c.Param("number")
+	if number == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - number missing"})
+		return
+	}
+
+	err := a.signalClient.CheckAccess(sub, number)
+	if err != nil {
+		c.JSON(403, Error{Msg: err.Error()})
+		return
+	}
+
+	schedules, err := a.scheduler.scheduleStorage.GetSchedulesByNumber(number)
+	if err != nil {
+		c.JSON(500, Error{Msg: err.Error()})
+		return
+	}
+
+	resp := []ScheduleResponse{}
+	for i := range schedules {
+		scheduleResponse, err := a.toScheduleResponse(&schedules[i])
+		if err != nil {
+			c.JSON(500, Error{Msg: err.Error()})
+			return
+		}
+		resp = append(resp, scheduleResponse)
+	}
+	c.JSON(200, resp)
+}
+
+// @Summary Get a scheduled message.
+// @Tags Schedules
+// @Description Get a scheduled message.
+// @Produce  json
+// @Success 200 {object} ScheduleResponse
+// @Failure 404 {object} Error
+// @Param number path string true "Registered Phone Number"
+// @Param id path string true "Schedule ID"
+// @Router /v1/schedules/{number}/{id} [get]
+func (a *Api) GetSchedule(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+	number := c.Param("number")
+	if number == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - number missing"})
+		return
+	}
+
+	err := a.signalClient.CheckAccess(sub, number)
+	if err != nil {
+		c.JSON(403, Error{Msg: err.Error()})
+		return
+	}
+
+	schedule, ok := a.getSchedule(c, number)
+	if !ok {
+		return
+	}
+
+	resp, err := a.toScheduleResponse(schedule)
+	if err != nil {
+		c.JSON(500, Error{Msg: err.Error()})
+		return
+	}
+	c.JSON(200, resp)
+}
+
+// @Summary Update a scheduled message.
+// @Tags Schedules
+// @Description Replace the message and the schedule of a scheduled message. An already completed one-shot schedule becomes active again.
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} ScheduleResponse
+// @Failure 400 {object} Error
+// @Param number path string true "Registered Phone Number"
+// @Param id path string true "Schedule ID"
+// @Param data body ScheduleRequest true "Schedule"
+// @Router /v1/schedules/{number}/{id} [put]
+func (a *Api) UpdateSchedule(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+	number := c.Param("number")
+	if number == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - number missing"})
+		return
+	}
+
+	err := a.signalClient.CheckAccess(sub, number)
+	if err != nil {
+		c.JSON(403, Error{Msg: err.Error()})
+		return
+	}
+
+	schedule, ok := a.getSchedule(c, number)
+	if !ok {
+		return
+	}
+
+	var req ScheduleRequest
+	err = c.BindJSON(&req)
+	if err != nil {
+		c.JSON(400, Error{Msg: "Couldn't process request - invalid request"})
+		log.Error(err.Error())
+		return
+	}
+
+	err = a.applyScheduleRequest(schedule, &req)
+	if err != nil {
+		clientError(c, err)
+		return
+	}
+
+	err = a.scheduler.Save(schedule)
+	if err != nil {
+		c.JSON(500, Error{Msg: "Couldn't store schedule: " + err.Error()})
+		return
+	}
+
+	resp, err := a.toScheduleResponse(schedule)
+	if err != nil {
+		c.JSON(500, Error{Msg: err.Error()})
+		return
+	}
+	c.JSON(200, resp)
+}
+
+// @Summary Delete a scheduled message.
+// @Tags Schedules
+// @Description Delete a scheduled message together with its run history.
+// @Produce  json
+// @Success 204 {string} OK
+// @Failure 404 {object} Error
+// @Param number path string true "Registered Phone Number"
+// @Param id path string true "Schedule ID"
+// @Router /v1/schedules/{number}/{id} [delete]
+func (a *Api) DeleteSchedule(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+	number := c.Param("number")
+	if number == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - number missing"})
+		return
+	}
+
+	err := a.signalClient.CheckAccess(sub, number)
+	if err != nil {
+		c.JSON(403, Error{Msg: err.Error()})
+		return
+	}
+
+	schedule, ok := a.getSchedule(c, number)
+	if !ok {
+		return
+	}
+
+	a.scheduler.Remove(schedule.ID)
+	err = a.scheduler.scheduleStorage.DeleteSchedule(schedule.ID)
+	if err != nil {
+		c.JSON(500, Error{Msg: "Couldn't delete schedule: " + err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// @Summary List the run history of a scheduled message.
+// @Tags Schedules
+// @Description List the past runs of a scheduled message, most recent run first.
+// @Produce  json
+// @Success 200 {object} []ScheduleRunResponse
+// @Failure 404 {object} Error
+// @Param number path string true "Registered Phone Number"
+// @Param id path string true "Schedule ID"
+// @Param limit query string false "Maximum number of runs to return (default: 100)"
+// @Router /v1/schedules/{number}/{id}/runs [get]
+func (a *Api) GetScheduleRuns(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+	number := c.Param("number")
+	if number == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - number missing"})
+		return
+	}
+
+	err := a.signalClient.CheckAccess(sub, number)
+	if err != nil {
+		c.JSON(403, Error{Msg: err.Error()})
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 {
+		c.JSON(400, Error{Msg: "Couldn't process request - limit needs to be a positive number!"})
+		return
+	}
+
+	schedule, ok := a.getSchedule(c, number)
+	if !ok {
+		return
+	}
+
+	runs, err := a.scheduler.scheduleStorage.GetScheduleRuns(schedule.ID, limit)
+	if err != nil {
+		c.JSON(500, Error{Msg: err.Error()})
+		return
+	}
+
+	resp := []ScheduleRunResponse{}
+	for _, run := range runs {
+		runResponse := ScheduleRunResponse{RunAt: run.RunAt, Success: run.Success, Error: run.Error}
+		if run.Response != "" {
+			var sendResponse []client.SendResponse
+			err = json.Unmarshal([]byte(run.Response), &sendResponse)
+			if err == nil {
+				runResponse.Response = &sendResponse
+			}
+		}
+		resp = append(resp, runResponse)
+	}
+	c.JSON(200, resp)
+}
+
+func toWebhookResponse(webhook *utils.Webhook) WebhookResponse {
+	resp := WebhookResponse{
+		Id:           webhook.ID,
+		Number:       webhook.Number,
+		Url:          webhook.Url,
+		MessageTypes: []string{},
+		CreatedAt:    webhook.CreatedAt,
+	}
+	if webhook.MessageTypes != "" {
+		resp.MessageTypes = strings.Split(webhook.MessageTypes, ",")
+	}
+	return resp
+}
+
+// getWebhook returns the webhook with the id from the request path, if it belongs to the number from the request path.
+func (a *Api) getWebhook(c *gin.Context, number string) (*utils.Webhook, bool) {
+	webhook, ok := a.webhookDispatcher.webhookStorage.GetWebhook(c.Param("id"))
+	if !ok || webhook.Number != number {
+		c.JSON(404, Error{Msg: "No webhook with that id found"})
+		return nil, false
+	}
+	return webhook, true
+}
+
+// getWebhookDeadLetter returns the dead letter with the id from the request path, if it belongs to the webhook.
+func (a *Api) getWebhookDeadLetter(c *gin.Context, webhook *utils.Webhook) (*utils.WebhookDelivery, bool) {
+	delivery, ok := a.webhookDispatcher.webhookStorage.GetDelivery(c.Param("deliveryid"))
+	if !ok || delivery.WebhookID != webhook.ID || delivery.Status != utils.WebhookDeliveryDead {
+		c.JSON(404, Error{Msg: "No dead letter with that id found"})
+		return nil, false
+	}
+	return delivery, true
+}
+
+// @Summary Create a webhook.
+// @Tags Webhooks
+// @Description Every envelope the number receives (only in json-rpc mode) is POSTed to the URL of the webhook. Every request is signed with HMAC-SHA256 using the secret of the webhook: the signed data is the X-Signal-Timestamp header (unix time in seconds the request was sent at), a dot and the body (<timestamp>.<body>); the signature is sent in the X-Signal-Signature-256 header (sha256=<hex encoded signature>). Receivers should compute the signature themselves, compare it in constant time and reject requests whose timestamp is too old (e.g. more than 5 minutes), so that captured requests can't be replayed. The X-Signal-Delivery-Id header stays the same for all attempts of a delivery and can be used to detect duplicates. If no secret is provided, one is generated; it is only returned on creation. Optionally, only envelopes of the given message types (message, edit, reaction, remote_delete, sync, receipt, typing, story, call, other) are delivered. Failed deliveries are retried with exponential backoff and end up as dead letters once all attempts failed.
+// @Accept  json
+// @Produce  json
+// @Success 201 {object} WebhookResponse
+// @Failure 400 {object} Error
+// @Param number path string true "Registered Phone Number"
+// @Param data body WebhookRequest true "Webhook"
+// @Router /v1/webhooks/{number} [post]
+func (a *Api) CreateWebhook(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+	number := c.Param("number")
+	if number == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - number missing"})
+		return
+	}
+
+	err := a.signalClient.CheckAccess(sub, number)
+	if err != nil {
+		c.JSON(403, Error{Msg: err.Error()})
+		return
+	}
+
+	if a.signalCliMode != client.JsonRpc {
+		c.JSON(400, Error{Msg: "Webhooks are only supported in JSON-RPC mode"})
+		return
+	}
+
+	var req WebhookRequest
+	err = c.BindJSON(&req)
+	if err != nil {
+		c.JSON(400, Error{Msg: "Couldn't process request - invalid request"})
+		log.Error(err.Error())
+		return
+	}
+
+	webhookUrl, err := url.Parse(req.Url)
+	if err != nil || (webhookUrl.Scheme != "http" && webhookUrl.Scheme != "https") || webhookUrl.Host == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - please provide a valid http(s) url"})
+		return
+	}
+
+	for _, messageType := range req.MessageTypes {
+		if !utils.IsValidMessageType(messageType) {
+			c.JSON(400, Error{Msg: "Couldn't process request - invalid message type " + messageType})
+			return
+		}
+	}
+
+	secret := req.Secret
+	if secret == "" {
+		secret, err = generateWebhookSecret()
+		if err != nil {
+			c.JSON(500, Error{Msg: err.Error()})
+			return
+		}
+	}
+
+	u, err := uuid.NewV4()
+	if err != nil {
+		c.JSON(500, Error{Msg: err.Error()})
+		return
+	}
+
+	webhook := utils.Webhook{
+		ID:           u.String(),
+		Sub:          sub,
+		Number:       number,
+		Url:          req.Url,
+		Secret:       secret,
+		MessageTypes: strings.Join(req.MessageTypes, ","),
+	}
+	err = a.webhookDispatcher.webhookStorage.CreateWebhook(&webhook)
+	if err != nil {
+		c.JSON(500, Error{Msg: "Couldn't store webhook: " + err.Error()})
+		return
+	}
+
+	resp := toWebhookResponse(&webhook)
+	resp.Secret = webhook.Secret
+	c.JSON(201, resp)
+}
+
+// @Summary List all webhooks.
+// @Tags Webhooks
+// @Description List all webhooks of the given number.
+// @Produce  json
+// @Success 200 {object} []WebhookResponse
+// @Failure 400 {object} Error
+// @Param number path string true "Registered Phone Number"
+// @Router /v1/webhooks/{number} [get]
+func (a *Api) GetWebhooks(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+	number := c.Param("number")
+	if number == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - number missing"})
+		return
+	}
+
+	err := a.signalClient.CheckAccess(sub, number)
+	if err != nil {
+		c.JSON(403, Error{Msg: err.Error()})
+		return
+	}
+
+	webhooks, err := a.webhookDispatcher.webhookStorage.GetWebhooksByNumber(number)
+	if err != nil {
+		c.JSON(500, Error{Msg: err.Error()})
+		return
+	}
+
+	resp := []WebhookResponse{}
+	for i := range webhooks {
+		resp = append(resp, toWebhookResponse(&webhooks[i]))
+	}
+	c.JSON(200, resp)
+}
+
+// @Summary Delete a webhook.
+// @Tags Webhooks
+// @Description Delete a webhook together with its pending deliveries and dead letters.
+// @Produce  json
+// @Success 204 {string} OK
+// @Failure 404 {object} Error
+// @Param number path string true "Registered Phone Number"
+// @Param id path string true "Webhook ID"
+// @Router /v1/webhooks/{number}/{id} [delete]
+func (a *Api) DeleteWebhook(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+	number := c.Param("number")
+	if number == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - number missing"})
+		return
+	}
+
+	err := a.signalClient.CheckAccess(sub, number)
+	if err != nil {
+		c.JSON(403, Error{Msg: err.Error()})
+		return
+	}
+
+	webhook, ok := a.getWebhook(c, number)
+	if !ok {
+		return
+	}
+
+	err = a.webhookDispatcher.DeleteWebhook(webhook.ID)
+	if err != nil {
+		c.JSON(500, Error{Msg: "Couldn't delete webhook: " + err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// @Summary List the dead letters of a webhook.
+// @Tags Webhooks
+// @Description List the envelopes that couldn't be delivered to the webhook, oldest first.
+// @Produce  json
+// @Success 200 {object} []WebhookDeliveryResponse
+// @Failure 404 {object} Error
+// @Param number path string true "Registered Phone Number"
+// @Param id path string true "Webhook ID"
+// @Router /v1/webhooks/{number}/{id}/dead-letters [get]
+func (a *Api) GetWebhookDeadLetters(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+	number := c.Param("number")
+	if number == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - number missing"})
+		return
+	}
+
+	err := a.signalClient.CheckAccess(sub, number)
+	if err != nil {
+		c.JSON(403, Error{Msg: err.Error()})
+		return
+	}
+
+	webhook, ok := a.getWebhook(c, number)
+	if !ok {
+		return
+	}
+
+	deliveries, err := a.webhookDispatcher.webhookStorage.GetDeadDeliveries(webhook.ID)
+	if err != nil {
+		c.JSON(500, Error{Msg: err.Error()})
+		return
+	}
+
+	resp := []WebhookDeliveryResponse{}
+	for _, delivery := range deliveries {
+		resp = append(resp, WebhookDeliveryResponse{
+			Id:             delivery.ID,
+			MessageType:    delivery.MessageType,
+			Attempts:       delivery.Attempts,
+			LastError:      delivery.LastError,
+			LastStatusCode: delivery.LastStatusCode,
+			Payload:        json.RawMessage(delivery.Payload),
+			CreatedAt:      delivery.CreatedAt,
+			UpdatedAt:      delivery.UpdatedAt,
+		})
+	}
+	c.JSON(200, resp)
+}
+
+// @Summary Replay all dead letters of a webhook.
+// @Tags Webhooks
+// @Description Try to deliver all dead letters of the webhook again.
+// @Produce  json
+// @Success 204 {string} OK
+// @Failure 404 {object} Error
+// @Param number path string true "Registered Phone Number"
+// @Param id path string true "Webhook ID"
+// @Router /v1/webhooks/{number}/{id}/dead-letters/replay [post]
+func (a *Api) ReplayWebhookDeadLetters(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+	number := c.Param("number")
+	if number == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - number missing"})
+		return
+	}
+
+	err := a.signalClient.CheckAccess(sub, number)
+	if err != nil {
+		c.JSON(403, Error{Msg: err.Error()})
+		return
+	}
+
+	webhook, ok := a.getWebhook(c, number)
+	if !ok {
+		return
+	}
+
+	deliveries, err := a.webhookDispatcher.webhookStorage.GetDeadDeliveries(webhook.ID)
+	if err != nil {
+		c.JSON(500, Error{Msg: err.Error()})
+		return
+	}
+
+	for i := range deliveries {
+		err = a.webhookDispatcher.Replay(&deliveries[i])
+		if err != nil {
+			c.JSON(500, Error{Msg: "Couldn't replay dead letter: " + err.Error()})
+			return
+		}
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// @Summary Replay a dead letter of a webhook.
+// @Tags Webhooks
+// @Description Try to deliver the dead letter to the webhook again.
+// @Produce  json
+// @Success 204 {string} OK
+// @Failure 404 {object} Error
+// @Param number path string true "Registered Phone Number"
+// @Param id path string true "Webhook ID"
+// @Param deliveryid path string true "Dead Letter ID"
+// @Router /v1/webhooks/{number}/{id}/dead-letters/{deliveryid}/replay [post]
+func (a *Api) ReplayWebhookDeadLetter(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+	number := c.Param("number")
+	if number == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - number missing"})
+		return
+	}
+
+	err := a.signalClient.CheckAccess(sub, number)
+	if err != nil {
+		c.JSON(403, Error{Msg: err.Error()})
+		return
+	}
+
+	webhook, ok := a.getWebhook(c, number)
+	if !ok {
+		return
+	}
+
+	delivery, ok := a.getWebhookDeadLetter(c, webhook)
+	if !ok {
+		return
+	}
+
+	err = a.webhookDispatcher.Replay(delivery)
+	if err != nil {
+		c.JSON(500, Error{Msg: "Couldn't replay dead letter: " + err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// @Summary Delete a dead letter of a webhook.
+// @Tags Webhooks
+// @Description Delete a dead letter without delivering it.
+// @Produce  json
+// @Success 204 {string} OK
+// @Failure 404 {object} Error
+// @Param number path string true "Registered Phone Number"
+// @Param id path string true "Webhook ID"
+// @Param deliveryid path string true "Dead Letter ID"
+// @Router /v1/webhooks/{number}/{id}/dead-letters/{deliveryid} [delete]
+func (a *Api) DeleteWebhookDeadLetter(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+	number := c.Param("number")
+	if number == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - number missing"})
+		return
+	}
+
+	err := a.signalClient.CheckAccess(sub, number)
+	if err != nil {
+		c.JSON(403, Error{Msg: err.Error()})
+		return
+	}
+
+	webhook, ok := a.getWebhook(c, number)
+	if !ok {
+		return
+	}
+
+	delivery, ok := a.getWebhookDeadLetter(c, webhook)
+	if !ok {
+		return
+	}
+
+	err = a.webhookDispatcher.webhookStorage.DeleteDelivery(delivery.ID)
+	if err != nil {
+		c.JSON(500, Error{Msg: "Couldn't delete dead letter: " + err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// renderTemplate renders the template referenced by the request into the message. The defaults of the
+// template (text mode, mentions and attachments) are used unless the request specifies them itself.
+func (a *Api) renderTemplate(sub string, req *SendMessageV2) error {
+	if req.TemplateId == "" {
+		return nil
+	}
+
+	storedTemplate, ok := a.templateStorage.GetTemplate(sub, req.TemplateId)
+	if !ok {
+		return errors.New("Couldn't process request - template " + req.TemplateId + " not found")
+	}
+
+	t, err := template.New(storedTemplate.Name).Option("missingkey=error").Parse(storedTemplate.Body)
+	if err != nil {
+		return errors.New("Couldn't parse template: " + err.Error())
+	}
+
+	var message bytes.Buffer
+	err = t.Execute(&message, req.Variables)
+	if err != nil {
+		return errors.New("Couldn't render template: " + err.Error())
+	}
+	req.Message = message.String()
+
+	if req.TextMode == nil && storedTemplate.TextMode != "" {
+		textMode := storedTemplate.TextMode
+		req.TextMode = &textMode
+	}
+
+	if !req.Mentions.Auto && len(req.Mentions.Mentions) == 0 && storedTemplate.Mentions != "" {
+		err = json.Unmarshal([]byte(storedTemplate.Mentions), &req.Mentions)
+		if err != nil {
+			return err
+		}
+	}
+
+	if storedTemplate.Base64Attachments != "" {
+		var base64Attachments []string
+		err = json.Unmarshal([]byte(storedTemplate.Base64Attachments), &base64Attachments)
+		if err != nil {
+			return err
+		}
+		req.Base64Attachments = append(base64Attachments, req.Base64Attachments...)
+	}
+
+	if storedTemplate.AttachmentUrls != "" {
+		var attachmentUrls []string
+		err = json.Unmarshal([]byte(storedTemplate.AttachmentUrls), &attachmentUrls)
+		if err != nil {
+			return err
+		}
+		req.AttachmentUrls = append(attachmentUrls, req.AttachmentUrls...)
+	}
+
+	// the message is rendered now, so it mustn't be rendered again (e.g. when it is queued)
+	req.TemplateId = ""
+	req.Variables = nil
+	return nil
+}
+
+func toTemplateResponse(storedTemplate *utils.Template) (TemplateResponse, error) {
+	resp := TemplateResponse{
+		Id:                storedTemplate.ID,
+		Name:              storedTemplate.Name,
+		Body:              storedTemplate.Body,
+		Base64Attachments: []string{},
+		AttachmentUrls:    []string{},
+		CreatedAt:         storedTemplate.CreatedAt,
+		UpdatedAt:         storedTemplate.UpdatedAt,
+	}
+	if storedTemplate.TextMode != "" {
+		textMode := storedTemplate.TextMode
+		resp.TextMode = &textMode
+	}
+
+	if storedTemplate.Mentions != "" {
+		err := json.Unmarshal([]byte(storedTemplate.Mentions), &resp.Mentions)
+		if err != nil {
+			return resp, err
+		}
+	}
+	if storedTemplate.Base64Attachments != "" {
+		err := json.Unmarshal([]byte(storedTemplate.Base64Attachments), &resp.Base64Attachments)
+		if err != nil {
+			return resp, err
+		}
+	}
+	if storedTemplate.AttachmentUrls != "" {
+		err := json.Unmarshal([]byte(storedTemplate.AttachmentUrls), &resp.AttachmentUrls)
+		if err != nil {
+			return resp, err
+		}
+	}
+	return resp, nil
+}
+
+// applyTemplateRequest validates the request and copies it into the given template.
+func (a *Api) applyTemplateRequest(storedTemplate *utils.Template, req *TemplateRequest) error {
+	if req.Name == "" {
+		return errors.New("Couldn't process request - please provide a name")
+	}
+
+	if req.Body == "" {
+		return errors.New("Couldn't process request - please provide a body")
+	}
+
+	if req.TextMode != nil && *req.TextMode != "normal" && *req.TextMode != "styled" {
+		return errors.New("Couldn't process request - text_mode needs to be either 'normal' or 'styled'")
+	}
+
+	_, err := template.New(req.Name).Parse(req.Body)
+	if err != nil {
+		return errors.New("Couldn't process request - invalid template: " + err.Error())
+	}
+
+	if existingTemplate, ok := a.templateStorage.GetTemplateByName(storedTemplate.Sub, req.Name); ok && existingTemplate.ID != storedTemplate.ID {
+		return errors.New("Couldn't process request - a template with the name " + req.Name + " already exists")
+	}
+
+	storedTemplate.Name = req.Name
+	storedTemplate.Body = req.Body
+	storedTemplate.TextMode = ""
+	if req.TextMode != nil {
+		storedTemplate.TextMode = *req.TextMode
+	}
+
+	storedTemplate.Mentions = ""
+	if req.Mentions.Auto || len(req.Mentions.Mentions) > 0 {
+		mentions, err := json.Marshal(req.Mentions)
+		if err != nil {
+			return err
+		}
+		storedTemplate.Mentions = string(mentions)
+	}
+
+	storedTemplate.Base64Attachments = ""
+	if len(req.Base64Attachments) > 0 {
+		base64Attachments, err := json.Marshal(req.Base64Attachments)
+		if err != nil {
+			return err
+		}
+		storedTemplate.Base64Attachments = string(base64Attachments)
+	}
+
+	storedTemplate.AttachmentUrls = ""
+	if len(req.AttachmentUrls) > 0 {
+		attachmentUrls, err := json.Marshal(req.AttachmentUrls)
+		if err != nil {
+			return err
+		}
+		storedTemplate.AttachmentUrls = string(attachmentUrls)
+	}
+	return nil
+}
+
+// @Summary Create a message template.
+// @Tags Templates
+// @Description Create a named message template. The body is a Go text/template (e.g. 'Alert {{.name}} is {{.state}}') that is rendered with the variables provided when sending a message with the template_id.
+// @Accept  json
+// @Produce  json
+// @Success 201 {object} TemplateResponse
+// @Failure 400 {object} Error
+// @Param data body TemplateRequest true "Template"
+// @Router /v1/templates [post]
+func (a *Api) CreateTemplate(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+
+	var req TemplateRequest
+	err := c.BindJSON(&req)
+	if err != nil {
+		c.JSON(400, Error{Msg: "Couldn't process request - invalid request"})
+		log.Error(err.Error())
+		return
+	}
+
+	u, err := uuid.NewV4()
+	if err != nil {
+		c.JSON(500, Error{Msg: err.Error()})
+		return
+	}
+
+	storedTemplate := utils.Template{ID: u.String(), Sub: sub}
+	err = a.applyTemplateRequest(&storedTemplate, &req)
+	if err != nil {
+		clientError(c, err)
+		return
+	}
+
+	err = a.templateStorage.CreateTemplate(&storedTemplate)
+	if err != nil {
+		c.JSON(500, Error{Msg: "Couldn't store template: " + err.Error()})
+		return
+	}
+
+	resp, err := toTemplateResponse(&storedTemplate)
+	if err != nil {
+		c.JSON(500, Error{Msg: err.Error()})
+		return
+	}
+	c.JSON(201, resp)
+}
+
+// @Summary List all message templates.
+// @Tags Templates
+// @Description List all message templates.
+// @Produce  json
+// @Success 200 {object} []TemplateResponse
+// @Failure 400 {object} Error
+// @Router /v1/templates [get]
+func (a *Api) GetTemplates(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+
+	templates, err := a.templateStorage.GetTemplates(sub)
+	if err != nil {
+		c.JSON(500, Error{Msg: err.Error()})
+		return
+	}
+
+	resp := []TemplateResponse{}
+	for i := range templates {
+		templateResponse, err := toTemplateResponse(&templates[i])
+		if err != nil {
+			c.JSON(500, Error{Msg: err.Error()})
+			return
+		}
+		resp = append(resp, templateResponse)
+	}
+	c.JSON(200, resp)
+}
+
+// @Summary Get a message template.
+// @Tags Templates
+// @Description Get a message template.
+// @Produce  json
+// @Success 200 {object} TemplateResponse
+// @Failure 404 {object} Error
+// @Param id path string true "Template ID"
+// @Router /v1/templates/{id} [get]
+func (a *Api) GetTemplate(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+
+	storedTemplate, ok := a.templateStorage.GetTemplate(sub, c.Param("id"))
+	if !ok {
+		c.JSON(404, Error{Msg: "No template with that id found"})
+		return
+	}
+
+	resp, err := toTemplateResponse(storedTemplate)
+	if err != nil {
+		c.JSON(500, Error{Msg: err.Error()})
+		return
+	}
+	c.JSON(200, resp)
+}
+
+// @Summary Update a message template.
+// @Tags Templates
+// @Description Replace a message template.
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} TemplateResponse
+// @Failure 400 {object} Error
+// @Param id path string true "Template ID"
+// @Param data body TemplateRequest true "Template"
+// @Router /v1/templates/{id} [put]
+func (a *Api) UpdateTemplate(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+
+	storedTemplate, ok := a.templateStorage.GetTemplate(sub, c.Param("id"))
+	if !ok {
+		c.JSON(404, Error{Msg: "No template with that id found"})
+		return
+	}
+
+	var req TemplateRequest
+	err := c.BindJSON(&req)
+	if err != nil {
+		c.JSON(400, Error{Msg: "Couldn't process request - invalid request"})
+		log.Error(err.Error())
+		return
+	}
+
+	err = a.applyTemplateRequest(storedTemplate, &req)
+	if err != nil {
+		clientError(c, err)
+		return
+	}
+
+	err = a.templateStorage.SaveTemplate(storedTemplate)
+	if err != nil {
+		c.JSON(500, Error{Msg: "Couldn't store template: " + err.Error()})
+		return
+	}
+
+	resp, err := toTemplateResponse(storedTemplate)
+	if err != nil {
+		c.JSON(500, Error{Msg: err.Error()})
+		return
+	}
+	c.JSON(200, resp)
+}
+
+// @Summary Delete a message template.
+// @Tags Templates
+// @Description Delete a message template.
+// @Produce  json
+// @Success 204 {string} OK
+// @Failure 404 {object} Error
+// @Param id path string true "Template ID"
+// @Router /v1/templates/{id} [delete]
+func (a *Api) DeleteTemplate(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+
+	storedTemplate, ok := a.templateStorage.GetTemplate(sub, c.Param("id"))
+	if !ok {
+		c.JSON(404, Error{Msg: "No template with that id found"})
+		return
+	}
+
+	err := a.templateStorage.DeleteTemplate(sub, storedTemplate.ID)
+	if err != nil {
+		c.JSON(500, Error{Msg: "Couldn't delete template: " + err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// @Summary List installed sticker packs.
+// @Tags Sticker Packs
+// @Description List the installed sticker packs together with their stickers. A sticker can be sent with '<pack_id>:<sticker id>'.
+// @Produce  json
+// @Success 200 {object} []client.StickerPackEntry
+// @Failure 400 {object} Error
+// @Param number path string true "Registered Phone Number"
+// @Router /v1/sticker-packs/{number} [get]
+func (a *Api) ListStickerPacks(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+	number := c.Param("number")
+	if number == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - number missing"})
+		return
+	}
+
+	err := a.signalClient.CheckAccess(sub, number)
+	if err != nil {
+		c.JSON(403, Error{Msg: err.Error()})
+		return
+	}
+
+	stickerPacks, err := a.signalClient.ListStickerPacks(number)
+	if err != nil {
+		clientError(c, err)
+		return
+	}
+	c.JSON(200, stickerPacks)
+}
+
+// @Summary Install a sticker pack.
+// @Tags Sticker Packs
+// @Description Install the sticker pack with the given signal.art url.
+// @Accept  json
+// @Produce  json
+// @Success 204 {string} OK
+// @Failure 400 {object} Error
+// @Param number path string true "Registered Phone Number"
+// @Param data body AddStickerPackRequest true "Sticker Pack"
+// @Router /v1/sticker-packs/{number} [post]
+func (a *Api) AddStickerPack(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+	number := c.Param("number")
+	if number == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - number missing"})
+		return
+	}
+
+	err := a.signalClient.CheckAccess(sub, number)
+	if err != nil {
+		c.JSON(403, Error{Msg: err.Error()})
+		return
+	}
+
+	var req AddStickerPackRequest
+	err = c.BindJSON(&req)
+	if err != nil {
+		c.JSON(400, Error{Msg: "Couldn't process request - invalid request"})
+		log.Error(err.Error())
+		return
+	}
+
+	if !strings.HasPrefix(req.Url, "https://signal.art/addstickers/") {
+		c.JSON(400, Error{Msg: "Couldn't process request - please provide a valid signal.art sticker pack url"})
+		return
+	}
+
+	err = a.signalClient.AddStickerPack(number, req.Url)
+	if err != nil {
+		clientError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// @Summary Upload a new sticker pack.
+// @Tags Sticker Packs
+// @Description Upload a new sticker pack as multipart/form-data. Either upload a single zip file containing the pack or the manifest.json together with all the sticker images it references (the file names of the parts need to match the manifest).
+// @Accept  mpfd
+// @Produce  json
+// @Success 201 {object} UploadStickerPackResponse
+// @Failure 400 {object} Error
+// @Failure 413 {object} Error
+// @Param number path string true "Registered Phone Number"
+// @Router /v1/sticker-packs/{number}/upload [post]
+func (a *Api) UploadStickerPack(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+	number := c.Param("number")
+	if number == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - number missing"})
+		return
+	}
+
+	err := a.signalClient.CheckAccess(sub, number)
+	if err != nil {
+		c.JSON(403, Error{Msg: err.Error()})
+		return
+	}
+
+	if a.maxUploadSize > 0 {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, a.maxUploadSize)
+	}
+
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(400, Error{Msg: "Couldn't process request - multipart/form-data expected"})
+		return
+	}
+
+	upload, err := a.signalClient.NewStickerPackUpload()
+	if err != nil {
+		c.JSON(500, Error{Msg: err.Error()})
+		return
+	}
+	defer upload.CleanUp()
+
+	err = addStickerPackParts(reader, upload)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			c.JSON(413, Error{Msg: "Couldn't process request - upload exceeds the maximum size of " + strconv.FormatInt(a.maxUploadSize, 10) + " bytes"})
+			return
+		}
+		c.JSON(400, Error{Msg: "Couldn't process request - invalid request: " + err.Error()})
+		return
+	}
+
+	url, err := a.signalClient.UploadStickerPack(number, upload)
+	if err != nil {
+		clientError(c, err)
+		return
+	}
+	c.JSON(201, UploadStickerPackResponse{Url: url})
+}
+
+// addStickerPackParts stores the files of the multipart request in the sticker pack upload. Parts without
+// a file name are skipped.
+func addStickerPackParts(reader *multipart.Reader, upload *client.StickerPackUpload) error {
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = addStickerPackPart(upload, part)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func addStickerPackPart(upload *client.StickerPackUpload, part *multipart.Part) error {
+	defer part.Close()
+	if part.FileName() == "" {
+		return nil
+	}
+	return upload.AddFile(part.FileName(), part)
+}
+
+// @Summary Get a sticker.
+// @Tags Sticker Packs
+// @Description Get the image of a sticker of an installed sticker pack. The image is read from the sticker store of the account, so the sticker pack needs to be installed first.
+// @Produce  image/webp
+// @Success 200 {string} OK
+// @Failure 400 {object} Error
+// @Failure 404 {object} Error
+// @Param number path string true "Registered Phone Number"
+// @Param packid path string true "Sticker Pack ID"
+// @Param stickerid path string true "Sticker ID"
+// @Router /v1/sticker-packs/{number}/{packid}/{stickerid} [get]
+func (a *Api) GetSticker(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+	number := c.Param("number")
+	if number == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - number missing"})
+		return
+	}
+
+	stickerId, err := strconv.Atoi(c.Param("stickerid"))
+	if err != nil || stickerId < 0 {
+		c.JSON(400, Error{Msg: "Couldn't process request - invalid sticker id"})
+		return
+	}
+
+	err = a.signalClient.CheckAccess(sub, number)
+	if err != nil {
+		c.JSON(403, Error{Msg: err.Error()})
+		return
+	}
+
+	stickerBytes, err := a.signalClient.GetSticker(number, c.Param("packid"), stickerId)
+	if err != nil {
+		clientError(c, err)
+		return
+	}
+
+	mime := mimetype.Detect(stickerBytes)
+	c.Data(200, mime.String(), stickerBytes)
+}
+
+// @Summary Lift a rate limit of the account.
+// @Tags Accounts
+// @Description When Signal rate limits an account, sending fails with status 429 and a challenge token. Solve the captcha at https://signalcaptchas.org/challenge/generate.html and submit it together with the challenge token to be able to send messages again.
+// @Accept  json
+// @Produce  json
+// @Success 204 {string} string "OK"
+// @Failure 400 {object} Error
+// @Param number path string true "Registered Phone Number"
+// @Param data body RateLimitChallengeRequest true "Challenge token and captcha"
+// @Router /v1/accounts/{number}/rate-limit-challenge [post]
+func (a *Api) SubmitRateLimitChallenge(c *gin.Context) {
+	sub := c.MustGet("sub").(string)
+	number := c.Param("number")
+	if number == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - number missing"})
+		return
+	}
+
+	err := a.signalClient.CheckAccess(sub, number)
+	if err != nil {
+		c.JSON(403, Error{Msg: err.Error()})
+		return
+	}
+
+	var req RateLimitChallengeRequest
+	err = c.BindJSON(&req)
+	if err != nil {
+		c.JSON(400, Error{Msg: "Couldn't process request - invalid request"})
+		log.Error(err.Error())
+		return
+	}
+
+	if req.ChallengeToken == "" || req.Captcha == "" {
+		c.JSON(400, Error{Msg: "Couldn't process request - please provide the challenge token and the captcha"})
+		return
+	}
+
+	err = a.signalClient.SubmitRateLimitChallenge(number, req.ChallengeToken, req.Captcha)
+	if err != nil {
+		clientError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,238 @@
+package api
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/sheophe/signal-cli-rest-api/client"
+	utils "github.com/sheophe/signal-cli-rest-api/utils"
+)
+
+// newTestStickerPackReader creates a multipart reader with a form field and the given files.
+func newTestStickerPackReader(t *testing.T, files map[string]string, fileNames ...string) *multipart.Reader {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	err := writer.WriteField("comment", "not a file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fileName := range fileNames {
+		part, err := writer.CreateFormFile("files", fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(files[fileName]))
+	}
+	writer.Close()
+	return multipart.NewReader(&body, writer.Boundary())
+}
+
+func TestAddStickerPackParts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sticker-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	signalClient := client.NewSignalClient(dir, dir+string(os.PathSeparator), dir, client.Normal, "", "", nil, nil)
+	files := map[string]string{"manifest.json": "{}", "1.webp": "sticker"}
+
+	upload, err := signalClient.NewStickerPackUpload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upload.CleanUp()
+
+	err = addStickerPackParts(newTestStickerPackReader(t, files, "manifest.json", "1.webp"), upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadDirs, _ := filepath.Glob(filepath.Join(dir, "*", "*"))
+	if len(uploadDirs) != 2 {
+		t.Errorf("expected the two files to be stored, got %v", uploadDirs)
+	}
+
+	duplicateUpload, err := signalClient.NewStickerPackUpload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer duplicateUpload.CleanUp()
+
+	err = addStickerPackParts(newTestStickerPackReader(t, files, "1.webp", "1.webp"), duplicateUpload)
+	if err == nil {
+		t.Error("expected a duplicate file name to be rejected")
+	}
+}
+
+func newTestTemplateApi(t *testing.T, templates ...utils.Template) *Api {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	templateStorage, err := utils.NewTemplateStorage(filepath.Join(dir, "templates.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { templateStorage.Close() })
+
+	for i := range templates {
+		err = templateStorage.CreateTemplate(&templates[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &Api{templateStorage: templateStorage}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	a := newTestTemplateApi(t,
+		utils.Template{ID: "greeting", Sub: "sub", Name: "greeting", Body: "Hello {{.name}}!", TextMode: "styled",
+			Mentions: "\"auto\"", Base64Attachments: "[\"aGVsbG8=\"]", AttachmentUrls: "[\"https://example.com/a.png\"]"},
+		utils.Template{ID: "plain", Sub: "sub", Name: "plain", Body: "Hello"},
+		utils.Template{ID: "other", Sub: "other-sub", Name: "other", Body: "Hello"},
+	)
+	normal := "normal"
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name              string
+		req               SendMessageV2
+		message           string
+		textMode          string
+		autoMentions      bool
+		base64Attachments []string
+		attachmentUrls    []string
+		status            int
+	}{
+		{"no template", SendMessageV2{Message: "unchanged"}, "unchanged", "", false, nil, nil, 0},
+		{"defaults", SendMessageV2{TemplateId: "greeting", Variables: map[string]interface{}{"name": "Alice"}},
+			"Hello Alice!", "styled", true, []string{"aGVsbG8="}, []string{"https://example.com/a.png"}, 0},
+		{"overrides", SendMessageV2{TemplateId: "greeting", Variables: map[string]interface{}{"name": "Bob"}, TextMode: &normal,
+			Mentions:          client.MessageMentions{Mentions: []client.MessageMention{{Author: "+491111", Start: 6, Length: 3}}},
+			Base64Attachments: []string{"d29ybGQ="}, AttachmentUrls: []string{"https://example.com/b.png"}},
+			"Hello Bob!", "normal", false, []string{"aGVsbG8=", "d29ybGQ="}, []string{"https://example.com/a.png", "https://example.com/b.png"}, 0},
+		{"without defaults", SendMessageV2{TemplateId: "plain"}, "Hello", "", false, nil, nil, 0},
+		{"missing variable", SendMessageV2{TemplateId: "greeting"}, "", "", false, nil, nil, 400},
+		{"unknown template", SendMessageV2{TemplateId: "unknown"}, "", "", false, nil, nil, 400},
+		{"template of another user", SendMessageV2{TemplateId: "other"}, "", "", false, nil, nil, 400},
+	}
+	for _, test := range tests {
+		req := test.req
+		err := a.renderTemplate("sub", &req)
+		if test.status != 0 {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+				continue
+			}
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			clientError(c, err)
+			if w.Code != test.status {
+				t.Errorf("%s: expected status %d, got %d", test.name, test.status, w.Code)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err.Error())
+			continue
+		}
+
+		textMode := ""
+		if req.TextMode != nil {
+			textMode = *req.TextMode
+		}
+		if req.Message != test.message || textMode != test.textMode || req.Mentions.Auto != test.autoMentions {
+			t.Errorf("%s: expected message %q (text mode %q, auto mentions %t), got %q (%q, %t)", test.name,
+				test.message, test.textMode, test.autoMentions, req.Message, textMode, req.Mentions.Auto)
+		}
+		if !reflect.DeepEqual(req.Base64Attachments, test.base64Attachments) || !reflect.DeepEqual(req.AttachmentUrls, test.attachmentUrls) {
+			t.Errorf("%s: expected attachments %v %v, got %v %v", test.name, test.base64Attachments, test.attachmentUrls,
+				req.Base64Attachments, req.AttachmentUrls)
+		}
+		if test.req.TemplateId != "" && (req.TemplateId != "" || req.Variables != nil) {
+			t.Errorf("%s: expected the template id and variables to be cleared, got %q %v", test.name, req.TemplateId, req.Variables)
+		}
+	}
+}
+
+// newTestHandlerApi creates an api without any registered number, so requests that pass the validation
+// of a handler fail with 403.
+func newTestHandlerApi() *Api {
+	return &Api{signalClient: client.NewSignalClient("", "", "", client.JsonRpc, "", "", nil, nil)}
+}
+
+func runHandler(handler gin.HandlerFunc, params gin.Params, body string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	c.Params = params
+	c.Set("sub", "sub")
+	handler(c)
+	return w
+}
+
+// checkTimestampValidation calls the handler with valid and invalid timestamps in the path.
+func checkTimestampValidation(t *testing.T, handler gin.HandlerFunc, body string) {
+	tests := []struct {
+		timestamp string
+		status    int
+	}{
+		{"", 400},
+		{"abc", 400},
+		{"0", 400},
+		{"-1000", 400},
+		{"1000", 403},
+	}
+	for _, test := range tests {
+		params := gin.Params{{Key: "number", Value: "+490000"}, {Key: "timestamp", Value: test.timestamp}}
+		w := runHandler(handler, params, body)
+		if w.Code != test.status {
+			t.Errorf("timestamp %q: expected status %d, got %d (%s)", test.timestamp, test.status, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestEditMessageTimestamp(t *testing.T) {
+	checkTimestampValidation(t, newTestHandlerApi().EditMessage, `{"recipients": ["+491111"], "message": "edited"}`)
+}
+
+func TestRemoteDeleteTimestamp(t *testing.T) {
+	checkTimestampValidation(t, newTestHandlerApi().RemoteDelete, `{"recipient": "+491111"}`)
+}
+
+func TestValidateReceiptRequest(t *testing.T) {
+	tests := []struct {
+		name  string
+		req   ReceiptRequest
+		valid bool
+	}{
+		{"read", ReceiptRequest{Recipient: "+491111", Timestamps: []int64{1000, 2000}, Type: "read"}, true},
+		{"viewed", ReceiptRequest{Recipient: "+491111", Timestamps: []int64{1000}, Type: "viewed"}, true},
+		{"missing type", ReceiptRequest{Recipient: "+491111", Timestamps: []int64{1000}}, false},
+		{"unknown type", ReceiptRequest{Recipient: "+491111", Timestamps: []int64{1000}, Type: "delivered"}, false},
+		{"type in upper case", ReceiptRequest{Recipient: "+491111", Timestamps: []int64{1000}, Type: "READ"}, false},
+		{"missing timestamps", ReceiptRequest{Recipient: "+491111", Type: "read"}, false},
+		{"zero timestamp", ReceiptRequest{Recipient: "+491111", Timestamps: []int64{1000, 0}, Type: "read"}, false},
+		{"negative timestamp", ReceiptRequest{Recipient: "+491111", Timestamps: []int64{-1000}, Type: "read"}, false},
+		{"missing recipient", ReceiptRequest{Timestamps: []int64{1000}, Type: "read"}, false},
+	}
+	for _, test := range tests {
+		err := validateReceiptRequest(&test.req)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %t, got error %v", test.name, test.valid, err)
+		}
+	}
+}
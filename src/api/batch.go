@@ -0,0 +1,85 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+type batchItem struct {
+	index int
+	req   SendMessageV2
+}
+
+// batchRunner sends the messages of a batch. Every number gets its own queue with a fixed number of
+// workers, so that neither the number of goroutines nor the number of parsed messages that are kept
+// in memory depend on the size of the batch.
+type batchRunner struct {
+	parallelism int
+	// checks a message before it is queued; returns a result in case the message can't be sent
+	prepare func(index int, req *SendMessageV2) *BatchSendResult
+	send    func(index int, req *SendMessageV2) BatchSendResult
+	results chan BatchSendResult
+	queues  map[string]chan batchItem
+	wg      sync.WaitGroup
+}
+
+func newBatchRunner(parallelism int, prepare func(index int, req *SendMessageV2) *BatchSendResult,
+	send func(index int, req *SendMessageV2) BatchSendResult) *batchRunner {
+	return &batchRunner{
+		parallelism: parallelism,
+		prepare:     prepare,
+		send:        send,
+		results:     make(chan BatchSendResult, parallelism),
+		queues:      make(map[string]chan batchItem),
+	}
+}
+
+func (b *batchRunner) getQueue(number string) chan batchItem {
+	queue, ok := b.queues[number]
+	if !ok {
+		queue = make(chan batchItem, b.parallelism)
+		b.queues[number] = queue
+		for i := 0; i < b.parallelism; i++ {
+			b.wg.Add(1)
+			go func() {
+				defer b.wg.Done()
+				for item := range queue {
+					b.results <- b.send(item.index, &item.req)
+				}
+			}()
+		}
+	}
+	return queue
+}
+
+// run reads the messages from the decoder (which needs to be positioned after the opening bracket of
+// the array) and sends them. The results are passed to the results channel as soon as they are done;
+// it is closed once all messages were sent. A message that can't be decoded results in an error for
+// that message; if the JSON is malformed, the remaining messages are skipped.
+func (b *batchRunner) run(decoder *json.Decoder) {
+	for index := 0; decoder.More(); index++ {
+		var req SendMessageV2
+		err := decoder.Decode(&req)
+		if err != nil {
+			b.results <- BatchSendResult{Index: index, Status: 400, Error: "Couldn't process request - invalid request"}
+			var unmarshalTypeError *json.UnmarshalTypeError
+			if errors.As(err, &unmarshalTypeError) {
+				continue
+			}
+			break
+		}
+
+		if result := b.prepare(index, &req); result != nil {
+			b.results <- *result
+			continue
+		}
+		b.getQueue(req.Number) <- batchItem{index: index, req: req}
+	}
+
+	for _, queue := range b.queues {
+		close(queue)
+	}
+	b.wg.Wait()
+	close(b.results)
+}
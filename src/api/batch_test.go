@@ -0,0 +1,131 @@
+package api
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func runTestBatch(t *testing.T, body string, parallelism int, prepare func(index int, req *SendMessageV2) *BatchSendResult,
+	send func(index int, req *SendMessageV2) BatchSendResult) []BatchSendResult {
+	decoder := json.NewDecoder(strings.NewReader(body))
+	if _, err := decoder.Token(); err != nil {
+		t.Fatal(err)
+	}
+	if prepare == nil {
+		prepare = func(index int, req *SendMessageV2) *BatchSendResult { return nil }
+	}
+
+	runner := newBatchRunner(parallelism, prepare, send)
+	go runner.run(decoder)
+
+	results := []BatchSendResult{}
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case result, ok := <-runner.results:
+			if !ok {
+				return results
+			}
+			results = append(results, result)
+		case <-timeout:
+			t.Fatal("batch didn't finish")
+		}
+	}
+}
+
+func sentOk(index int, req *SendMessageV2) BatchSendResult {
+	return BatchSendResult{Index: index, Number: req.Number, Status: 201}
+}
+
+func TestBatchRunnerStreamsInCompletionOrder(t *testing.T) {
+	// the first message is slow, the others are done before it
+	body := `[{"number":"+491111","message":"slow"},{"number":"+492222","message":"a"},{"number":"+492222","message":"b"}]`
+	results := runTestBatch(t, body, 2, nil, func(index int, req *SendMessageV2) BatchSendResult {
+		if req.Message == "slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return sentOk(index, req)
+	})
+
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %+v", results)
+	}
+	if results[2].Index != 0 {
+		t.Errorf("expected the slow message to be streamed last, got %+v", results)
+	}
+}
+
+func TestBatchRunnerItemErrors(t *testing.T) {
+	body := `[{"number":"+491111","message":"a"},{"number":42},{"number":"+499999","message":"b"},{"number":"+491111","message":"c"}]`
+	prepare := func(index int, req *SendMessageV2) *BatchSendResult {
+		if req.Number == "+499999" {
+			return &BatchSendResult{Index: index, Number: req.Number, Status: 403}
+		}
+		return nil
+	}
+	results := runTestBatch(t, body, 1, prepare, sentOk)
+
+	statuses := make(map[int]int)
+	for _, result := range results {
+		statuses[result.Index] = result.Status
+	}
+	expected := map[int]int{0: 201, 1: 400, 2: 403, 3: 201}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results, got %+v", len(expected), results)
+	}
+	for index, status := range expected {
+		if statuses[index] != status {
+			t.Errorf("message %d: expected status %d, got %d", index, status, statuses[index])
+		}
+	}
+}
+
+func TestBatchRunnerMalformedJson(t *testing.T) {
+	body := `[{"number":"+491111","message":"a"},{"number":`
+	results := runTestBatch(t, body, 1, nil, sentOk)
+	statuses := make(map[int]int)
+	for _, result := range results {
+		statuses[result.Index] = result.Status
+	}
+	if len(results) != 2 || statuses[0] != 201 || statuses[1] != 400 {
+		t.Fatalf("expected the first message to be sent and an error for the second, got %+v", results)
+	}
+}
+
+func TestBatchRunnerLimitsParallelismPerNumber(t *testing.T) {
+	items := []string{}
+	for i := 0; i < 20; i++ {
+		items = append(items, `{"number":"+491111","message":"a"}`, `{"number":"+492222","message":"b"}`)
+	}
+
+	var mutex sync.Mutex
+	running := make(map[string]int)
+	maxRunning := make(map[string]int)
+	results := runTestBatch(t, "["+strings.Join(items, ",")+"]", 3, nil, func(index int, req *SendMessageV2) BatchSendResult {
+		mutex.Lock()
+		running[req.Number]++
+		if running[req.Number] > maxRunning[req.Number] {
+			maxRunning[req.Number] = running[req.Number]
+		}
+		mutex.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mutex.Lock()
+		running[req.Number]--
+		mutex.Unlock()
+		return sentOk(index, req)
+	})
+
+	if len(results) != 40 {
+		t.Fatalf("expected 40 results, got %d", len(results))
+	}
+	for number, max := range maxRunning {
+		if max > 3 {
+			t.Errorf("%s: expected at most 3 messages at the same time, got %d", number, max)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/sheophe/signal-cli-rest-api/client"
+)
+
+// machine readable codes of the errors reported by the client
+const (
+	ErrorCodeUnregisteredRecipient = "unregistered_recipient"
+	ErrorCodeUntrustedIdentity     = "untrusted_identity"
+	ErrorCodeRateLimited           = "rate_limited"
+	ErrorCodeGroupNotFound         = "group_not_found"
+	ErrorCodeAccountNotLoggedIn    = "account_not_logged_in"
+	ErrorCodeTimeout               = "timeout"
+	ErrorCodeSignalCliCrashed      = "signal_cli_crashed"
+	ErrorCodeNotFound              = "not_found"
+	ErrorCodeInvalidName           = "invalid_name"
+	ErrorCodeInternalError         = "internal_error"
+	ErrorCodeAttachmentTooLarge    = "attachment_too_large"
+)
+
+// errorStatus returns the http status code and the error code for an error of the client (the error may
+// be wrapped). Errors that aren't typed are reported with the default status and without error code.
+func errorStatus(err error, defaultStatus int) (int, string) {
+	var unregisteredRecipientError *client.UnregisteredRecipientError
+	var untrustedIdentityError *client.UntrustedIdentityError
+	var rateLimitError *client.RateLimitError
+	var groupNotFoundError *client.GroupNotFoundError
+	var accountNotLoggedInError *client.AccountNotLoggedInError
+	var timeoutError *client.TimeoutError
+	var signalCliCrashError *client.SignalCliCrashError
+	var notFoundError *client.NotFoundError
+	var invalidNameError *client.InvalidNameError
+	var internalError *client.InternalError
+	var attachmentTooLargeError *client.AttachmentTooLargeError
+	switch {
+	case errors.As(err, &unregisteredRecipientError):
+		return 422, ErrorCodeUnregisteredRecipient
+	case errors.As(err, &untrustedIdentityError):
+		return 409, ErrorCodeUntrustedIdentity
+	case errors.As(err, &rateLimitError):
+		return 429, ErrorCodeRateLimited
+	case errors.As(err, &groupNotFoundError):
+		return 404, ErrorCodeGroupNotFound
+	case errors.As(err, &accountNotLoggedInError):
+		return 409, ErrorCodeAccountNotLoggedIn
+	case errors.As(err, &timeoutError):
+		return 504, ErrorCodeTimeout
+	case errors.As(err, &signalCliCrashError):
+		return 502, ErrorCodeSignalCliCrashed
+	case errors.As(err, &notFoundError):
+		return 404, ErrorCodeNotFound
+	case errors.As(err, &invalidNameError):
+		return 400, ErrorCodeInvalidName
+	case errors.As(err, &internalError):
+		return 500, ErrorCodeInternalError
+	case errors.As(err, &attachmentTooLargeError):
+		return 413, ErrorCodeAttachmentTooLarge
+	}
+	return defaultStatus, ""
+}
+
+// clientError responds with the http status and error code that belong to the error of the client.
+// Errors that aren't typed are reported with status 400.
+func clientError(c *gin.Context, err error) {
+	clientErrorWithStatus(c, err, 400)
+}
+
+// clientErrorWithStatus is like clientError, but reports errors that aren't typed with the given status.
+func clientErrorWithStatus(c *gin.Context, err error, defaultStatus int) {
+	status, code := errorStatus(err, defaultStatus)
+	var rateLimitError *client.RateLimitError
+	if errors.As(err, &rateLimitError) {
+		if rateLimitError.RetryAfter > 0 {
+			c.Header("Retry-After", strconv.Itoa(rateLimitError.RetryAfter))
+		}
+		c.JSON(status, RateLimitError{Msg: err.Error(), Code: code, ChallengeToken: rateLimitError.ChallengeToken, RetryAfter: rateLimitError.RetryAfter})
+		return
+	}
+	var untrustedIdentityError *client.UntrustedIdentityError
+	if errors.As(err, &untrustedIdentityError) {
+		c.JSON(status, UntrustedIdentityError{Msg: err.Error(), Code: code, Identities: untrustedIdentityError.Identities})
+		return
+	}
+	c.JSON(status, Error{Msg: err.Error(), Code: code})
+}
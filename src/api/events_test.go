@@ -0,0 +1,30 @@
+package api
+
+import (
+	"testing"
+
+	utils "github.com/sheophe/signal-cli-rest-api/utils"
+)
+
+func TestParseEventId(t *testing.T) {
+	timestamp, cursor, storedId, err := parseEventId("1000")
+	if err != nil || timestamp != 1000 || cursor != nil || storedId != 0 {
+		t.Errorf("unexpected result for a timestamp only: %d %v %d %v", timestamp, cursor, storedId, err)
+	}
+
+	timestamp, cursor, storedId, err = parseEventId("1000-42")
+	if err != nil || timestamp != 1000 || cursor == nil || *cursor != 42 || storedId != 0 {
+		t.Errorf("unexpected result for a cursor: %d %v %d %v", timestamp, cursor, storedId, err)
+	}
+
+	timestamp, cursor, storedId, err = parseEventId(storedEventId(&utils.StoredMessage{ID: 7, Timestamp: 1000}))
+	if err != nil || timestamp != 1000 || cursor != nil || storedId != 7 {
+		t.Errorf("unexpected result for a stored message: %d %v %d %v", timestamp, cursor, storedId, err)
+	}
+
+	for _, id := range []string{"", "abc", "-1", "1000-", "1000-x", "1000-s", "1000-sx"} {
+		if _, _, _, err := parseEventId(id); err == nil {
+			t.Errorf("expected event id %q to be invalid", id)
+		}
+	}
+}
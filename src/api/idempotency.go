@@ -0,0 +1,180 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	utils "github.com/sheophe/signal-cli-rest-api/utils"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+const idempotencyKeyMaxLength = 255
+
+// maximum size of a response that is stored with an idempotency key (e.g. of a big batch)
+const idempotencyResponseMaxSize = 1024 * 1024
+
+// idempotencyResponseWriter keeps a copy of the response, so that it can be stored with the idempotency key.
+// Only up to idempotencyResponseMaxSize bytes are kept.
+type idempotencyResponseWriter struct {
+	gin.ResponseWriter
+	body     bytes.Buffer
+	tooLarge bool
+}
+
+func (w *idempotencyResponseWriter) keep(data []byte) {
+	if w.tooLarge {
+		return
+	}
+	if w.body.Len()+len(data) > idempotencyResponseMaxSize {
+		w.tooLarge = true
+		w.body = bytes.Buffer{}
+		return
+	}
+	w.body.Write(data)
+}
+
+func (w *idempotencyResponseWriter) Write(data []byte) (int, error) {
+	w.keep(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *idempotencyResponseWriter) WriteString(s string) (int, error) {
+	w.keep([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+// newRequestHash returns the hash of the request the body is written to.
+func newRequestHash(c *gin.Context) hash.Hash {
+	requestHash := sha256.New()
+	requestHash.Write([]byte(c.Request.Method + " " + c.Request.URL.Path + "?" + c.Request.URL.RawQuery + "\n"))
+	return requestHash
+}
+
+// isStoredIdempotentStatus reports whether the response is stored with the idempotency key. Apart from
+// successful requests, these are the ones whose outcome is unknown (signal-cli timed out or crashed), as
+// the message may have been sent nevertheless.
+func isStoredIdempotentStatus(status int) bool {
+	return (status >= 200 && status < 300) || status == http.StatusBadGateway || status == http.StatusGatewayTimeout
+}
+
+// IdempotencyMiddleware makes requests with an Idempotency-Key header safe to retry: the response of the
+// first successful request is stored for the sub and replayed for every further request with the same key.
+// Failed requests aren't stored, so they can be retried with the same key - unless it is unknown whether
+// the message was sent (see isStoredIdempotentStatus). The body is hashed while the handler reads it (it
+// isn't buffered, as it may contain big uploads), so the hash of the request is only known once the
+// request is done. Responses that are too big to be stored are replaced by an error.
+func (a *Api) IdempotencyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(idempotencyKeyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+
+		if len(key) > idempotencyKeyMaxLength {
+			c.AbortWithStatusJSON(400, Error{Msg: "Couldn't process request - " + idempotencyKeyHeader + " must not be longer than " + strconv.Itoa(idempotencyKeyMaxLength) + " characters"})
+			return
+		}
+
+		sub := c.MustGet("sub").(string)
+
+		entry, reserved, err := a.subStorage.ReserveIdempotencyKey(sub, key, a.idempotencyKeyTtl)
+		if err != nil {
+			c.AbortWithStatusJSON(500, Error{Msg: "Couldn't check " + idempotencyKeyHeader + ": " + err.Error()})
+			return
+		}
+
+		if !reserved {
+			a.replayIdempotentRequest(c, entry)
+			return
+		}
+
+		requestHash := newRequestHash(c)
+		body := c.Request.Body
+		c.Request.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(body, requestHash), body}
+
+		writer := &idempotencyResponseWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		completed := false
+		defer func() {
+			if !completed {
+				err := a.subStorage.ReleaseIdempotencyKey(sub, key)
+				if err != nil {
+					log.Error("Couldn't release ", idempotencyKeyHeader, ": ", err.Error())
+				}
+			}
+		}()
+
+		c.Next()
+
+		status := writer.Status()
+		if !isStoredIdempotentStatus(status) {
+			return
+		}
+
+		// include the part of the body the handler didn't read
+		_, err = io.Copy(io.Discard, io.LimitReader(c.Request.Body, a.maxUploadSize))
+		if err != nil {
+			log.Error("Couldn't read request for ", idempotencyKeyHeader, ": ", err.Error())
+			return
+		}
+
+		contentType := writer.Header().Get("Content-Type")
+		response := writer.body.Bytes()
+		if writer.tooLarge {
+			status = 409
+			contentType = "application/json; charset=utf-8"
+			response, _ = json.Marshal(Error{Msg: "A request with this " + idempotencyKeyHeader + " was already processed, but its response was too large to be stored"})
+		}
+		err = a.subStorage.CompleteIdempotencyKey(sub, key, hex.EncodeToString(requestHash.Sum(nil)), status, contentType, response)
+		if err != nil {
+			log.Error("Couldn't store response for ", idempotencyKeyHeader, ": ", err.Error())
+			return
+		}
+		completed = true
+	}
+}
+
+// replayIdempotentRequest responds with the stored response of a request that was sent with the same key
+// before, provided that the requests are the same.
+func (a *Api) replayIdempotentRequest(c *gin.Context, entry *utils.IdempotencyKey) {
+	if entry.Status == 0 {
+		c.AbortWithStatusJSON(409, Error{Msg: "A request with this " + idempotencyKeyHeader + " is still in progress"})
+		return
+	}
+
+	requestHash := newRequestHash(c)
+	_, err := io.Copy(requestHash, http.MaxBytesReader(c.Writer, c.Request.Body, a.maxUploadSize))
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			c.AbortWithStatusJSON(413, Error{Msg: "Couldn't process request - upload exceeds the maximum size of " + strconv.FormatInt(a.maxUploadSize, 10) + " bytes"})
+			return
+		}
+		c.AbortWithStatusJSON(400, Error{Msg: "Couldn't process request - invalid request"})
+		log.Error(err.Error())
+		return
+	}
+
+	if entry.RequestHash != hex.EncodeToString(requestHash.Sum(nil)) {
+		c.AbortWithStatusJSON(422, Error{Msg: idempotencyKeyHeader + " was already used for a different request"})
+		return
+	}
+	c.Header("Idempotent-Replayed", "true")
+	c.Data(entry.Status, entry.ContentType, entry.Response)
+	c.Abort()
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	utils "github.com/sheophe/signal-cli-rest-api/utils"
+)
+
+// newTestIdempotencyRouter creates a router with the idempotency middleware in front of the given handler.
+func newTestIdempotencyRouter(t *testing.T, ttl time.Duration, handler gin.HandlerFunc) *gin.Engine {
+	dir, err := ioutil.TempDir("", "idempotency")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	subStorage, err := utils.NewSubStorage(filepath.Join(dir, "subs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { subStorage.Close() })
+
+	a := &Api{subStorage: subStorage, idempotencyKeyTtl: ttl, maxUploadSize: 1024 * 1024}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set("sub", "sub") })
+	router.POST("/send", a.IdempotencyMiddleware(), handler)
+	return router
+}
+
+func idempotentRequest(router *gin.Engine, key string, query string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/send"+query, strings.NewReader(body))
+	req.Header.Set(idempotencyKeyHeader, key)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// countingHandler responds with the body of the request and the given status.
+func countingHandler(calls *int32, status int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		atomic.AddInt32(calls, 1)
+		body, _ := ioutil.ReadAll(c.Request.Body)
+		c.String(status, string(body))
+	}
+}
+
+func TestIdempotencyMiddlewareReplay(t *testing.T) {
+	var calls int32
+	router := newTestIdempotencyRouter(t, time.Hour, countingHandler(&calls, 201))
+
+	first := idempotentRequest(router, "key", "", "hello")
+	second := idempotentRequest(router, "key", "", "hello")
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Fatalf("expected the handler to be called once, got %d", atomic.LoadInt32(&calls))
+	}
+	if second.Code != 201 || second.Body.String() != first.Body.String() || second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("expected the stored response to be replayed, got %d %s", second.Code, second.Body.String())
+	}
+
+	idempotentRequest(router, "other-key", "", "hello")
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Errorf("expected a different key to be processed, got %d call(s)", atomic.LoadInt32(&calls))
+	}
+}
+
+func TestIdempotencyMiddlewareConflict(t *testing.T) {
+	var calls int32
+	router := newTestIdempotencyRouter(t, time.Hour, countingHandler(&calls, 201))
+
+	idempotentRequest(router, "key", "?async=false", "hello")
+	if w := idempotentRequest(router, "key", "?async=false", "other body"); w.Code != 422 {
+		t.Errorf("expected a different body to be rejected, got %d", w.Code)
+	}
+	if w := idempotentRequest(router, "key", "?async=true", "hello"); w.Code != 422 {
+		t.Errorf("expected a different query to be rejected, got %d", w.Code)
+	}
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("expected the handler to be called once, got %d", atomic.LoadInt32(&calls))
+	}
+}
+
+func TestIdempotencyMiddlewareInProgress(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	router := newTestIdempotencyRouter(t, time.Hour, func(c *gin.Context) {
+		close(started)
+		<-release
+		c.String(201, "sent")
+	})
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- idempotentRequest(router, "key", "", "hello") }()
+	<-started
+
+	if w := idempotentRequest(router, "key", "", "hello"); w.Code != 409 {
+		t.Errorf("expected a request with a key that is in use to be rejected, got %d", w.Code)
+	}
+	close(release)
+	if w := <-done; w.Code != 201 {
+		t.Errorf("expected the first request to succeed, got %d", w.Code)
+	}
+}
+
+func TestIdempotencyMiddlewareExpiry(t *testing.T) {
+	var calls int32
+	router := newTestIdempotencyRouter(t, 50*time.Millisecond, countingHandler(&calls, 201))
+
+	idempotentRequest(router, "key", "", "hello")
+	time.Sleep(100 * time.Millisecond)
+	idempotentRequest(router, "key", "", "hello")
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Errorf("expected the expired key to be processed again, got %d call(s)", atomic.LoadInt32(&calls))
+	}
+}
+
+func TestIdempotencyMiddlewareFailedRequests(t *testing.T) {
+	var calls int32
+	router := newTestIdempotencyRouter(t, time.Hour, countingHandler(&calls, 400))
+
+	idempotentRequest(router, "key", "", "hello")
+	idempotentRequest(router, "key", "", "hello")
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Errorf("expected a failed request to be retried, got %d call(s)", atomic.LoadInt32(&calls))
+	}
+
+	// the outcome of a timeout is unknown, so it isn't retried
+	calls = 0
+	router = newTestIdempotencyRouter(t, time.Hour, countingHandler(&calls, 504))
+	idempotentRequest(router, "key", "", "hello")
+	if w := idempotentRequest(router, "key", "", "hello"); w.Code != 504 || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("expected the timeout to be replayed, got %d after %d call(s)", w.Code, atomic.LoadInt32(&calls))
+	}
+}
+
+func TestIdempotencyMiddlewareLargeResponse(t *testing.T) {
+	var calls int32
+	router := newTestIdempotencyRouter(t, time.Hour, func(c *gin.Context) {
+		atomic.AddInt32(&calls, 1)
+		c.String(200, strings.Repeat("a", idempotencyResponseMaxSize+1))
+	})
+
+	if w := idempotentRequest(router, "key", "", ""); w.Code != 200 || w.Body.Len() != idempotencyResponseMaxSize+1 {
+		t.Fatalf("expected the full response, got %d with %d bytes", w.Code, w.Body.Len())
+	}
+	if w := idempotentRequest(router, "key", "", ""); w.Code != 409 || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("expected the request not to be processed again, got %d after %d call(s)", w.Code, atomic.LoadInt32(&calls))
+	}
+}
@@ -0,0 +1,249 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	uuid "github.com/gofrs/uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sheophe/signal-cli-rest-api/client"
+	utils "github.com/sheophe/signal-cli-rest-api/utils"
+)
+
+// size of the per number job channel; if it is full, dispatching falls back to a goroutine
+const sendQueueChannelSize = 1024
+
+type deliverSendJobFunc func(job *utils.SendJob) (*[]client.SendResponse, error)
+
+// permanentError marks a failure that won't go away by retrying, e.g. an invalid request.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// isPermanentSendError reports whether sending failed for a reason that a retry can't fix.
+func isPermanentSendError(err error) bool {
+	var permanent *permanentError
+	var unregisteredRecipientError *client.UnregisteredRecipientError
+	var groupNotFoundError *client.GroupNotFoundError
+	var accountNotLoggedInError *client.AccountNotLoggedInError
+	var invalidNameError *client.InvalidNameError
+	var notFoundError *client.NotFoundError
+	var attachmentTooLargeError *client.AttachmentTooLargeError
+	return errors.As(err, &permanent) || errors.As(err, &unregisteredRecipientError) ||
+		errors.As(err, &groupNotFoundError) || errors.As(err, &accountNotLoggedInError) ||
+		errors.As(err, &invalidNameError) || errors.As(err, &notFoundError) || errors.As(err, &attachmentTooLargeError)
+}
+
+type SendQueue struct {
+	jobStorage     *utils.JobStorage
+	deliver        deliverSendJobFunc
+	workers        int
+	maxAttempts    int
+	retryBaseDelay time.Duration
+	retryMaxDelay  time.Duration
+	queues         map[string]chan string
+	mutex          sync.Mutex
+}
+
+func NewSendQueue(jobStorage *utils.JobStorage, workers int, maxAttempts int, retryBaseDelay time.Duration, retryMaxDelay time.Duration) *SendQueue {
+	return &SendQueue{
+		jobStorage:     jobStorage,
+		workers:        workers,
+		maxAttempts:    maxAttempts,
+		retryBaseDelay: retryBaseDelay,
+		retryMaxDelay:  retryMaxDelay,
+		queues:         make(map[string]chan string),
+	}
+}
+
+// message of a job that was being sent when the process stopped
+const interruptedSendJobError = "Delivery was interrupted by a shutdown - the message may or may not have been sent, so it isn't sent again"
+
+// Start picks up all jobs that weren't finished before the last shutdown. Jobs that were being sent at that
+// time are marked as failed instead of being sent again, as it is unknown whether the message went out.
+func (q *SendQueue) Start() error {
+	if q.deliver == nil {
+		return errors.New("no delivery function set")
+	}
+
+	jobs, err := q.jobStorage.GetUnfinishedJobs()
+	if err != nil {
+		return err
+	}
+
+	resumed := 0
+	for i := range jobs {
+		job := &jobs[i]
+		if job.Status == utils.SendJobSending {
+			log.Warn("Send job ", job.ID, " was interrupted by a shutdown, marking it as failed")
+			job.Status = utils.SendJobFailed
+			job.LastError = interruptedSendJobError
+			err = q.jobStorage.SaveJob(job)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		resumed += 1
+		delay := time.Until(job.NextAttemptAt)
+		if job.Status == utils.SendJobRetrying && delay > 0 {
+			q.dispatchAfter(job.Number, job.ID, delay)
+		} else {
+			q.dispatch(job.Number, job.ID)
+		}
+	}
+
+	if resumed > 0 {
+		log.Info("Resumed ", resumed, " unfinished send job(s)")
+	}
+	return nil
+}
+
+func (q *SendQueue) Enqueue(sub string, number string, payload interface{}) (*utils.SendJob, error) {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+
+	job := utils.SendJob{
+		ID:      u.String(),
+		Sub:     sub,
+		Number:  number,
+		Status:  utils.SendJobQueued,
+		Payload: string(payloadBytes),
+	}
+	err = q.jobStorage.CreateJob(&job)
+	if err != nil {
+		return nil, err
+	}
+
+	q.dispatch(number, job.ID)
+	return &job, nil
+}
+
+func (q *SendQueue) GetJob(id string) (*utils.SendJob, bool) {
+	return q.jobStorage.GetJob(id)
+}
+
+func (q *SendQueue) getQueue(number string) chan string {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	queue, ok := q.queues[number]
+	if !ok {
+		queue = make(chan string, sendQueueChannelSize)
+		q.queues[number] = queue
+		for i := 0; i < q.workers; i++ {
+			go q.work(queue)
+		}
+	}
+	return queue
+}
+
+func (q *SendQueue) dispatch(number string, id string) {
+	queue := q.getQueue(number)
+	select {
+	case queue <- id:
+	default:
+		go func() { queue <- id }()
+	}
+}
+
+func (q *SendQueue) dispatchAfter(number string, id string, delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		q.dispatch(number, id)
+	})
+}
+
+func (q *SendQueue) work(queue chan string) {
+	for id := range queue {
+		q.process(id)
+	}
+}
+
+func (q *SendQueue) retryDelay(attempts int) time.Duration {
+	return retryDelay(q.retryBaseDelay, q.retryMaxDelay, attempts)
+}
+
+// retryDelay doubles the base delay with every attempt, up to the max delay.
+func retryDelay(baseDelay time.Duration, maxDelay time.Duration, attempts int) time.Duration {
+	delay := baseDelay
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= maxDelay {
+			return maxDelay
+		}
+	}
+	return delay
+}
+
+func (q *SendQueue) process(id string) {
+	job, ok := q.jobStorage.GetJob(id)
+	if !ok {
+		log.Error("Couldn't process send job ", id, ": job not found")
+		return
+	}
+
+	job.Status = utils.SendJobSending
+	job.Attempts += 1
+	err := q.jobStorage.SaveJob(job)
+	if err != nil {
+		log.Error("Couldn't update send job ", id, ": ", err.Error())
+		return
+	}
+
+	resp, err := q.deliver(job)
+	if err == nil {
+		respBytes, err := json.Marshal(resp)
+		if err != nil {
+			log.Error("Couldn't serialize response of send job ", id, ": ", err.Error())
+		}
+		job.Status = utils.SendJobSent
+		job.LastError = ""
+		job.Response = string(respBytes)
+		err = q.jobStorage.SaveJob(job)
+		if err != nil {
+			log.Error("Couldn't update send job ", id, ": ", err.Error())
+		}
+		return
+	}
+
+	job.LastError = err.Error()
+	if job.Attempts >= q.maxAttempts || isPermanentSendError(err) {
+		log.Error("Giving up on send job ", id, " after ", job.Attempts, " attempt(s): ", err.Error())
+		job.Status = utils.SendJobFailed
+		err = q.jobStorage.SaveJob(job)
+		if err != nil {
+			log.Error("Couldn't update send job ", id, ": ", err.Error())
+		}
+		return
+	}
+
+	delay := q.retryDelay(job.Attempts)
+	log.Debug("Send job ", id, " failed (attempt ", job.Attempts, "), retrying in ", delay, ": ", err.Error())
+	job.Status = utils.SendJobRetrying
+	job.NextAttemptAt = time.Now().Add(delay)
+	err = q.jobStorage.SaveJob(job)
+	if err != nil {
+		log.Error("Couldn't update send job ", id, ": ", err.Error())
+		return
+	}
+	q.dispatchAfter(job.Number, job.ID, delay)
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sheophe/signal-cli-rest-api/client"
+	utils "github.com/sheophe/signal-cli-rest-api/utils"
+)
+
+func newTestJobStorage(t *testing.T) *utils.JobStorage {
+	dir, err := ioutil.TempDir("", "jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	jobStorage, err := utils.NewJobStorage(filepath.Join(dir, "jobs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { jobStorage.Close() })
+	return jobStorage
+}
+
+// newTestSendQueue creates a queue whose deliveries fail with the given errors (one per attempt) and succeed afterwards.
+func newTestSendQueue(t *testing.T, jobStorage *utils.JobStorage, maxAttempts int, failures ...error) (*SendQueue, *int32) {
+	var calls int32
+	q := NewSendQueue(jobStorage, 1, maxAttempts, 20*time.Millisecond, time.Second)
+	q.deliver = func(job *utils.SendJob) (*[]client.SendResponse, error) {
+		call := int(atomic.AddInt32(&calls, 1))
+		if call <= len(failures) {
+			return nil, failures[call-1]
+		}
+		return &[]client.SendResponse{{Timestamp: 1}}, nil
+	}
+	return q, &calls
+}
+
+func waitForJobStatus(t *testing.T, q *SendQueue, id string, status string) *utils.SendJob {
+	var job *utils.SendJob
+	waitFor(t, func() bool {
+		job, _ = q.GetJob(id)
+		return job != nil && job.Status == status
+	})
+	return job
+}
+
+func TestSendQueueRetries(t *testing.T) {
+	q, calls := newTestSendQueue(t, newTestJobStorage(t), 3, errors.New("network error"), errors.New("network error"))
+	err := q.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	job, err := q.Enqueue("sub", "+491111", SendMessageV2{Number: "+491111", Message: "Hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job = waitForJobStatus(t, q, job.ID, utils.SendJobSent)
+	if job.Attempts != 3 || atomic.LoadInt32(calls) != 3 {
+		t.Errorf("expected 3 attempts, got %d (%d calls)", job.Attempts, atomic.LoadInt32(calls))
+	}
+	if job.LastError != "" || job.Response == "" {
+		t.Errorf("expected the response and no error, got %+v", job)
+	}
+	// the retries wait 20ms and 40ms
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("expected the retries to back off, but the job was sent after %s", elapsed)
+	}
+}
+
+func TestSendQueueGivesUp(t *testing.T) {
+	q, calls := newTestSendQueue(t, newTestJobStorage(t), 2, errors.New("network error"), errors.New("still down"))
+	q.Start()
+
+	job, err := q.Enqueue("sub", "+491111", SendMessageV2{Number: "+491111", Message: "Hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job = waitForJobStatus(t, q, job.ID, utils.SendJobFailed)
+	if job.Attempts != 2 || job.LastError != "still down" {
+		t.Errorf("expected 2 attempts with the last error, got %+v", job)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadInt32(calls) != 2 {
+		t.Errorf("expected no further attempts, got %d calls", atomic.LoadInt32(calls))
+	}
+}
+
+func TestSendQueuePermanentError(t *testing.T) {
+	failures := []error{
+		&client.UnregisteredRecipientError{Description: "unregistered user"},
+		&client.GroupNotFoundError{Description: "group not found"},
+		&permanentError{errors.New("invalid request")},
+	}
+	for _, failure := range failures {
+		q, calls := newTestSendQueue(t, newTestJobStorage(t), 5, failure)
+		q.Start()
+
+		job, err := q.Enqueue("sub", "+491111", SendMessageV2{Number: "+491111", Message: "Hello"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		job = waitForJobStatus(t, q, job.ID, utils.SendJobFailed)
+		if job.Attempts != 1 || atomic.LoadInt32(calls) != 1 {
+			t.Errorf("%s: expected the job to fail after the first attempt, got %d attempt(s)", failure.Error(), job.Attempts)
+		}
+	}
+}
+
+func TestSendQueueResumesAfterRestart(t *testing.T) {
+	jobStorage := newTestJobStorage(t)
+	jobs := []utils.SendJob{
+		{ID: "in-flight", Sub: "sub", Number: "+491111", Status: utils.SendJobSending, Payload: "{}", Attempts: 1},
+		{ID: "retrying", Sub: "sub", Number: "+491111", Status: utils.SendJobRetrying, Payload: "{}", Attempts: 1,
+			NextAttemptAt: time.Now().Add(50 * time.Millisecond)},
+		{ID: "sent", Sub: "sub", Number: "+491111", Status: utils.SendJobSent, Payload: "{}", Attempts: 1},
+	}
+	for i := range jobs {
+		err := jobStorage.CreateJob(&jobs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q, calls := newTestSendQueue(t, jobStorage, 5)
+	err := q.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := waitForJobStatus(t, q, "retrying", utils.SendJobSent)
+	if job.Attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", job.Attempts)
+	}
+
+	job, _ = q.GetJob("in-flight")
+	if job.Status != utils.SendJobFailed || job.Attempts != 1 || job.LastError != interruptedSendJobError {
+		t.Errorf("expected the interrupted job to be marked as failed, got %+v", job)
+	}
+	if atomic.LoadInt32(calls) != 1 {
+		t.Errorf("expected neither the sent nor the interrupted job to be delivered again, got %d calls", atomic.LoadInt32(calls))
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	expected := []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, delay := range expected {
+		if actual := retryDelay(2*time.Second, 10*time.Second, i+1); actual != delay {
+			t.Errorf("attempt %d: expected %s, got %s", i+1, delay, actual)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// RateLimiter is a token bucket rate limiter with one bucket per key. Every bucket holds up to burst
+// tokens and is refilled with ratePerMinute tokens per minute.
+type RateLimiter struct {
+	ratePerSecond float64
+	burst         float64
+	buckets       map[string]*tokenBucket
+	mutex         sync.Mutex
+}
+
+// NewRateLimiter creates a rate limiter. In case ratePerMinute is 0, rate limiting is disabled and nil is returned.
+func NewRateLimiter(ratePerMinute int, burst int) *RateLimiter {
+	if ratePerMinute <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		ratePerSecond: float64(ratePerMinute) / 60,
+		burst:         float64(burst),
+		buckets:       make(map[string]*tokenBucket),
+	}
+}
+
+func (r *RateLimiter) refill(key string, now time.Time) *tokenBucket {
+	bucket, ok := r.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: r.burst, lastRefill: now}
+		r.buckets[key] = bucket
+		return bucket
+	}
+	bucket.tokens = math.Min(r.burst, bucket.tokens+now.Sub(bucket.lastRefill).Seconds()*r.ratePerSecond)
+	bucket.lastRefill = now
+	return bucket
+}
+
+// Take removes a token from the bucket of the given key. If the bucket is empty, false and the time
+// until the next token is available are returned. A nil RateLimiter allows everything.
+func (r *RateLimiter) Take(key string) (bool, time.Duration) {
+	if r == nil {
+		return true, 0
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.take(key, time.Now())
+}
+
+func (r *RateLimiter) take(key string, now time.Time) (bool, time.Duration) {
+	bucket := r.refill(key, now)
+	if bucket.tokens < 1 {
+		wait := (1 - bucket.tokens) / r.ratePerSecond
+		return false, time.Duration(wait * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// Return puts back a token that was taken, but not used.
+func (r *RateLimiter) Return(key string) {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.returnToken(key, time.Now())
+}
+
+func (r *RateLimiter) returnToken(key string, now time.Time) {
+	bucket := r.refill(key, now)
+	bucket.tokens = math.Min(r.burst, bucket.tokens+1)
+}
+
+// Wait blocks until a token of the given key is available and takes it. It is used for
+// messages that are sent in the background, where there is no caller to reject.
+func (r *RateLimiter) Wait(key string) {
+	for {
+		ok, wait := r.Take(key)
+		if ok {
+			return
+		}
+		time.Sleep(wait)
+	}
+}
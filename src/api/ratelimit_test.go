@@ -0,0 +1,88 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBurst(t *testing.T) {
+	r := NewRateLimiter(60, 3)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := r.take("a", now); !ok {
+			t.Fatalf("token %d of the burst wasn't granted", i+1)
+		}
+	}
+
+	ok, wait := r.take("a", now)
+	if ok {
+		t.Fatal("token beyond the burst was granted")
+	}
+	if wait != time.Second {
+		t.Errorf("expected to wait 1s, got %s", wait)
+	}
+
+	if ok, _ := r.take("b", now); !ok {
+		t.Error("keys don't have separate buckets")
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	r := NewRateLimiter(60, 2)
+	now := time.Now()
+
+	r.take("a", now)
+	r.take("a", now)
+
+	if ok, _ := r.take("a", now.Add(500*time.Millisecond)); ok {
+		t.Fatal("token was granted before it was refilled")
+	}
+	if ok, _ := r.take("a", now.Add(time.Second)); !ok {
+		t.Fatal("token wasn't refilled after 1s")
+	}
+
+	// refilling is capped at the burst
+	later := now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		if ok, _ := r.take("a", later); !ok {
+			t.Fatalf("token %d wasn't refilled", i+1)
+		}
+	}
+	if ok, _ := r.take("a", later); ok {
+		t.Error("bucket was refilled beyond the burst")
+	}
+}
+
+func TestRateLimiterReturn(t *testing.T) {
+	r := NewRateLimiter(60, 1)
+	now := time.Now()
+
+	r.take("a", now)
+	r.returnToken("a", now)
+	if ok, _ := r.take("a", now); !ok {
+		t.Fatal("returned token wasn't granted")
+	}
+
+	// returning doesn't exceed the burst
+	r.returnToken("a", now)
+	r.returnToken("a", now)
+	r.take("a", now)
+	if ok, _ := r.take("a", now); ok {
+		t.Error("bucket holds more tokens than the burst")
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	r := NewRateLimiter(0, 10)
+	if r != nil {
+		t.Fatal("expected rate limiting to be disabled")
+	}
+	for i := 0; i < 100; i++ {
+		if ok, _ := r.Take("a"); !ok {
+			t.Fatal("disabled rate limiter rejected a token")
+		}
+	}
+	r.Return("a")
+	r.Wait("a")
+}
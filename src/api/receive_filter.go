@@ -0,0 +1,103 @@
+package api
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sheophe/signal-cli-rest-api/client"
+	utils "github.com/sheophe/signal-cli-rest-api/utils"
+)
+
+// receiveFilter decides which received messages are delivered to a client. Every criterion that is set
+// needs to match; lists match if any of their entries matches.
+type receiveFilter struct {
+	types          []string
+	senders        []string
+	groupIds       []string
+	hasText        *bool
+	hasAttachments *bool
+}
+
+func splitFilterValues(value string) []string {
+	values := []string{}
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func parseFilterBool(c *gin.Context, name string) (*bool, error) {
+	value := c.Query(name)
+	if value == "" {
+		return nil, nil
+	}
+	if value != "true" && value != "false" {
+		return nil, errors.New(name + " parameter needs to be either 'true' or 'false'")
+	}
+	b := StringToBool(value)
+	return &b, nil
+}
+
+// parseReceiveFilter reads the filter from the query parameters type, sender, group_id (all of them
+// comma-separated lists), has_text and has_attachment.
+func parseReceiveFilter(c *gin.Context) (*receiveFilter, error) {
+	filter := &receiveFilter{
+		types:    splitFilterValues(c.Query("type")),
+		senders:  splitFilterValues(c.Query("sender")),
+		groupIds: splitFilterValues(c.Query("group_id")),
+	}
+	for _, messageType := range filter.types {
+		if !utils.IsValidMessageType(messageType) {
+			return nil, errors.New("invalid type '" + messageType + "'")
+		}
+	}
+
+	var err error
+	filter.hasText, err = parseFilterBool(c, "has_text")
+	if err != nil {
+		return nil, err
+	}
+	filter.hasAttachments, err = parseFilterBool(c, "has_attachment")
+	if err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+func (f *receiveFilter) isEmpty() bool {
+	return len(f.types) == 0 && len(f.senders) == 0 && len(f.groupIds) == 0 && f.hasText == nil && f.hasAttachments == nil
+}
+
+func containsValue(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether the envelope passes the filter.
+func (f *receiveFilter) matches(envelope *client.SignalCliEnvelope) bool {
+	if len(f.types) > 0 && !containsValue(f.types, envelope.MessageType()) {
+		return false
+	}
+	if len(f.senders) > 0 && !containsValue(f.senders, envelope.SourceNumber) &&
+		!containsValue(f.senders, envelope.SourceUuid) && !containsValue(f.senders, envelope.Source) {
+		return false
+	}
+	if len(f.groupIds) > 0 && !containsValue(f.groupIds, envelope.GroupId()) {
+		return false
+	}
+	if f.hasText != nil && envelope.HasText() != *f.hasText {
+		return false
+	}
+	if f.hasAttachments != nil && envelope.HasAttachments() != *f.hasAttachments {
+		return false
+	}
+	return true
+}
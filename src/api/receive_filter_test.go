@@ -0,0 +1,116 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sheophe/signal-cli-rest-api/client"
+)
+
+func newTestReceiveFilter(t *testing.T, query string) (*receiveFilter, error) {
+	t.Helper()
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/v1/receive/+491111?"+query, nil)
+	return parseReceiveFilter(c)
+}
+
+func TestParseReceiveFilter(t *testing.T) {
+	testCases := []struct {
+		query string
+		valid bool
+		empty bool
+	}{
+		{"", true, true},
+		{"format=v2", true, true},
+		{"type=message,reaction", true, false},
+		{"type=message,unknown", false, false},
+		{"sender=%2B492222&group_id=group.abc", true, false},
+		{"has_text=true", true, false},
+		{"has_attachment=yes", false, false},
+	}
+
+	for _, testCase := range testCases {
+		filter, err := newTestReceiveFilter(t, testCase.query)
+		if (err == nil) != testCase.valid {
+			t.Errorf("%q: expected valid to be %v, got error %v", testCase.query, testCase.valid, err)
+			continue
+		}
+		if err == nil && filter.isEmpty() != testCase.empty {
+			t.Errorf("%q: expected empty to be %v", testCase.query, testCase.empty)
+		}
+	}
+}
+
+func TestReceiveFilterMatches(t *testing.T) {
+	envelopes := map[string]string{
+		"text":       `{"envelope":{"sourceNumber":"+492222","sourceUuid":"uuid-2","timestamp":1000,"dataMessage":{"message":"Hello"}}}`,
+		"group":      `{"envelope":{"sourceNumber":"+493333","timestamp":1000,"dataMessage":{"message":"Hi","groupInfo":{"groupId":"abc"},"attachments":[{"id":"att1"}]}}}`,
+		"attachment": `{"envelope":{"sourceNumber":"+492222","timestamp":1000,"dataMessage":{"attachments":[{"id":"att1"}]}}}`,
+		"typing":     `{"envelope":{"sourceNumber":"+492222","timestamp":1000,"typingMessage":{"action":"STARTED"}}}`,
+		"receipt":    `{"envelope":{"sourceNumber":"+493333","timestamp":1000,"receiptMessage":{"isDelivery":true}}}`,
+	}
+
+	testCases := []struct {
+		query    string
+		expected []string
+	}{
+		{"", []string{"attachment", "group", "receipt", "text", "typing"}},
+		{"type=message", []string{"attachment", "group", "text"}},
+		{"type=typing,receipt", []string{"receipt", "typing"}},
+		{"sender=uuid-2", []string{"text"}},
+		{"sender=%2B493333", []string{"group", "receipt"}},
+		{"group_id=group.YWJj", []string{"group"}},
+		{"has_text=true", []string{"group", "text"}},
+		{"has_attachment=true&has_text=false", []string{"attachment"}},
+		{"type=message&has_attachment=false", []string{"text"}},
+	}
+
+	for _, testCase := range testCases {
+		filter, err := newTestReceiveFilter(t, testCase.query)
+		if err != nil {
+			t.Fatalf("%q: %s", testCase.query, err.Error())
+		}
+		matched := []string{}
+		for _, name := range []string{"attachment", "group", "receipt", "text", "typing"} {
+			received, err := client.ParseReceivedMessage([]byte(envelopes[name]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if filter.matches(&received.Envelope) {
+				matched = append(matched, name)
+			}
+		}
+		if len(matched) != len(testCase.expected) {
+			t.Errorf("%q: expected %v, got %v", testCase.query, testCase.expected, matched)
+			continue
+		}
+		for i := range matched {
+			if matched[i] != testCase.expected[i] {
+				t.Errorf("%q: expected %v, got %v", testCase.query, testCase.expected, matched)
+				break
+			}
+		}
+	}
+}
+
+func TestFormatReceivedMessage(t *testing.T) {
+	data := []byte(`{"envelope":{"sourceNumber":"+492222","timestamp":1000,"typingMessage":{"action":"STARTED"}}}`)
+
+	filter, _ := newTestReceiveFilter(t, "")
+	if formatted, ok := formatReceivedMessage("+491111", data, receiveFormatV1, filter); !ok || string(formatted) != string(data) {
+		t.Errorf("expected the envelope to be passed through, got %s", formatted)
+	}
+
+	filter, _ = newTestReceiveFilter(t, "type=message")
+	if _, ok := formatReceivedMessage("+491111", data, receiveFormatV1, filter); ok {
+		t.Error("expected the typing indicator to be filtered out")
+	}
+
+	filter, _ = newTestReceiveFilter(t, "type=typing")
+	formatted, ok := formatReceivedMessage("+491111", data, receiveFormatV2, filter)
+	expected := `{"account":"+491111","type":"typing","timestamp":1000,"sender":{"number":"+492222"},"typing":{"action":"started"}}`
+	if !ok || string(formatted) != expected {
+		t.Errorf("expected %s, got %s", expected, formatted)
+	}
+}
@@ -0,0 +1,208 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sheophe/signal-cli-rest-api/client"
+	utils "github.com/sheophe/signal-cli-rest-api/utils"
+)
+
+type dispatchScheduleFunc func(schedule *utils.Schedule) (*[]client.SendResponse, error)
+
+// scheduleTimer is the registration of a one-shot schedule. A new one is created whenever the
+// schedule is registered, so that a fired timer can tell whether it is still the current one.
+type scheduleTimer struct {
+	*time.Timer
+}
+
+type Scheduler struct {
+	scheduleStorage *utils.ScheduleStorage
+	dispatch        dispatchScheduleFunc
+	cron            *cron.Cron
+	parser          cron.Parser
+	cronEntries     map[string]cron.EntryID
+	timers          map[string]*scheduleTimer
+	mutex           sync.Mutex
+}
+
+func NewScheduler(scheduleStorage *utils.ScheduleStorage) *Scheduler {
+	return &Scheduler{
+		scheduleStorage: scheduleStorage,
+		cron:            cron.New(),
+		parser:          cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow),
+		cronEntries:     make(map[string]cron.EntryID),
+		timers:          make(map[string]*scheduleTimer),
+	}
+}
+
+// Start registers all active schedules. One-shot schedules whose send time
+// passed while the service was down are dispatched right away.
+func (s *Scheduler) Start() error {
+	if s.dispatch == nil {
+		return errors.New("no dispatch function set")
+	}
+
+	schedules, err := s.scheduleStorage.GetActiveSchedules()
+	if err != nil {
+		return err
+	}
+
+	for i := range schedules {
+		err = s.Add(&schedules[i])
+		if err != nil {
+			log.Error("Couldn't register schedule ", schedules[i].ID, ": ", err.Error())
+		}
+	}
+
+	s.cron.Start()
+	return nil
+}
+
+func (s *Scheduler) ParseCron(expression string) (cron.Schedule, error) {
+	return s.parser.Parse(expression)
+}
+
+func (s *Scheduler) Add(schedule *utils.Schedule) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.add(schedule)
+}
+
+// Save stores the changes of an existing schedule and registers it again. Both happen under the
+// mutex, so that a one-shot schedule that is being dispatched at the same time doesn't overwrite them.
+func (s *Scheduler) Save(schedule *utils.Schedule) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := s.scheduleStorage.SaveSchedule(schedule)
+	if err != nil {
+		return err
+	}
+	return s.add(schedule)
+}
+
+// add needs to be called with the mutex held.
+func (s *Scheduler) add(schedule *utils.Schedule) error {
+	s.remove(schedule.ID)
+
+	if !schedule.Active {
+		return nil
+	}
+
+	id := schedule.ID
+	if schedule.Cron != "" {
+		cronSchedule, err := s.parser.Parse(schedule.Cron)
+		if err != nil {
+			return err
+		}
+		s.cronEntries[id] = s.cron.Schedule(cronSchedule, cron.FuncJob(func() {
+			s.run(id, nil)
+		}))
+	} else if schedule.SendAt != nil {
+		timer := &scheduleTimer{}
+		timer.Timer = time.AfterFunc(time.Until(*schedule.SendAt), func() {
+			s.run(id, timer)
+		})
+		s.timers[id] = timer
+	} else {
+		return errors.New("schedule needs either a send time or a cron expression")
+	}
+	return nil
+}
+
+func (s *Scheduler) Remove(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.remove(id)
+}
+
+func (s *Scheduler) remove(id string) {
+	if entryId, ok := s.cronEntries[id]; ok {
+		s.cron.Remove(entryId)
+		delete(s.cronEntries, id)
+	}
+	if timer, ok := s.timers[id]; ok {
+		timer.Stop()
+		delete(s.timers, id)
+	}
+}
+
+// NextRun returns the time the schedule is going to be dispatched next, if any.
+func (s *Scheduler) NextRun(schedule *utils.Schedule) *time.Time {
+	if !schedule.Active {
+		return nil
+	}
+
+	if schedule.Cron != "" {
+		s.mutex.Lock()
+		entryId, ok := s.cronEntries[schedule.ID]
+		s.mutex.Unlock()
+		if !ok {
+			return nil
+		}
+		next := s.cron.Entry(entryId).Next
+		if next.IsZero() {
+			return nil
+		}
+		return &next
+	}
+
+	return schedule.SendAt
+}
+
+// run dispatches a schedule. For one-shot schedules, timer is the timer that fired.
+func (s *Scheduler) run(id string, timer *scheduleTimer) {
+	schedule, ok := s.scheduleStorage.GetSchedule(id)
+	if !ok || !schedule.Active {
+		return
+	}
+
+	run := utils.ScheduleRun{ScheduleID: id, RunAt: time.Now()}
+	resp, err := s.dispatch(schedule)
+	if err != nil {
+		log.Error("Couldn't dispatch schedule ", id, ": ", err.Error())
+		run.Error = err.Error()
+	} else {
+		run.Success = true
+		respBytes, err := json.Marshal(resp)
+		if err != nil {
+			log.Error("Couldn't serialize response of schedule ", id, ": ", err.Error())
+		}
+		run.Response = string(respBytes)
+	}
+
+	err = s.scheduleStorage.AddScheduleRun(&run)
+	if err != nil {
+		log.Error("Couldn't record run of schedule ", id, ": ", err.Error())
+	}
+
+	if timer != nil {
+		s.complete(id, timer, schedule.UpdatedAt)
+	}
+}
+
+// complete deactivates a one-shot schedule after it was dispatched. If the schedule was updated or
+// removed in the meantime (i.e. the timer isn't the registered one anymore or the stored schedule
+// changed since it was loaded for the dispatch), the schedule is left as it is.
+func (s *Scheduler) complete(id string, timer *scheduleTimer, updatedAt time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.timers[id] != timer {
+		return
+	}
+	delete(s.timers, id)
+
+	_, err := s.scheduleStorage.DeactivateSchedule(id, updatedAt)
+	if err != nil {
+		log.Error("Couldn't update schedule ", id, ": ", err.Error())
+	}
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sheophe/signal-cli-rest-api/client"
+	utils "github.com/sheophe/signal-cli-rest-api/utils"
+)
+
+func newTestScheduler(t *testing.T, dispatch dispatchScheduleFunc) *Scheduler {
+	dir, err := ioutil.TempDir("", "schedules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	scheduleStorage, err := utils.NewScheduleStorage(filepath.Join(dir, "schedules.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { scheduleStorage.Close() })
+
+	s := NewScheduler(scheduleStorage)
+	s.dispatch = dispatch
+	err = s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.cron.Stop() })
+	return s
+}
+
+func createTestSchedule(t *testing.T, s *Scheduler, schedule utils.Schedule) *utils.Schedule {
+	err := s.scheduleStorage.CreateSchedule(&schedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Add(&schedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &schedule
+}
+
+func scheduleRuns(s *Scheduler, id string) []utils.ScheduleRun {
+	runs, _ := s.scheduleStorage.GetScheduleRuns(id, 10)
+	return runs
+}
+
+func dispatchOk(schedule *utils.Schedule) (*[]client.SendResponse, error) {
+	return &[]client.SendResponse{{Timestamp: 1}}, nil
+}
+
+func TestSchedulerOneShot(t *testing.T) {
+	var calls int32
+	s := newTestScheduler(t, func(schedule *utils.Schedule) (*[]client.SendResponse, error) {
+		atomic.AddInt32(&calls, 1)
+		return dispatchOk(schedule)
+	})
+
+	sendAt := time.Now().Add(20 * time.Millisecond)
+	schedule := createTestSchedule(t, s, utils.Schedule{ID: "once", Sub: "sub", Number: "+491111", Payload: "{}", SendAt: &sendAt, Active: true})
+
+	waitFor(t, func() bool { return len(scheduleRuns(s, schedule.ID)) == 1 })
+	waitFor(t, func() bool {
+		stored, _ := s.scheduleStorage.GetSchedule(schedule.ID)
+		return !stored.Active
+	})
+	if runs := scheduleRuns(s, schedule.ID); !runs[0].Success {
+		t.Errorf("expected a successful run, got %+v", runs[0])
+	}
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("expected exactly one dispatch, got %d", atomic.LoadInt32(&calls))
+	}
+}
+
+func TestSchedulerCron(t *testing.T) {
+	s := newTestScheduler(t, dispatchOk)
+	schedule := createTestSchedule(t, s, utils.Schedule{ID: "cron", Sub: "sub", Number: "+491111", Payload: "{}", Cron: "*/5 * * * *", Active: true})
+
+	next := s.NextRun(schedule)
+	if next == nil || next.Minute()%5 != 0 || next.Before(time.Now()) {
+		t.Fatalf("expected the next run on a multiple of 5 minutes, got %v", next)
+	}
+
+	// run the job like cron would
+	s.cron.Entry(s.cronEntries[schedule.ID]).Job.Run()
+	s.cron.Entry(s.cronEntries[schedule.ID]).Job.Run()
+
+	if runs := scheduleRuns(s, schedule.ID); len(runs) != 2 {
+		t.Errorf("expected 2 runs, got %d", len(runs))
+	}
+	stored, _ := s.scheduleStorage.GetSchedule(schedule.ID)
+	if !stored.Active {
+		t.Error("expected the cron schedule to stay active")
+	}
+
+	s.Remove(schedule.ID)
+	if _, ok := s.cronEntries[schedule.ID]; ok || len(s.cron.Entries()) != 0 {
+		t.Error("expected the cron entry to be removed")
+	}
+}
+
+func TestSchedulerUpdateWhileRunning(t *testing.T) {
+	dispatching := make(chan struct{})
+	release := make(chan struct{})
+	s := newTestScheduler(t, func(schedule *utils.Schedule) (*[]client.SendResponse, error) {
+		if schedule.Payload == "{}" {
+			close(dispatching)
+			<-release
+		}
+		return dispatchOk(schedule)
+	})
+
+	sendAt := time.Now()
+	schedule := createTestSchedule(t, s, utils.Schedule{ID: "once", Sub: "sub", Number: "+491111", Payload: "{}", SendAt: &sendAt, Active: true})
+
+	select {
+	case <-dispatching:
+	case <-time.After(5 * time.Second):
+		t.Fatal("schedule wasn't dispatched")
+	}
+
+	// update the schedule while it is being dispatched
+	updated, _ := s.scheduleStorage.GetSchedule(schedule.ID)
+	newSendAt := time.Now().Add(time.Hour)
+	updated.SendAt = &newSendAt
+	updated.Payload = `{"message":"updated"}`
+	updated.Active = true
+	err := s.Save(updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+
+	waitFor(t, func() bool { return len(scheduleRuns(s, schedule.ID)) == 1 })
+	time.Sleep(50 * time.Millisecond)
+
+	stored, _ := s.scheduleStorage.GetSchedule(schedule.ID)
+	if !stored.Active || stored.Payload != updated.Payload || !stored.SendAt.Equal(newSendAt) {
+		t.Errorf("expected the update to be kept, got %+v", stored)
+	}
+	s.mutex.Lock()
+	_, ok := s.timers[schedule.ID]
+	s.mutex.Unlock()
+	if !ok {
+		t.Error("expected the timer of the update to be registered")
+	}
+}
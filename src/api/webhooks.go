@@ -0,0 +1,345 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	uuid "github.com/gofrs/uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sheophe/signal-cli-rest-api/client"
+	utils "github.com/sheophe/signal-cli-rest-api/utils"
+)
+
+// size of the per webhook delivery channel; if it is full, dispatching falls back to a goroutine
+const webhookQueueChannelSize = 1024
+
+// size of the channel of received envelopes that still need to be queued for the webhooks; if it is
+// full, receiving waits
+const webhookEnvelopeChannelSize = 1024
+
+const (
+	// HMAC-SHA256 signature of "<timestamp>.<request body>" (hex encoded, prefixed with "sha256=")
+	webhookSignatureHeader = "X-Signal-Signature-256"
+	// time the request was sent at (unix time in seconds); part of the signature, so that receivers can
+	// reject replayed requests
+	webhookTimestampHeader   = "X-Signal-Timestamp"
+	webhookIdHeader          = "X-Signal-Webhook-Id"
+	webhookDeliveryIdHeader  = "X-Signal-Delivery-Id"
+	webhookAttemptHeader     = "X-Signal-Delivery-Attempt"
+	webhookMessageTypeHeader = "X-Signal-Message-Type"
+)
+
+type receivedEnvelope struct {
+	number      string
+	messageType string
+	data        []byte
+}
+
+// webhookQueue is the delivery channel of a webhook; done is closed once the webhook is deleted.
+type webhookQueue struct {
+	ids  chan string
+	done chan struct{}
+}
+
+// WebhookDispatcher POSTs the received envelopes to the webhooks of their number. Every webhook has its own
+// worker, so a slow endpoint doesn't hold up the others. Failed deliveries are retried with exponential
+// backoff; once they failed too often, they are kept as dead letters that can be replayed.
+type WebhookDispatcher struct {
+	webhookStorage *utils.WebhookStorage
+	httpClient     *http.Client
+	maxAttempts    int
+	retryBaseDelay time.Duration
+	retryMaxDelay  time.Duration
+	envelopes      chan receivedEnvelope
+	queues         map[string]*webhookQueue
+	mutex          sync.Mutex
+}
+
+// NewWebhookDispatcher creates a webhook dispatcher. Unless allowPrivateNetworks is set, webhooks can't
+// reach private, loopback or link-local addresses. Redirects aren't followed.
+func NewWebhookDispatcher(webhookStorage *utils.WebhookStorage, timeout time.Duration, maxAttempts int,
+	retryBaseDelay time.Duration, retryMaxDelay time.Duration, allowPrivateNetworks bool) *WebhookDispatcher {
+	httpClient := &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	if !allowPrivateNetworks {
+		httpClient.Transport = &http.Transport{
+			Proxy:                 nil,
+			DialContext:           client.NewPublicDialer(timeout).DialContext,
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+		}
+	}
+
+	d := &WebhookDispatcher{
+		webhookStorage: webhookStorage,
+		httpClient:     httpClient,
+		maxAttempts:    maxAttempts,
+		retryBaseDelay: retryBaseDelay,
+		retryMaxDelay:  retryMaxDelay,
+		envelopes:      make(chan receivedEnvelope, webhookEnvelopeChannelSize),
+		queues:         make(map[string]*webhookQueue),
+	}
+	go d.queueEnvelopes()
+	return d
+}
+
+// Start picks up all deliveries that weren't finished before the last shutdown.
+func (d *WebhookDispatcher) Start() error {
+	deliveries, err := d.webhookStorage.GetUnfinishedDeliveries()
+	if err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		delay := time.Until(delivery.NextAttemptAt)
+		if delivery.Status == utils.WebhookDeliveryRetrying && delay > 0 {
+			d.dispatchAfter(delivery.WebhookID, delivery.ID, delay)
+		} else {
+			d.dispatch(delivery.WebhookID, delivery.ID)
+		}
+	}
+
+	if len(deliveries) > 0 {
+		log.Info("Resumed ", len(deliveries), " unfinished webhook deliveries")
+	}
+	return nil
+}
+
+// Dispatch queues a received envelope for all webhooks of the number that subscribed to its message type.
+// The deliveries are created in the background, so that receiving doesn't wait for the database.
+func (d *WebhookDispatcher) Dispatch(number string, messageType string, data []byte) {
+	d.envelopes <- receivedEnvelope{number: number, messageType: messageType, data: data}
+}
+
+func (d *WebhookDispatcher) queueEnvelopes() {
+	for envelope := range d.envelopes {
+		d.createDeliveries(envelope.number, envelope.messageType, envelope.data)
+	}
+}
+
+func (d *WebhookDispatcher) createDeliveries(number string, messageType string, data []byte) {
+	webhooks, err := d.webhookStorage.GetWebhooksByNumber(number)
+	if err != nil {
+		log.Error("Couldn't look up webhooks of ", number, ": ", err.Error())
+		return
+	}
+
+	for _, webhook := range webhooks {
+		if !webhook.Matches(messageType) {
+			continue
+		}
+
+		u, err := uuid.NewV4()
+		if err != nil {
+			log.Error("Couldn't create webhook delivery: ", err.Error())
+			return
+		}
+
+		delivery := utils.WebhookDelivery{
+			ID:          u.String(),
+			WebhookID:   webhook.ID,
+			MessageType: messageType,
+			Status:      utils.WebhookDeliveryPending,
+			Payload:     string(data),
+		}
+		err = d.webhookStorage.CreateDelivery(&delivery)
+		if err != nil {
+			log.Error("Couldn't store webhook delivery for ", webhook.Url, ": ", err.Error())
+			continue
+		}
+		d.dispatch(webhook.ID, delivery.ID)
+	}
+}
+
+// Replay queues a dead letter again; it gets the full number of attempts.
+func (d *WebhookDispatcher) Replay(delivery *utils.WebhookDelivery) error {
+	delivery.Status = utils.WebhookDeliveryPending
+	delivery.Attempts = 0
+	delivery.LastError = ""
+	delivery.LastStatusCode = 0
+	delivery.NextAttemptAt = time.Time{}
+	err := d.webhookStorage.SaveDelivery(delivery)
+	if err != nil {
+		return err
+	}
+
+	d.dispatch(delivery.WebhookID, delivery.ID)
+	return nil
+}
+
+// DeleteWebhook deletes the webhook together with its deliveries and stops its worker.
+func (d *WebhookDispatcher) DeleteWebhook(id string) error {
+	err := d.webhookStorage.DeleteWebhook(id)
+	if err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if queue, ok := d.queues[id]; ok {
+		close(queue.done)
+		delete(d.queues, id)
+	}
+	return nil
+}
+
+// getQueue returns the queue of the webhook; nil in case the webhook doesn't exist (anymore).
+func (d *WebhookDispatcher) getQueue(webhookId string) *webhookQueue {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	queue, ok := d.queues[webhookId]
+	if !ok {
+		if _, exists := d.webhookStorage.GetWebhook(webhookId); !exists {
+			return nil
+		}
+		queue = &webhookQueue{ids: make(chan string, webhookQueueChannelSize), done: make(chan struct{})}
+		d.queues[webhookId] = queue
+		go d.work(queue)
+	}
+	return queue
+}
+
+func (d *WebhookDispatcher) dispatch(webhookId string, id string) {
+	queue := d.getQueue(webhookId)
+	if queue == nil {
+		return
+	}
+	select {
+	case queue.ids <- id:
+	default:
+		go func() {
+			select {
+			case queue.ids <- id:
+			case <-queue.done:
+			}
+		}()
+	}
+}
+
+func (d *WebhookDispatcher) dispatchAfter(webhookId string, id string, delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		d.dispatch(webhookId, id)
+	})
+}
+
+func (d *WebhookDispatcher) work(queue *webhookQueue) {
+	for {
+		select {
+		case id := <-queue.ids:
+			d.process(id)
+		case <-queue.done:
+			return
+		}
+	}
+}
+
+func generateWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// signWebhookPayload signs the timestamp together with the payload, i.e. "<timestamp>.<payload>".
+func signWebhookPayload(secret string, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// post delivers the envelope to the webhook and returns the status code of the response (0 if there is none).
+func (d *WebhookDispatcher) post(webhook *utils.Webhook, delivery *utils.WebhookDelivery) (int, error) {
+	payload := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, webhook.Url, strings.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, signWebhookPayload(webhook.Secret, timestamp, payload))
+	req.Header.Set(webhookIdHeader, webhook.ID)
+	req.Header.Set(webhookDeliveryIdHeader, delivery.ID)
+	req.Header.Set(webhookAttemptHeader, strconv.Itoa(delivery.Attempts))
+	req.Header.Set(webhookMessageTypeHeader, delivery.MessageType)
+
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// read (a bit of) the body, so that the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func (d *WebhookDispatcher) process(id string) {
+	delivery, ok := d.webhookStorage.GetDelivery(id)
+	if !ok || delivery.Status == utils.WebhookDeliveryDead {
+		// the webhook was deleted in the meantime
+		return
+	}
+
+	webhook, ok := d.webhookStorage.GetWebhook(delivery.WebhookID)
+	if !ok {
+		d.webhookStorage.DeleteDelivery(id)
+		return
+	}
+
+	delivery.Attempts += 1
+	statusCode, err := d.post(webhook, delivery)
+	if err == nil {
+		err = d.webhookStorage.DeleteDelivery(id)
+		if err != nil {
+			log.Error("Couldn't delete webhook delivery ", id, ": ", err.Error())
+		}
+		return
+	}
+
+	delivery.LastError = err.Error()
+	delivery.LastStatusCode = statusCode
+	if delivery.Attempts >= d.maxAttempts {
+		log.Warn("Giving up on webhook delivery ", id, " to ", webhook.Url, " after ", delivery.Attempts, " attempt(s): ", err.Error())
+		delivery.Status = utils.WebhookDeliveryDead
+		err = d.webhookStorage.SaveDelivery(delivery)
+		if err != nil {
+			log.Error("Couldn't update webhook delivery ", id, ": ", err.Error())
+		}
+		return
+	}
+
+	delay := retryDelay(d.retryBaseDelay, d.retryMaxDelay, delivery.Attempts)
+	log.Debug("Webhook delivery ", id, " to ", webhook.Url, " failed (attempt ", delivery.Attempts, "), retrying in ", delay, ": ", err.Error())
+	delivery.Status = utils.WebhookDeliveryRetrying
+	delivery.NextAttemptAt = time.Now().Add(delay)
+	err = d.webhookStorage.SaveDelivery(delivery)
+	if err != nil {
+		log.Error("Couldn't update webhook delivery ", id, ": ", err.Error())
+		return
+	}
+	d.dispatchAfter(delivery.WebhookID, delivery.ID, delay)
+}
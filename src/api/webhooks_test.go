@@ -0,0 +1,220 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	utils "github.com/sheophe/signal-cli-rest-api/utils"
+)
+
+func newTestWebhookDispatcher(t *testing.T, url string, messageTypes string) (*WebhookDispatcher, *utils.Webhook) {
+	dir, err := ioutil.TempDir("", "webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	webhookStorage, err := utils.NewWebhookStorage(filepath.Join(dir, "webhooks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { webhookStorage.Close() })
+
+	webhook := utils.Webhook{ID: "webhook-1", Sub: "sub", Number: "+491111", Url: url, Secret: "secret", MessageTypes: messageTypes}
+	err = webhookStorage.CreateWebhook(&webhook)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewWebhookDispatcher(webhookStorage, time.Second, 2, time.Millisecond, time.Millisecond, true)
+	return d, &webhook
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSignWebhookPayload(t *testing.T) {
+	payload := []byte(`{"envelope":{"timestamp":1}}`)
+	// HMAC-SHA256 of `1700000000.{"envelope":{"timestamp":1}}` with the key "secret"
+	expected := "sha256=288ed374006e69a2d80f6f48f075fa96aa3de468e258ff90de603dcbbbdcd7bd"
+	if signature := signWebhookPayload("secret", "1700000000", payload); signature != expected {
+		t.Errorf("expected %s, got %s", expected, signature)
+	}
+	if signWebhookPayload("secret", "1700000001", payload) == expected {
+		t.Error("expected the timestamp to be part of the signature")
+	}
+}
+
+func TestWebhookDispatcherDelivers(t *testing.T) {
+	payload := `{"envelope":{"timestamp":1}}`
+	received := make(chan *http.Request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != payload {
+			t.Errorf("expected payload %s, got %s", payload, body)
+		}
+		received <- r
+	}))
+	defer server.Close()
+
+	d, webhook := newTestWebhookDispatcher(t, server.URL, utils.MessageTypeMessage+","+utils.MessageTypeReaction)
+	d.Dispatch("+491111", utils.MessageTypeTyping, []byte(payload))
+	d.Dispatch("+491111", utils.MessageTypeMessage, []byte(payload))
+
+	select {
+	case r := <-received:
+		timestamp, err := strconv.ParseInt(r.Header.Get(webhookTimestampHeader), 10, 64)
+		if err != nil || time.Since(time.Unix(timestamp, 0)) > time.Minute {
+			t.Errorf("expected the current time in the timestamp header, got %s", r.Header.Get(webhookTimestampHeader))
+		}
+		if r.Header.Get(webhookSignatureHeader) != signWebhookPayload("secret", r.Header.Get(webhookTimestampHeader), []byte(payload)) {
+			t.Errorf("unexpected signature %s", r.Header.Get(webhookSignatureHeader))
+		}
+		if r.Header.Get(webhookMessageTypeHeader) != utils.MessageTypeMessage {
+			t.Errorf("expected message type %s, got %s", utils.MessageTypeMessage, r.Header.Get(webhookMessageTypeHeader))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook wasn't called")
+	}
+
+	waitFor(t, func() bool {
+		deliveries, _ := d.webhookStorage.GetUnfinishedDeliveries()
+		return len(deliveries) == 0
+	})
+	select {
+	case <-received:
+		t.Error("expected the typing message to be filtered")
+	default:
+	}
+
+	deadLetters, _ := d.webhookStorage.GetDeadDeliveries(webhook.ID)
+	if len(deadLetters) != 0 {
+		t.Errorf("expected no dead letters, got %d", len(deadLetters))
+	}
+}
+
+func TestWebhookDispatcherDeadLetter(t *testing.T) {
+	var healthy int32
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	d, webhook := newTestWebhookDispatcher(t, server.URL, "")
+	d.Dispatch("+491111", utils.MessageTypeMessage, []byte(`{}`))
+
+	var deadLetters []utils.WebhookDelivery
+	waitFor(t, func() bool {
+		deadLetters, _ = d.webhookStorage.GetDeadDeliveries(webhook.ID)
+		return len(deadLetters) == 1
+	})
+	if deadLetters[0].Attempts != 2 || deadLetters[0].LastStatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected 2 attempts with status 503, got %+v", deadLetters[0])
+	}
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Errorf("expected 2 calls, got %d", atomic.LoadInt32(&calls))
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+	err := d.Replay(&deadLetters[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		_, ok := d.webhookStorage.GetDelivery(deadLetters[0].ID)
+		return !ok
+	})
+}
+
+func TestWebhookDispatcherBlocksPrivateNetworks(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer server.Close()
+
+	d, webhook := newTestWebhookDispatcher(t, server.URL, "")
+	d = NewWebhookDispatcher(d.webhookStorage, time.Second, 1, time.Millisecond, time.Millisecond, false)
+	d.Dispatch("+491111", utils.MessageTypeMessage, []byte(`{}`))
+
+	var deadLetters []utils.WebhookDelivery
+	waitFor(t, func() bool {
+		deadLetters, _ = d.webhookStorage.GetDeadDeliveries(webhook.ID)
+		return len(deadLetters) == 1
+	})
+	if !strings.Contains(deadLetters[0].LastError, "not allowed") {
+		t.Errorf("expected the address to be blocked, got %s", deadLetters[0].LastError)
+	}
+	if atomic.LoadInt32(&calls) != 0 {
+		t.Errorf("expected no calls, got %d", atomic.LoadInt32(&calls))
+	}
+}
+
+func TestWebhookDispatcherDoesntFollowRedirects(t *testing.T) {
+	var redirected int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/target" {
+			atomic.AddInt32(&redirected, 1)
+			return
+		}
+		http.Redirect(w, r, "/target", http.StatusTemporaryRedirect)
+	}))
+	defer server.Close()
+
+	d, webhook := newTestWebhookDispatcher(t, server.URL, "")
+	d.Dispatch("+491111", utils.MessageTypeMessage, []byte(`{}`))
+
+	var deadLetters []utils.WebhookDelivery
+	waitFor(t, func() bool {
+		deadLetters, _ = d.webhookStorage.GetDeadDeliveries(webhook.ID)
+		return len(deadLetters) == 1
+	})
+	if deadLetters[0].LastStatusCode != http.StatusTemporaryRedirect || atomic.LoadInt32(&redirected) != 0 {
+		t.Errorf("expected the redirect not to be followed, got %+v", deadLetters[0])
+	}
+}
+
+func TestWebhookDispatcherDeleteWebhook(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	d, webhook := newTestWebhookDispatcher(t, server.URL, "")
+	d.Dispatch("+491111", utils.MessageTypeMessage, []byte(`{}`))
+	waitFor(t, func() bool {
+		deliveries, _ := d.webhookStorage.GetUnfinishedDeliveries()
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		return len(deliveries) == 0 && d.queues[webhook.ID] != nil
+	})
+
+	err := d.DeleteWebhook(webhook.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.dispatch(webhook.ID, "delivery-of-deleted-webhook")
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if len(d.queues) != 0 {
+		t.Errorf("expected the queue of the deleted webhook to be removed, got %d queue(s)", len(d.queues))
+	}
+}
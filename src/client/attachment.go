@@ -3,7 +3,9 @@ package client
 import (
 	"encoding/base64"
 	"errors"
+	"io"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 
@@ -115,6 +117,70 @@ func (attachmentEntry *AttachmentEntry) storeBase64AsTemporaryFile() error {
 	return nil
 }
 
+// storeReaderAsTemporaryFile streams the data from the reader into the attachment tmp directory without
+// keeping it in memory. At most maxSize bytes are accepted (a maxSize <= 0 disables the check).
+func (attachmentEntry *AttachmentEntry) storeReaderAsTemporaryFile(reader io.Reader, maxSize int64) error {
+	attachmentEntry.FileName = filepath.Base(attachmentEntry.FileName)
+	if attachmentEntry.FileName == "." || attachmentEntry.FileName == string(os.PathSeparator) {
+		attachmentEntry.FileName = ""
+	}
+
+	// if no custom filename
+	if strings.Compare(attachmentEntry.FileName, "") == 0 {
+		fileNameUuid, err := uuid.NewV4()
+		if err != nil {
+			return err
+		}
+		attachmentEntry.FileName = fileNameUuid.String()
+		if attachmentEntry.MimeInfo != "" {
+			if mimeType := mimetype.Lookup(attachmentEntry.MimeInfo); mimeType != nil {
+				attachmentEntry.FileName += mimeType.Extension()
+			}
+		}
+	}
+
+	dirNameUuid, err := uuid.NewV4()
+	if err != nil {
+		return err
+	}
+
+	attachmentEntry.DirName = dirNameUuid.String()
+	dirPath := attachmentEntry.attachmentTmpDir + attachmentEntry.DirName
+	if err := os.Mkdir(dirPath, os.ModePerm); err != nil {
+		return err
+	}
+
+	attachmentEntry.FilePath = dirPath + string(os.PathSeparator) + attachmentEntry.FileName
+
+	f, err := os.Create(attachmentEntry.FilePath)
+	if err != nil {
+		attachmentEntry.cleanUp()
+		return err
+	}
+	defer f.Close()
+
+	if maxSize > 0 {
+		reader = io.LimitReader(reader, maxSize+1)
+	}
+
+	written, err := io.Copy(f, reader)
+	if err != nil {
+		attachmentEntry.cleanUp()
+		return err
+	}
+	if maxSize > 0 && written > maxSize {
+		attachmentEntry.cleanUp()
+		return &AttachmentTooLargeError{Description: "Attachment " + attachmentEntry.FileName + " exceeds the maximum size"}
+	}
+	if err := f.Sync(); err != nil {
+		attachmentEntry.cleanUp()
+		return err
+	}
+	f.Close()
+
+	return nil
+}
+
 func (attachmentEntry *AttachmentEntry) cleanUp() {
 	if strings.Compare(attachmentEntry.FilePath, "") != 0 {
 		os.Remove(attachmentEntry.FilePath)
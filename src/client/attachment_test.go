@@ -2,6 +2,7 @@ package client
 
 import (
 	"flag"
+	"io/ioutil"
 	"os"
 	"strings"
 	"testing"
@@ -105,3 +106,55 @@ func Test_Attachment_ExtractMetadata_ShouldPrepareDataFor_toDataForSignal(t *tes
 		})
 	}
 }
+
+func Test_Attachment_storeReaderAsTemporaryFile(t *testing.T) {
+	testCases := []struct {
+		nameTest         string
+		fileName         string
+		mimeInfo         string
+		data             string
+		maxSize          int64
+		fileNameExpected string
+		tooLarge         bool
+	}{
+		{"filename kept", "image.jpg", "image/jpeg", "12345", 10, "image.jpg", false},
+		{"path stripped from filename", "../../etc/passwd", "", "12345", 10, "passwd", false},
+		{"exact max size", "file.txt", "", "12345", 5, "file.txt", false},
+		{"exceeds max size", "file.txt", "", "123456", 5, "", true},
+		{"no max size", "file.txt", "", "123456", 0, "file.txt", false},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.nameTest, func(t *testing.T) {
+			attachmentEntry := NewAttachmentEntry("", os.TempDir()+string(os.PathSeparator))
+			attachmentEntry.FileName = tt.fileName
+			attachmentEntry.MimeInfo = tt.mimeInfo
+
+			err := attachmentEntry.storeReaderAsTemporaryFile(strings.NewReader(tt.data), tt.maxSize)
+			defer attachmentEntry.cleanUp()
+
+			if tt.tooLarge {
+				if _, ok := err.(*AttachmentTooLargeError); !ok {
+					t.Fatalf("storeReaderAsTemporaryFile() got error \"%v\", want AttachmentTooLargeError", err)
+				}
+				if _, err := os.Stat(attachmentEntry.FilePath); !os.IsNotExist(err) {
+					t.Errorf("file \"%v\" wasn't removed", attachmentEntry.FilePath)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("storeReaderAsTemporaryFile() got error \"%v\"", err)
+			}
+
+			if attachmentEntry.FileName != tt.fileNameExpected {
+				t.Errorf("FileName got \"%v\", want \"%v\"", attachmentEntry.FileName, tt.fileNameExpected)
+			}
+
+			content, err := ioutil.ReadFile(attachmentEntry.toDataForSignal())
+			if err != nil || string(content) != tt.data {
+				t.Errorf("file content got \"%v\", want \"%v\"", string(content), tt.data)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+	log "github.com/sirupsen/logrus"
+
+	utils "github.com/sheophe/signal-cli-rest-api/utils"
+)
+
+// number of bytes that are read upfront to detect the mime type of a fetched attachment
+const attachmentUrlSniffSize = 3072
+
+var privateNetworks = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+	// 6to4, which can embed private IPv4 addresses
+	"2002::/16",
+}
+
+var blockedNets = parseNetworks(privateNetworks)
+
+func parseNetworks(networks []string) []*net.IPNet {
+	ipNets := []*net.IPNet{}
+	for _, network := range networks {
+		_, ipNet, _ := net.ParseCIDR(network)
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets
+}
+
+func isBlockedIp(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, blockedNet := range blockedNets {
+		if blockedNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewPublicDialer creates a dialer that refuses to connect to private, loopback, link-local and other
+// internal addresses. The check is done on the resolved address, so that neither DNS tricks nor
+// redirects can be used to reach internal services with user provided urls.
+func NewPublicDialer(timeout time.Duration) *net.Dialer {
+	return newFilteringDialer(timeout, isBlockedIp)
+}
+
+func newFilteringDialer(timeout time.Duration, isBlocked func(ip net.IP) bool) *net.Dialer {
+	return &net.Dialer{
+		Timeout: timeout,
+		Control: func(network string, address string, conn syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || isBlocked(ip) {
+				return errors.New("Access to address " + host + " is not allowed")
+			}
+			return nil
+		},
+	}
+}
+
+type attachmentUrlFetcher struct {
+	client         *http.Client
+	maxSize        int64
+	allowedHosts   []string
+	allowedSchemes []string
+	isBlocked      func(ip net.IP) bool
+}
+
+func getListEnv(key string, defaultVal string) []string {
+	l := []string{}
+	for _, entry := range strings.Split(utils.GetEnv(key, defaultVal), ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry != "" {
+			l = append(l, entry)
+		}
+	}
+	return l
+}
+
+func newAttachmentUrlFetcher() *attachmentUrlFetcher {
+	timeout, err := utils.GetIntEnv("ATTACHMENT_URL_TIMEOUT", 10)
+	if err != nil || timeout < 1 {
+		log.Error("Env variable 'ATTACHMENT_URL_TIMEOUT' contains an invalid value...falling back to default (10)")
+		timeout = 10
+	}
+
+	maxSize, err := utils.GetIntEnv("ATTACHMENT_URL_MAX_SIZE", 25*1024*1024)
+	if err != nil || maxSize < 1 {
+		log.Error("Env variable 'ATTACHMENT_URL_MAX_SIZE' contains an invalid value...falling back to default (26214400)")
+		maxSize = 25 * 1024 * 1024
+	}
+
+	f := &attachmentUrlFetcher{
+		maxSize:        int64(maxSize),
+		allowedHosts:   getListEnv("ATTACHMENT_URL_ALLOWED_HOSTS", ""),
+		allowedSchemes: getListEnv("ATTACHMENT_URL_ALLOWED_SCHEMES", "https,http"),
+		isBlocked:      isBlockedIp,
+	}
+
+	dialer := newFilteringDialer(time.Duration(timeout)*time.Second, func(ip net.IP) bool { return f.isBlocked(ip) })
+
+	f.client = &http.Client{
+		Timeout: time.Duration(timeout) * time.Second,
+		Transport: &http.Transport{
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   time.Duration(timeout) * time.Second,
+			ResponseHeaderTimeout: time.Duration(timeout) * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("Too many redirects")
+			}
+			return f.checkUrl(req.URL)
+		},
+	}
+	return f
+}
+
+func (f *attachmentUrlFetcher) checkUrl(u *url.URL) error {
+	if !utils.StringInSlice(strings.ToLower(u.Scheme), f.allowedSchemes) {
+		return errors.New("Scheme '" + u.Scheme + "' is not allowed for attachment urls")
+	}
+
+	if len(f.allowedHosts) > 0 && !utils.StringInSlice(strings.ToLower(u.Hostname()), f.allowedHosts) {
+		return errors.New("Host '" + u.Hostname() + "' is not allowed for attachment urls")
+	}
+	return nil
+}
+
+// fetch downloads the url into the attachment tmp directory. The mime type is detected from the
+// content, the file name is taken from the url path (if there is one).
+func (f *attachmentUrlFetcher) fetch(rawUrl string, attachmentTmpDir string) (*AttachmentEntry, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Host == "" {
+		return nil, errors.New("Invalid attachment url " + rawUrl)
+	}
+
+	err = f.checkUrl(u)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, errors.New("Couldn't fetch attachment url " + rawUrl + ": " + err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Couldn't fetch attachment url " + rawUrl + ": status code " + strconv.Itoa(resp.StatusCode))
+	}
+
+	if resp.ContentLength > f.maxSize {
+		return nil, &AttachmentTooLargeError{Description: "Attachment url " + rawUrl + " exceeds the maximum size"}
+	}
+
+	head := make([]byte, attachmentUrlSniffSize)
+	n, err := io.ReadFull(resp.Body, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, errors.New("Couldn't fetch attachment url " + rawUrl + ": " + err.Error())
+	}
+	head = head[:n]
+	mimeType := mimetype.Detect(head)
+
+	attachmentEntry := NewAttachmentEntry("", attachmentTmpDir)
+	attachmentEntry.MimeInfo = mimeType.String()
+	fileName := path.Base(u.Path)
+	if fileName != "." && fileName != "/" {
+		if path.Ext(fileName) == "" {
+			fileName += mimeType.Extension()
+		}
+		attachmentEntry.FileName = fileName
+	}
+
+	err = attachmentEntry.storeReaderAsTemporaryFile(io.MultiReader(bytes.NewReader(head), resp.Body), f.maxSize)
+	if err != nil {
+		if _, ok := err.(*AttachmentTooLargeError); ok {
+			return nil, &AttachmentTooLargeError{Description: "Attachment url " + rawUrl + " exceeds the maximum size"}
+		}
+		return nil, errors.New("Couldn't fetch attachment url " + rawUrl + ": " + err.Error())
+	}
+
+	return attachmentEntry, nil
+}
+
+// fetchAttachmentUrls downloads all urls. In case one of them can't be fetched, the already
+// downloaded ones are removed again.
+func (s *SignalClient) fetchAttachmentUrls(urls []string) ([]AttachmentEntry, error) {
+	attachmentEntries := []AttachmentEntry{}
+	if len(urls) == 0 {
+		return attachmentEntries, nil
+	}
+
+	fetcher := newAttachmentUrlFetcher()
+	for _, u := range urls {
+		attachmentEntry, err := fetcher.fetch(u, s.attachmentTmpDir)
+		if err != nil {
+			cleanupAttachmentEntries(attachmentEntries)
+			return nil, err
+		}
+		attachmentEntries = append(attachmentEntries, *attachmentEntry)
+	}
+	return attachmentEntries, nil
+}
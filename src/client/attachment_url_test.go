@@ -0,0 +1,168 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestIsBlockedIp(t *testing.T) {
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"0.0.0.0", true},
+		{"::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:10.0.0.1", true},
+		{"::ffff:169.254.169.254", true},
+		{"fd00::1", true},
+		{"fc00::1", true},
+		{"fe80::1", true},
+		{"2002:a00:1::1", true},
+		{"64:ff9b::a00:1", true},
+		{"8.8.8.8", false},
+		{"::ffff:8.8.8.8", false},
+		{"2001:4860:4860::8888", false},
+	}
+	for _, test := range tests {
+		if blocked := isBlockedIp(net.ParseIP(test.ip)); blocked != test.blocked {
+			t.Errorf("expected isBlockedIp(%s) to be %v", test.ip, test.blocked)
+		}
+	}
+}
+
+func TestAttachmentUrlFetcherCheckUrl(t *testing.T) {
+	f := newAttachmentUrlFetcher()
+	tests := []struct {
+		url     string
+		allowed bool
+	}{
+		{"https://example.com/image.png", true},
+		{"http://example.com/image.png", true},
+		{"HTTPS://example.com/image.png", true},
+		{"ftp://example.com/image.png", false},
+		{"file:///etc/passwd", false},
+		{"gopher://example.com/", false},
+	}
+	for _, test := range tests {
+		u, _ := url.Parse(test.url)
+		if err := f.checkUrl(u); (err == nil) != test.allowed {
+			t.Errorf("expected checkUrl(%s) to allow it: %v, got %v", test.url, test.allowed, err)
+		}
+	}
+
+	f.allowedHosts = []string{"example.com"}
+	u, _ := url.Parse("https://other.example.org/image.png")
+	if err := f.checkUrl(u); err == nil {
+		t.Error("expected a host that isn't allowed to be rejected")
+	}
+}
+
+// newTestAttachmentUrlFetcher creates a fetcher that may connect to the test server, but to no other internal address.
+func newTestAttachmentUrlFetcher(server *httptest.Server) *attachmentUrlFetcher {
+	serverUrl, _ := url.Parse(server.URL)
+	serverIp := net.ParseIP(serverUrl.Hostname())
+	f := newAttachmentUrlFetcher()
+	f.isBlocked = func(ip net.IP) bool {
+		return !ip.Equal(serverIp) && isBlockedIp(ip)
+	}
+	return f
+}
+
+func TestAttachmentUrlFetcherBlocksInternalAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secret"))
+	}))
+	defer server.Close()
+	port := server.URL[strings.LastIndex(server.URL, ":")+1:]
+
+	f := newAttachmentUrlFetcher()
+	urls := []string{
+		server.URL + "/image.png",
+		"http://localhost:" + port + "/image.png",
+		"http://[::ffff:127.0.0.1]:" + port + "/image.png",
+		"http://10.0.0.1/image.png",
+		"http://192.168.0.1/image.png",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://[fd00::1]/image.png",
+	}
+	for _, u := range urls {
+		_, err := f.fetch(u, t.TempDir())
+		if err == nil || !strings.Contains(err.Error(), "is not allowed") {
+			t.Errorf("expected %s to be blocked, got %v", u, err)
+		}
+	}
+}
+
+func TestAttachmentUrlFetcherRedirects(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/private":
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+		case "/file":
+			http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+		case "/public":
+			http.Redirect(w, r, "/image.png", http.StatusFound)
+		default:
+			w.Write([]byte("image"))
+		}
+	}))
+	defer server.Close()
+
+	f := newTestAttachmentUrlFetcher(server)
+	for _, path := range []string{"/private", "/file"} {
+		_, err := f.fetch(server.URL+path, t.TempDir())
+		if err == nil || !strings.Contains(err.Error(), "not allowed") {
+			t.Errorf("expected the redirect of %s to be blocked, got %v", path, err)
+		}
+	}
+
+	attachmentEntry, err := f.fetch(server.URL+"/public", t.TempDir())
+	if err != nil {
+		t.Fatalf("expected the redirect to be followed, got %v", err)
+	}
+	attachmentEntry.cleanUp()
+}
+
+func TestAttachmentUrlFetcherMaxSize(t *testing.T) {
+	body := strings.Repeat("a", 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked" {
+			// without Content-Length, the size is only known while reading
+			w.Write([]byte(body[:50]))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(body[50:]))
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	f := newTestAttachmentUrlFetcher(server)
+	f.maxSize = 10
+	for _, path := range []string{"/", "/chunked"} {
+		_, err := f.fetch(server.URL+path, t.TempDir())
+		var attachmentTooLargeError *AttachmentTooLargeError
+		if !errors.As(err, &attachmentTooLargeError) {
+			t.Errorf("expected %s to exceed the maximum size, got %v", path, err)
+		}
+	}
+
+	f.maxSize = 100
+	attachmentEntry, err := f.fetch(server.URL+"/", t.TempDir())
+	if err != nil {
+		t.Fatalf("expected a body of the maximum size to be fetched, got %v", err)
+	}
+	attachmentEntry.cleanUp()
+}
@@ -103,13 +103,22 @@ func (s *CliClient) Execute(wait bool, args []string, stdin string) (string, err
 			if err != nil {
 				return "", err
 			}
-			return "", errors.New("process killed as timeout reached")
+			return "", &TimeoutError{Description: "process killed as timeout reached"}
 		case err := <-done:
 			if err != nil {
 				combinedOutput := stdoutBuffer.String() + stderrBuffer.String()
 				log.Debug("signal-cli output (stdout): ", stdoutBuffer.String())
 				log.Debug("signal-cli output (stderr): ", stderrBuffer.String())
-				return "", errors.New(combinedOutput)
+				exitCode := 0
+				var exitError *exec.ExitError
+				if errors.As(err, &exitError) {
+					exitCode = exitError.ExitCode()
+				}
+				if exitCode == -1 {
+					// killed by a signal
+					return "", &SignalCliCrashError{Description: "signal-cli was terminated unexpectedly: " + err.Error()}
+				}
+				return "", parseSignalCliError(combinedOutput, exitCode)
 			}
 		}
 
@@ -6,11 +6,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -183,6 +186,38 @@ type SignalCliGroupEntry struct {
 	Admins            []SignalCliGroupAdmin  `json:"admins"`
 }
 
+type StickerEntry struct {
+	Id          int    `json:"id"`
+	Emoji       string `json:"emoji"`
+	ContentType string `json:"content_type"`
+}
+
+type StickerPackEntry struct {
+	PackId    string         `json:"pack_id"`
+	Url       string         `json:"url"`
+	Installed bool           `json:"installed"`
+	Title     string         `json:"title"`
+	Author    string         `json:"author"`
+	Cover     *StickerEntry  `json:"cover,omitempty"`
+	Stickers  []StickerEntry `json:"stickers"`
+}
+
+type SignalCliStickerEntry struct {
+	Id          int    `json:"id"`
+	Emoji       string `json:"emoji"`
+	ContentType string `json:"contentType"`
+}
+
+type SignalCliStickerPackEntry struct {
+	PackId    string                  `json:"packId"`
+	Url       string                  `json:"url"`
+	Installed bool                    `json:"installed"`
+	Title     string                  `json:"title"`
+	Author    string                  `json:"author"`
+	Cover     *SignalCliStickerEntry  `json:"cover"`
+	Stickers  []SignalCliStickerEntry `json:"stickers"`
+}
+
 type SignalCliIdentityEntry struct {
 	Number                string `json:"number"`
 	Uuid                  string `json:"uuid"`
@@ -213,8 +248,11 @@ type SendResults struct {
 }
 
 type SendResponse struct {
-	Timestamp int64         `json:"timestamp"`
-	Results   []SendResults `json:"results"`
+	Recipient           string              `json:"recipient,omitempty"`
+	Timestamp           int64               `json:"timestamp"`
+	Results             []SendResults       `json:"results"`
+	Error               string              `json:"error,omitempty"`
+	UntrustedIdentities []UntrustedIdentity `json:"untrusted_identities,omitempty"`
 }
 
 type About struct {
@@ -246,6 +284,24 @@ func cleanupAttachmentEntries(attachmentEntries []AttachmentEntry) {
 	}
 }
 
+// StoreAttachment streams an uploaded file into the attachment tmp directory. The returned
+// attachment needs to be removed with CleanupAttachments once it isn't needed anymore.
+func (s *SignalClient) StoreAttachment(reader io.Reader, fileName string, mimeType string, maxSize int64) (*AttachmentEntry, error) {
+	attachmentEntry := NewAttachmentEntry("", s.attachmentTmpDir)
+	attachmentEntry.FileName = fileName
+	attachmentEntry.MimeInfo = mimeType
+
+	err := attachmentEntry.storeReaderAsTemporaryFile(reader, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	return attachmentEntry, nil
+}
+
+func (s *SignalClient) CleanupAttachments(attachmentEntries []AttachmentEntry) {
+	cleanupAttachmentEntries(attachmentEntries)
+}
+
 func convertInternalGroupIdToGroupId(internalId string) string {
 	return groupPrefix + base64.StdEncoding.EncodeToString([]byte(internalId))
 }
@@ -340,11 +396,22 @@ type SignalClient struct {
 	signalCliApiConfig       *utils.SignalCliApiConfig
 	cliClient                *CliClient
 	subStorage               *utils.SubStorage
+	messageStorage           *utils.MessageStorage
+	messageStoreQueue        chan *utils.StoredMessage
+	receiveListeners         []ReceiveListener
+	receiveListenersMutex    sync.RWMutex
+	sendMaxParallelism       int
 }
 
 func NewSignalClient(signalCliConfig string, attachmentTmpDir string, avatarTmpDir string, signalCliMode SignalCliMode,
-	jsonRpc2ClientConfigPath string, signalCliApiConfigPath string, subStorage *utils.SubStorage) *SignalClient {
-	return &SignalClient{
+	jsonRpc2ClientConfigPath string, signalCliApiConfigPath string, subStorage *utils.SubStorage, messageStorage *utils.MessageStorage) *SignalClient {
+	sendMaxParallelism, err := utils.GetIntEnv("SEND_MAX_PARALLELISM", 4)
+	if err != nil || sendMaxParallelism < 1 {
+		log.Error("Env variable 'SEND_MAX_PARALLELISM' contains an invalid value...falling back to default (4)")
+		sendMaxParallelism = 4
+	}
+
+	s := &SignalClient{
 		signalCliConfig:          signalCliConfig,
 		attachmentTmpDir:         attachmentTmpDir,
 		avatarTmpDir:             avatarTmpDir,
@@ -353,7 +420,14 @@ func NewSignalClient(signalCliConfig string, attachmentTmpDir string, avatarTmpD
 		jsonRpc2Clients:          make(map[string]*JsonRpc2Client),
 		signalCliApiConfigPath:   signalCliApiConfigPath,
 		subStorage:               subStorage,
+		messageStorage:           messageStorage,
+		sendMaxParallelism:       sendMaxParallelism,
 	}
+	if messageStorage != nil {
+		s.messageStoreQueue = make(chan *utils.StoredMessage, messageStoreQueueSize)
+		go s.storeMessages()
+	}
+	return s
 }
 
 func (s *SignalClient) GetSignalCliMode() SignalCliMode {
@@ -375,7 +449,7 @@ func (s *SignalClient) Init() error {
 		}
 
 		s.jsonRpc2Clients = make(map[string]*JsonRpc2Client)
-		s.jsonRpc2Clients[utils.LinkNumber] = NewJsonRpc2Client(s.signalCliApiConfig, utils.LinkNumber, utils.LinkTcpPort, "")
+		s.jsonRpc2Clients[utils.LinkNumber] = NewJsonRpc2Client(s.signalCliApiConfig, utils.LinkNumber, utils.LinkTcpPort, "", s.handleReceivedEnvelope)
 		s.jsonRpc2Clients[utils.LinkNumber].Start()
 
 		tcpPortsNumberMapping := s.jsonRpc2ClientConfig.GetTcpPortsForNumbers()
@@ -384,7 +458,7 @@ func (s *SignalClient) Init() error {
 				continue
 			}
 			if sub, ok := s.subStorage.GetSubByNumber(number); ok {
-				s.jsonRpc2Clients[number] = NewJsonRpc2Client(s.signalCliApiConfig, number, tcpPort, sub)
+				s.jsonRpc2Clients[number] = NewJsonRpc2Client(s.signalCliApiConfig, number, tcpPort, sub, s.handleReceivedEnvelope)
 			}
 		}
 	} else {
@@ -398,9 +472,102 @@ func (s *MessageMention) toString() string {
 	return fmt.Sprintf("%d:%d:%s", s.Start, s.Length, s.Author)
 }
 
-func (s *SignalClient) send(number string, message string,
-	recipients []string, base64Attachments []string, isGroup bool, sticker string, mentions []MessageMention,
-	quoteTimestamp *int64, quoteAuthor *string, quoteMessage *string, quoteMentions []MessageMention, textMode *string) (*SendResponse, error) {
+// MessageMentions is either a list of mentions or "auto". In the latter case, the mentions are
+// generated from @{number} or @{uuid} placeholders in the message.
+type MessageMentions struct {
+	Auto     bool
+	Mentions []MessageMention
+}
+
+func (m MessageMentions) MarshalJSON() ([]byte, error) {
+	if m.Auto {
+		return json.Marshal("auto")
+	}
+	return json.Marshal(m.Mentions)
+}
+
+func (m *MessageMentions) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	var mode string
+	if err := json.Unmarshal(data, &mode); err == nil {
+		if mode != "auto" {
+			return errors.New("mentions need to be either a list of mentions or 'auto'")
+		}
+		m.Auto = true
+		m.Mentions = nil
+		return nil
+	}
+
+	m.Auto = false
+	return json.Unmarshal(data, &m.Mentions)
+}
+
+func (c *ContactEntry) displayName() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	if c.Profile != nil {
+		if name := strings.TrimSpace(c.Profile.GivenName + " " + c.Profile.FamilyName); name != "" {
+			return name
+		}
+	}
+	return c.Username
+}
+
+// mentionDisplayNameResolver returns a function that looks up the display name of a mentioned number or uuid.
+// The contacts are only loaded when needed (and only once, the function can be used concurrently); if there
+// is no display name, the number/uuid itself is used. In normal and native mode, the contacts aren't looked
+// up (as that would need another signal-cli invocation), so the number/uuid is used as display name.
+func (s *SignalClient) mentionDisplayNameResolver(number string) func(author string) string {
+	var displayNames map[string]string
+	var once sync.Once
+	return func(author string) string {
+		once.Do(func() {
+			displayNames = make(map[string]string)
+			if s.signalCliMode == JsonRpc {
+				contacts, err := s.GetContacts(number)
+				if err != nil {
+					log.Warn("Couldn't load contacts to resolve mentions: ", err.Error())
+				}
+				for _, contact := range contacts {
+					name := contact.displayName()
+					if name == "" {
+						continue
+					}
+					if contact.Number != "" {
+						displayNames[contact.Number] = name
+					}
+					if contact.UUID != "" {
+						displayNames[contact.UUID] = name
+					}
+				}
+			}
+		})
+
+		if name, ok := displayNames[author]; ok {
+			return name
+		}
+		return author
+	}
+}
+
+func toMessageMentions(mentions []utils.Mention) []MessageMention {
+	messageMentions := []MessageMention{}
+	for _, mention := range mentions {
+		messageMentions = append(messageMentions, MessageMention{Start: int64(mention.Start), Length: int64(mention.Length), Author: mention.Author})
+	}
+	return messageMentions
+}
+
+// sendOnce sends the message without handling untrusted identities (see send). displayName resolves the
+// names of mentions; if it is nil, the contacts are loaded when needed.
+func (s *SignalClient) sendOnce(number string, message string,
+	recipients []string, base64Attachments []string, attachments []AttachmentEntry, isGroup bool, sticker string, messageMentions MessageMentions,
+	quoteTimestamp *int64, quoteAuthor *string, quoteMessage *string, quoteMessageMentions MessageMentions, textMode *string,
+	editTimestamp *int64, linkPreview *linkPreviewEntry, displayName func(author string) string) (*SendResponse, error) {
 
 	var resp SendResponse
 
@@ -408,9 +575,31 @@ func (s *SignalClient) send(number string, message string,
 		return nil, errors.New("Please specify at least one recipient")
 	}
 
+	// in styled mode (or if requested explicitly), mention placeholders are resolved as well
+	styled := textMode != nil && *textMode == "styled"
+	if displayName == nil {
+		displayName = s.mentionDisplayNameResolver(number)
+	}
+	message, textStyles, autoMentions := utils.ParseMessage(message, styled, styled || messageMentions.Auto, displayName)
 	signalCliTextFormatStrings := []string{}
-	if textMode != nil && *textMode == "styled" {
-		message, signalCliTextFormatStrings = utils.ParseMarkdownMessage(message)
+	for _, textStyle := range textStyles {
+		signalCliTextFormatStrings = append(signalCliTextFormatStrings, textStyle.String())
+	}
+
+	var mentions []MessageMention
+	mentions = append(mentions, messageMentions.Mentions...)
+	if len(autoMentions) > 0 {
+		mentions = append(mentions, toMessageMentions(autoMentions)...)
+	}
+
+	var quoteMentions []MessageMention
+	quoteMentions = append(quoteMentions, quoteMessageMentions.Mentions...)
+	if quoteMessage != nil && (styled || quoteMessageMentions.Auto) {
+		resolvedQuoteMessage, _, autoQuoteMentions := utils.ParseMessage(*quoteMessage, false, true, displayName)
+		quoteMessage = &resolvedQuoteMessage
+		if len(autoQuoteMentions) > 0 {
+			quoteMentions = append(quoteMentions, toMessageMentions(autoQuoteMentions)...)
+		}
 	}
 
 	var groupId string = ""
@@ -439,6 +628,15 @@ func (s *SignalClient) send(number string, message string,
 		attachmentEntries = append(attachmentEntries, *attachmentEntry)
 	}
 
+	// already stored attachments are owned by the caller, so they are not cleaned up here
+	attachmentPaths := []string{}
+	for _, attachmentEntry := range attachmentEntries {
+		attachmentPaths = append(attachmentPaths, attachmentEntry.toDataForSignal())
+	}
+	for _, attachmentEntry := range attachments {
+		attachmentPaths = append(attachmentPaths, attachmentEntry.toDataForSignal())
+	}
+
 	if s.signalCliMode == JsonRpc {
 		jsonRpc2Client, err := s.getJsonRpc2Client(number)
 		if err != nil {
@@ -446,17 +644,22 @@ func (s *SignalClient) send(number string, message string,
 		}
 
 		type Request struct {
-			Recipients     []string `json:"recipient,omitempty"`
-			Message        string   `json:"message"`
-			GroupId        string   `json:"group-id,omitempty"`
-			Attachments    []string `json:"attachment,omitempty"`
-			Sticker        string   `json:"sticker,omitempty"`
-			Mentions       []string `json:"mentions,omitempty"`
-			QuoteTimestamp *int64   `json:"quote-timestamp,omitempty"`
-			QuoteAuthor    *string  `json:"quote-author,omitempty"`
-			QuoteMessage   *string  `json:"quote-message,omitempty"`
-			QuoteMentions  []string `json:"quote-mentions,omitempty"`
-			TextStyles     []string `json:"text-style,omitempty"`
+			Recipients         []string `json:"recipient,omitempty"`
+			Message            string   `json:"message"`
+			GroupId            string   `json:"group-id,omitempty"`
+			Attachments        []string `json:"attachment,omitempty"`
+			Sticker            string   `json:"sticker,omitempty"`
+			Mentions           []string `json:"mentions,omitempty"`
+			QuoteTimestamp     *int64   `json:"quote-timestamp,omitempty"`
+			QuoteAuthor        *string  `json:"quote-author,omitempty"`
+			QuoteMessage       *string  `json:"quote-message,omitempty"`
+			QuoteMentions      []string `json:"quote-mentions,omitempty"`
+			TextStyles         []string `json:"text-style,omitempty"`
+			EditTimestamp      *int64   `json:"edit-timestamp,omitempty"`
+			PreviewUrl         string   `json:"preview-url,omitempty"`
+			PreviewTitle       string   `json:"preview-title,omitempty"`
+			PreviewDescription string   `json:"preview-description,omitempty"`
+			PreviewImage       string   `json:"preview-image,omitempty"`
 		}
 
 		request := Request{Message: message}
@@ -465,8 +668,8 @@ func (s *SignalClient) send(number string, message string,
 		} else {
 			request.Recipients = recipients
 		}
-		for _, attachmentEntry := range attachmentEntries {
-			request.Attachments = append(request.Attachments, attachmentEntry.toDataForSignal())
+		if len(attachmentPaths) > 0 {
+			request.Attachments = attachmentPaths
 		}
 
 		request.Sticker = sticker
@@ -493,6 +696,15 @@ func (s *SignalClient) send(number string, message string,
 		if len(signalCliTextFormatStrings) > 0 {
 			request.TextStyles = signalCliTextFormatStrings
 		}
+		request.EditTimestamp = editTimestamp
+		if linkPreview != nil {
+			request.PreviewUrl = linkPreview.Url
+			request.PreviewTitle = linkPreview.Title
+			request.PreviewDescription = linkPreview.Description
+			if linkPreview.Image != nil {
+				request.PreviewImage = linkPreview.Image.toDataForSignal()
+			}
+		}
 
 		rawData, err := jsonRpc2Client.getRaw("send", request, nil)
 		if err != nil {
@@ -522,11 +734,9 @@ func (s *SignalClient) send(number string, message string,
 			cmd = append(cmd, signalCliTextFormatStrings...)
 		}
 
-		if len(attachmentEntries) > 0 {
+		if len(attachmentPaths) > 0 {
 			cmd = append(cmd, "-a")
-			for _, attachmentEntry := range attachmentEntries {
-				cmd = append(cmd, attachmentEntry.toDataForSignal())
-			}
+			cmd = append(cmd, attachmentPaths...)
 		}
 
 		for _, mention := range mentions {
@@ -559,6 +769,24 @@ func (s *SignalClient) send(number string, message string,
 			cmd = append(cmd, mention.toString())
 		}
 
+		if editTimestamp != nil {
+			cmd = append(cmd, "--edit-timestamp")
+			cmd = append(cmd, strconv.FormatInt(*editTimestamp, 10))
+		}
+
+		if linkPreview != nil {
+			cmd = append(cmd, []string{"--preview-url", linkPreview.Url}...)
+			if linkPreview.Title != "" {
+				cmd = append(cmd, []string{"--preview-title", linkPreview.Title}...)
+			}
+			if linkPreview.Description != "" {
+				cmd = append(cmd, []string{"--preview-description", linkPreview.Description}...)
+			}
+			if linkPreview.Image != nil {
+				cmd = append(cmd, []string{"--preview-image", linkPreview.Image.toDataForSignal()}...)
+			}
+		}
+
 		rawData, err := s.cliClient.Execute(true, cmd, message)
 		if err != nil {
 			cleanupAttachmentEntries(attachmentEntries)
@@ -570,7 +798,7 @@ func (s *SignalClient) send(number string, message string,
 		resp.Timestamp, err = strconv.ParseInt(strings.TrimSuffix(rawData, "\n"), 10, 64)
 		if err != nil {
 			cleanupAttachmentEntries(attachmentEntries)
-			return nil, errors.New(strings.Replace(rawData, "\n", "", -1)) //in case we can't parse the timestamp, it means signal-cli threw an error. So instead of returning the parsing error, return the actual error from signal-cli
+			return nil, parseSignalCliError(strings.Replace(rawData, "\n", "", -1), 0) //in case we can't parse the timestamp, it means signal-cli threw an error. So instead of returning the parsing error, return the actual error from signal-cli
 		}
 	}
 
@@ -649,7 +877,7 @@ func (s *SignalClient) VerifyRegisteredNumber(number string, token string, pin s
 }
 
 func (s *SignalClient) SendV1(number string, message string, recipients []string, base64Attachments []string, isGroup bool) (*SendResponse, error) {
-	timestamp, err := s.send(number, message, recipients, base64Attachments, isGroup, "", nil, nil, nil, nil, nil, nil)
+	timestamp, err := s.send(number, message, recipients, base64Attachments, nil, isGroup, "", MessageMentions{}, nil, nil, nil, MessageMentions{}, nil, nil, nil, nil)
 	return timestamp, err
 }
 
@@ -671,8 +899,14 @@ func (s *SignalClient) getJsonRpc2Clients() []*JsonRpc2Client {
 	return jsonRpc2Clients
 }
 
-func (s *SignalClient) SendV2(number string, message string, recps []string, base64Attachments []string, sticker string, mentions []MessageMention,
-	quoteTimestamp *int64, quoteAuthor *string, quoteMessage *string, quoteMentions []MessageMention, textMode *string) (*[]SendResponse, error) {
+// SendV2 sends the message to all individual recipients at once (so that they share the same timestamp)
+// and to every group separately, so that a failure for one group doesn't affect the others. The returned
+// list contains one entry per recipient/group (in the order they were specified in); an error is only
+// returned if the message couldn't be sent at all. The already stored attachments are sent in addition
+// to the base64 encoded ones and stay owned by the caller. Base64 encoded attachments and attachment urls
+// are stored once upfront and removed again after the message was sent.
+func (s *SignalClient) SendV2(number string, message string, recps []string, base64Attachments []string, attachmentUrls []string, attachments []AttachmentEntry, sticker string, mentions MessageMentions,
+	quoteTimestamp *int64, quoteAuthor *string, quoteMessage *string, quoteMentions MessageMentions, textMode *string, linkPreview *LinkPreview) (*[]SendResponse, error) {
 	if len(recps) == 0 {
 		return nil, errors.New("Please provide at least one recipient")
 	}
@@ -681,48 +915,247 @@ func (s *SignalClient) SendV2(number string, message string, recps []string, bas
 		return nil, errors.New("Please provide a valid number")
 	}
 
-	groups := []string{}
-	recipients := []string{}
+	storedAttachments := []AttachmentEntry{}
+	defer func() { cleanupAttachmentEntries(storedAttachments) }()
+	for _, base64Attachment := range base64Attachments {
+		attachmentEntry := NewAttachmentEntry(base64Attachment, s.attachmentTmpDir)
+		err := attachmentEntry.storeBase64AsTemporaryFile()
+		if err != nil {
+			return nil, err
+		}
+		storedAttachments = append(storedAttachments, *attachmentEntry)
+	}
+
+	fetchedAttachments, err := s.fetchAttachmentUrls(attachmentUrls)
+	if err != nil {
+		return nil, err
+	}
+	storedAttachments = append(storedAttachments, fetchedAttachments...)
+	attachments = append(append([]AttachmentEntry{}, attachments...), storedAttachments...)
+
+	preview, err := s.prepareLinkPreview(message, linkPreview)
+	if err != nil {
+		return nil, err
+	}
+	defer preview.cleanUp()
+
+	// the contacts are loaded (at most) once for all recipients
+	displayName := s.mentionDisplayNameResolver(number)
+	return s.sendToTargets(recps, func(recipients []string, isGroup bool) (*SendResponse, error) {
+		return s.send(number, message, recipients, nil, attachments, isGroup, sticker, mentions,
+			quoteTimestamp, quoteAuthor, quoteMessage, quoteMentions, textMode, nil, preview, displayName)
+	})
+}
+
+// EditMessage replaces the text of a previously sent message (identified by its timestamp) for every
+// recipient/group. Like SendV2, every recipient gets its own entry (with the new timestamp) in the response.
+func (s *SignalClient) EditMessage(number string, targetTimestamp int64, message string, recps []string,
+	mentions MessageMentions, textMode *string) (*[]SendResponse, error) {
+	if len(recps) == 0 {
+		return nil, errors.New("Please provide at least one recipient")
+	}
+
+	displayName := s.mentionDisplayNameResolver(number)
+	return s.sendToTargets(recps, func(recipients []string, isGroup bool) (*SendResponse, error) {
+		return s.send(number, message, recipients, nil, nil, isGroup, "", mentions,
+			nil, nil, nil, MessageMentions{}, textMode, &targetTimestamp, nil, displayName)
+	})
+}
+
+// sendTarget is either a group or all individual recipients of a send request.
+type sendTarget struct {
+	recipients []string
+	isGroup    bool
+}
 
+func (t *sendTarget) String() string {
+	if t.isGroup {
+		return groupPrefix + t.recipients[0]
+	}
+	return strings.Join(t.recipients, ", ")
+}
+
+// sendTargets splits the (deduplicated) recipients into one target for all individual recipients and one
+// target per group. Group ids are passed on without the group prefix.
+func sendTargets(recps []string) []sendTarget {
+	targets := []sendTarget{}
+	individual := sendTarget{}
+	seen := make(map[string]bool)
 	for _, recipient := range recps {
+		if seen[recipient] {
+			continue
+		}
+		seen[recipient] = true
 		if strings.HasPrefix(recipient, groupPrefix) {
-			groups = append(groups, strings.TrimPrefix(recipient, groupPrefix))
+			targets = append(targets, sendTarget{recipients: []string{strings.TrimPrefix(recipient, groupPrefix)}, isGroup: true})
 		} else {
-			recipients = append(recipients, recipient)
+			individual.recipients = append(individual.recipients, recipient)
 		}
 	}
+	if len(individual.recipients) > 0 {
+		targets = append([]sendTarget{individual}, targets...)
+	}
+	return targets
+}
+
+// matchesRecipient reports whether the address is the given recipient (number, uuid or username).
+func (a *SendAddress) matchesRecipient(recipient string) bool {
+	return recipient != "" && (a.Number == recipient || a.UUID == recipient || a.Username == recipient)
+}
 
-	if len(recipients) > 0 && len(groups) > 0 {
-		return nil, errors.New("Signal Messenger Groups and phone numbers cannot be specified together in one request! Please split them up into multiple REST API calls.")
+// splitSendResponse creates the entries of the individual recipients a message was sent to in one call:
+// all of them share the timestamp, the results and untrusted identities are assigned to their recipient.
+func splitSendResponse(resp *SendResponse, recipients []string) []SendResponse {
+	if len(recipients) == 1 {
+		entry := *resp
+		entry.Recipient = recipients[0]
+		return []SendResponse{entry}
 	}
 
-	if len(groups) > 1 {
-		return nil, errors.New("A signal message cannot be sent to more than one group at once! Please use multiple REST API calls for that.")
+	entries := []SendResponse{}
+	for _, recipient := range recipients {
+		entry := SendResponse{Recipient: recipient, Timestamp: resp.Timestamp}
+		for _, result := range resp.Results {
+			if result.RecepientAddress.matchesRecipient(recipient) {
+				entry.Results = append(entry.Results, result)
+			}
+		}
+		for _, identity := range resp.UntrustedIdentities {
+			if identity.Recipient == recipient {
+				entry.UntrustedIdentities = append(entry.UntrustedIdentities, identity)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// sendToTargets calls sendFunc once for all individual recipients and once for every group (in parallel).
+// The returned list contains one entry per recipient/group. An error is only returned if sending failed
+// for all targets.
+func (s *SignalClient) sendToTargets(recps []string, sendFunc func(recipients []string, isGroup bool) (*SendResponse, error)) (*[]SendResponse, error) {
+	targets := sendTargets(recps)
+
+	targetResponses := make([][]SendResponse, len(targets))
+	errs := make([]error, len(targets))
+	semaphore := make(chan struct{}, s.sendMaxParallelism)
+	var wg sync.WaitGroup
+	for i := range targets {
+		wg.Add(1)
+		go func(i int, target *sendTarget) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			resp, err := sendFunc(target.recipients, target.isGroup)
+			if err != nil {
+				errs[i] = err
+				for _, recipient := range target.recipients {
+					if target.isGroup {
+						recipient = groupPrefix + recipient
+					}
+					entry := SendResponse{Recipient: recipient, Error: err.Error()}
+					var untrustedIdentityError *UntrustedIdentityError
+					if errors.As(err, &untrustedIdentityError) {
+						entry.UntrustedIdentities = untrustedIdentityError.Identities
+					}
+					targetResponses[i] = append(targetResponses[i], entry)
+				}
+				return
+			}
+			if target.isGroup {
+				resp.Recipient = groupPrefix + target.recipients[0]
+				targetResponses[i] = []SendResponse{*resp}
+				return
+			}
+			targetResponses[i] = splitSendResponse(resp, target.recipients)
+		}(i, &targets[i])
 	}
+	wg.Wait()
 
-	timestamps := []SendResponse{}
-	for _, group := range groups {
-		timestamp, err := s.send(number, message, []string{group}, base64Attachments, true, sticker, mentions, quoteTimestamp, quoteAuthor, quoteMessage, quoteMentions, textMode)
+	failedTargets := []string{}
+	for i, err := range errs {
 		if err != nil {
-			return nil, err
+			failedTargets = append(failedTargets, targets[i].String()+": "+err.Error())
 		}
-		timestamps = append(timestamps, *timestamp)
 	}
 
-	if len(recipients) > 0 {
-		timestamp, err := s.send(number, message, recipients, base64Attachments, false, sticker, mentions, quoteTimestamp, quoteAuthor, quoteMessage, quoteMentions, textMode)
-		if err != nil {
-			return nil, err
+	if len(failedTargets) == len(targets) {
+		if len(targets) == 1 {
+			return nil, errs[0]
+		}
+		description := "Couldn't send message to any of the recipients (" + strings.Join(failedTargets, "; ") + ")"
+		untrustedIdentities := []UntrustedIdentity{}
+		for _, err := range errs {
+			var rateLimitError *RateLimitError
+			if errors.As(err, &rateLimitError) {
+				return nil, &RateLimitError{Description: description, ChallengeToken: rateLimitError.ChallengeToken, RetryAfter: rateLimitError.RetryAfter}
+			}
+			var untrustedIdentityError *UntrustedIdentityError
+			if errors.As(err, &untrustedIdentityError) {
+				untrustedIdentities = append(untrustedIdentities, untrustedIdentityError.Identities...)
+			}
 		}
-		timestamps = append(timestamps, *timestamp)
+		if len(untrustedIdentities) > 0 {
+			return nil, &UntrustedIdentityError{Description: description, Identities: untrustedIdentities}
+		}
+		return nil, newSendFailedError(description, errs)
 	}
 
-	return &timestamps, nil
+	// restore the order of the request
+	responsesByRecipient := make(map[string]SendResponse)
+	for _, entries := range targetResponses {
+		for _, entry := range entries {
+			responsesByRecipient[entry.Recipient] = entry
+		}
+	}
+	responses := []SendResponse{}
+	for _, recipient := range recps {
+		if entry, ok := responsesByRecipient[recipient]; ok {
+			responses = append(responses, entry)
+			delete(responsesByRecipient, recipient)
+		}
+	}
+	return &responses, nil
 }
 
-func (s *SignalClient) Receive(number string, timeout int64, ignoreAttachments bool, ignoreStories bool, maxMessages int64) (string, error) {
+// Receive fetches new messages. In json-rpc mode, the messages are taken from the inbox the messages are
+// buffered in while nobody is connected to the websocket; ignoreAttachments has no effect there, as the
+// attachments were already downloaded by the daemon. If match is set, only the matching messages are
+// returned; the other ones are received (and discarded) all the same. In json-rpc mode, maxMessages only
+// counts the matching messages, otherwise it limits the messages signal-cli receives. The request is
+// aborted once ctx is done.
+func (s *SignalClient) Receive(ctx context.Context, number string, timeout int64, ignoreAttachments bool, ignoreStories bool, maxMessages int64, match func(data []byte) bool) (string, error) {
 	if s.signalCliMode == JsonRpc {
-		return "", errors.New("Not implemented")
+		jsonRpc2Client, err := s.getJsonRpc2Client(number)
+		if err != nil {
+			return "", err
+		}
+
+		inboxMatch := func(msg *JsonRpc2ReceivedMessage) bool {
+			if msg.Err.Code != 0 {
+				log.Error("Received error for ", number, ": ", msg.Err.Message)
+				return false
+			}
+			if ignoreStories {
+				received, err := ParseReceivedMessage(msg.Params)
+				if err == nil && received.Envelope.StoryMessage != nil {
+					return false
+				}
+			}
+			return match == nil || match(msg.Params)
+		}
+
+		messages := []json.RawMessage{}
+		for _, msg := range jsonRpc2Client.ReceiveFromInbox(ctx, time.Duration(timeout)*time.Second, int(maxMessages), inboxMatch) {
+			messages = append(messages, msg.Params)
+		}
+
+		jsonBytes, err := json.Marshal(messages)
+		if err != nil {
+			return "", err
+		}
+		return string(jsonBytes), nil
 	} else {
 		command := []string{"--config", s.signalCliConfig, "--output", "json", "-a", number, "receive", "-t", strconv.FormatInt(timeout, 10)}
 
@@ -746,6 +1179,21 @@ func (s *SignalClient) Receive(number string, timeout int64, ignoreAttachments b
 
 		out = strings.Trim(out, "\n")
 		lines := strings.Split(out, "\n")
+		for _, line := range lines {
+			if line != "" {
+				s.storeReceivedMessage(number, []byte(line))
+			}
+		}
+
+		if match != nil {
+			matching := []string{}
+			for _, line := range lines {
+				if line != "" && match([]byte(line)) {
+					matching = append(matching, line)
+				}
+			}
+			lines = matching
+		}
 
 		jsonStr := "["
 		for i, line := range lines {
@@ -760,12 +1208,15 @@ func (s *SignalClient) Receive(number string, timeout int64, ignoreAttachments b
 	}
 }
 
-func (s *SignalClient) GetReceiveChannel(number string) (chan JsonRpc2ReceivedMessage, error) {
+// SubscribeReceive subscribes to the messages the number receives in json-rpc mode. If a cursor is given, the
+// buffered messages after it are replayed first; complete reports whether none of them were lost.
+func (s *SignalClient) SubscribeReceive(number string, cursor *uint64) (*ReceiveSubscription, bool, error) {
 	jsonRpc2Client, err := s.getJsonRpc2Client(number)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
-	return jsonRpc2Client.GetReceiveChannel(), nil
+	subscription, complete := jsonRpc2Client.Subscribe(cursor)
+	return subscription, complete, nil
 }
 
 func (s *SignalClient) CreateGroup(number string, name string, members []string, description string, editGroupPermission GroupPermission, addMembersPermission GroupPermission, groupLinkState GroupLinkState) (string, error) {
@@ -863,7 +1314,7 @@ func (s *SignalClient) updateGroupMembers(number string, groupId string, members
 	}
 
 	if group == nil {
-		return &NotFoundError{Description: "No group with that group id (" + groupId + ") found"}
+		return &GroupNotFoundError{Description: "No group with that group id (" + groupId + ") found"}
 	}
 
 	internalGroupId, err := ConvertGroupIdToInternalGroupId(groupId)
@@ -926,7 +1377,7 @@ func (s *SignalClient) updateGroupAdmins(number string, groupId string, admins [
 	}
 
 	if group == nil {
-		return &NotFoundError{Description: "No group with that group id (" + groupId + ") found"}
+		return &GroupNotFoundError{Description: "No group with that group id (" + groupId + ") found"}
 	}
 
 	internalGroupId, err := ConvertGroupIdToInternalGroupId(groupId)
@@ -1181,7 +1632,7 @@ func (s *SignalClient) GetDeviceLinkAwait(deviceLinkUri, sub string, ctx context
 		return SignalLinkNumber{}, err
 	}
 
-	s.jsonRpc2Clients[number] = NewJsonRpc2Client(s.signalCliApiConfig, number, tcpPort, sub)
+	s.jsonRpc2Clients[number] = NewJsonRpc2Client(s.signalCliApiConfig, number, tcpPort, sub, s.handleReceivedEnvelope)
 
 	return response, err
 }
@@ -1537,17 +1988,25 @@ func (s *SignalClient) UpdateGroup(number string, groupId string, base64Avatar *
 	return err
 }
 
+// convertRecipient converts a group id (with group prefix) into the internal group id signal-cli expects.
+// Phone numbers and usernames are returned unchanged.
+func convertRecipient(recipient string) (string, bool, error) {
+	if !strings.HasPrefix(recipient, groupPrefix) {
+		return recipient, false, nil
+	}
+
+	internalGroupId, err := ConvertGroupIdToInternalGroupId(recipient)
+	if err != nil {
+		return "", true, errors.New("Invalid group id")
+	}
+	return internalGroupId, true, nil
+}
+
 func (s *SignalClient) SendReaction(number string, recipient string, emoji string, target_author string, timestamp int64, remove bool) error {
 	// see https://github.com/AsamK/signal-cli/blob/master/man/signal-cli.1.adoc#sendreaction
-	var err error
-	recp := recipient
-	isGroup := false
-	if strings.HasPrefix(recipient, groupPrefix) {
-		isGroup = true
-		recp, err = ConvertGroupIdToInternalGroupId(recipient)
-		if err != nil {
-			return errors.New("Invalid group id")
-		}
+	recp, isGroup, err := convertRecipient(recipient)
+	if err != nil {
+		return err
 	}
 	if remove && emoji == "" {
 		emoji = "👍" // emoji must not be empty to remove a reaction
@@ -1600,16 +2059,112 @@ func (s *SignalClient) SendReaction(number string, recipient string, emoji strin
 	return err
 }
 
-func (s *SignalClient) SendStartTyping(number string, recipient string) error {
-	var err error
-	recp := recipient
-	isGroup := false
-	if strings.HasPrefix(recipient, groupPrefix) {
-		isGroup = true
-		recp, err = ConvertGroupIdToInternalGroupId(recipient)
+// RemoteDelete deletes a previously sent message (identified by its timestamp) for the given recipient or group.
+func (s *SignalClient) RemoteDelete(number string, recipient string, timestamp int64) error {
+	// see https://github.com/AsamK/signal-cli/blob/master/man/signal-cli.1.adoc#remotedelete
+	recp, isGroup, err := convertRecipient(recipient)
+	if err != nil {
+		return err
+	}
+
+	if s.signalCliMode == JsonRpc {
+		type Request struct {
+			Recipient string `json:"recipient,omitempty"`
+			GroupId   string `json:"group-id,omitempty"`
+			Timestamp int64  `json:"target-timestamp"`
+		}
+		request := Request{Timestamp: timestamp}
+		if !isGroup {
+			request.Recipient = recp
+		} else {
+			request.GroupId = recp
+		}
+		jsonRpc2Client, err := s.getJsonRpc2Client(number)
 		if err != nil {
-			return errors.New("Invalid group id")
+			return err
 		}
+		_, err = jsonRpc2Client.getRaw("remoteDelete", request, nil)
+		return err
+	}
+
+	cmd := []string{
+		"--config", s.signalCliConfig,
+		"-a", number,
+		"remoteDelete",
+	}
+	if !isGroup {
+		cmd = append(cmd, recp)
+	} else {
+		cmd = append(cmd, []string{"-g", recp}...)
+	}
+	cmd = append(cmd, []string{"-t", strconv.FormatInt(timestamp, 10)}...)
+	_, err = s.cliClient.Execute(true, cmd, "")
+	return err
+}
+
+// SendReceipt marks the messages with the given timestamps as read or viewed (receiptType "read" or "viewed").
+func (s *SignalClient) SendReceipt(number string, recipient string, timestamps []int64, receiptType string) error {
+	// see https://github.com/AsamK/signal-cli/blob/master/man/signal-cli.1.adoc#sendreceipt
+	if s.signalCliMode == JsonRpc {
+		type Request struct {
+			Recipient  string  `json:"recipient"`
+			Timestamps []int64 `json:"target-timestamp"`
+			Type       string  `json:"type"`
+		}
+		request := Request{Recipient: recipient, Timestamps: timestamps, Type: receiptType}
+		jsonRpc2Client, err := s.getJsonRpc2Client(number)
+		if err != nil {
+			return err
+		}
+		_, err = jsonRpc2Client.getRaw("sendReceipt", request, nil)
+		return err
+	}
+
+	cmd := []string{
+		"--config", s.signalCliConfig,
+		"-a", number,
+		"sendReceipt", recipient,
+		"--type", receiptType,
+	}
+	for _, timestamp := range timestamps {
+		cmd = append(cmd, []string{"-t", strconv.FormatInt(timestamp, 10)}...)
+	}
+	_, err := s.cliClient.Execute(true, cmd, "")
+	return err
+}
+
+// SubmitRateLimitChallenge lifts a rate limit of the account with the challenge token Signal sent along
+// with the proof required failure and the solved captcha (see https://signalcaptchas.org/challenge/generate.html).
+func (s *SignalClient) SubmitRateLimitChallenge(number string, challengeToken string, captcha string) error {
+	if s.signalCliMode == JsonRpc {
+		type Request struct {
+			Challenge string `json:"challenge"`
+			Captcha   string `json:"captcha"`
+		}
+		request := Request{Challenge: challengeToken, Captcha: captcha}
+		jsonRpc2Client, err := s.getJsonRpc2Client(number)
+		if err != nil {
+			return err
+		}
+		_, err = jsonRpc2Client.getRaw("submitRateLimitChallenge", request, nil)
+		return err
+	}
+
+	cmd := []string{
+		"--config", s.signalCliConfig,
+		"-a", number,
+		"submitRateLimitChallenge",
+		"--challenge", challengeToken,
+		"--captcha", captcha,
+	}
+	_, err := s.cliClient.Execute(true, cmd, "")
+	return err
+}
+
+func (s *SignalClient) SendStartTyping(number string, recipient string) error {
+	recp, isGroup, err := convertRecipient(recipient)
+	if err != nil {
+		return err
 	}
 
 	if s.signalCliMode == JsonRpc {
@@ -1643,15 +2198,9 @@ func (s *SignalClient) SendStartTyping(number string, recipient string) error {
 }
 
 func (s *SignalClient) SendStopTyping(number string, recipient string) error {
-	var err error
-	recp := recipient
-	isGroup := false
-	if strings.HasPrefix(recipient, groupPrefix) {
-		isGroup = true
-		recp, err = ConvertGroupIdToInternalGroupId(recipient)
-		if err != nil {
-			return errors.New("Invalid group id")
-		}
+	recp, isGroup, err := convertRecipient(recipient)
+	if err != nil {
+		return err
 	}
 
 	if s.signalCliMode == JsonRpc {
@@ -1854,6 +2403,16 @@ func (s *SignalClient) GetTrustMode(number string) utils.SignalCliTrustMode {
 	return trustMode
 }
 
+func (s *SignalClient) SetMessageRetention(number string, days int) error {
+	s.signalCliApiConfig.SetMessageRetentionForNumber(number, days)
+	return s.signalCliApiConfig.Persist()
+}
+
+// GetMessageRetention returns the number of days the received messages of the number are stored, if set.
+func (s *SignalClient) GetMessageRetention(number string) (int, bool) {
+	return s.signalCliApiConfig.GetMessageRetentionForNumber(number)
+}
+
 func (s *SignalClient) IsNumberLoggedIn(number string) (bool, error) {
 	client, ok := s.jsonRpc2Clients[number]
 	if !ok {
@@ -1929,3 +2488,167 @@ func (s *SignalClient) GetNumbers(sub string) (*AssignedNumbers, error) {
 	}
 	return &AssignedNumbers{Numbers: numbers}, nil
 }
+
+func (s *SignalCliStickerEntry) toStickerEntry() StickerEntry {
+	return StickerEntry{Id: s.Id, Emoji: s.Emoji, ContentType: s.ContentType}
+}
+
+func (s *SignalClient) ListStickerPacks(number string) ([]StickerPackEntry, error) {
+	var rawData string
+	var err error
+	if s.signalCliMode == JsonRpc {
+		jsonRpc2Client, err := s.getJsonRpc2Client(number)
+		if err != nil {
+			return nil, err
+		}
+		rawData, err = jsonRpc2Client.getRaw("listStickerPacks", nil, nil)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		rawData, err = s.cliClient.Execute(true, []string{"--config", s.signalCliConfig, "--output", "json", "-a", number, "listStickerPacks"}, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	signalCliStickerPacks := []SignalCliStickerPackEntry{}
+	err = json.Unmarshal([]byte(rawData), &signalCliStickerPacks)
+	if err != nil {
+		return nil, err
+	}
+
+	stickerPacks := []StickerPackEntry{}
+	for _, signalCliStickerPack := range signalCliStickerPacks {
+		stickerPack := StickerPackEntry{
+			PackId:    signalCliStickerPack.PackId,
+			Url:       signalCliStickerPack.Url,
+			Installed: signalCliStickerPack.Installed,
+			Title:     signalCliStickerPack.Title,
+			Author:    signalCliStickerPack.Author,
+			Stickers:  []StickerEntry{},
+		}
+		if signalCliStickerPack.Cover != nil {
+			cover := signalCliStickerPack.Cover.toStickerEntry()
+			stickerPack.Cover = &cover
+		}
+		for _, signalCliSticker := range signalCliStickerPack.Stickers {
+			stickerPack.Stickers = append(stickerPack.Stickers, signalCliSticker.toStickerEntry())
+		}
+		stickerPacks = append(stickerPacks, stickerPack)
+	}
+	return stickerPacks, nil
+}
+
+// AddStickerPack installs the sticker pack with the given url (https://signal.art/addstickers/#pack_id=...&pack_key=...).
+func (s *SignalClient) AddStickerPack(number string, url string) error {
+	if s.signalCliMode == JsonRpc {
+		type Request struct {
+			Uri string `json:"uri"`
+		}
+		jsonRpc2Client, err := s.getJsonRpc2Client(number)
+		if err != nil {
+			return err
+		}
+		_, err = jsonRpc2Client.getRaw("addStickerPack", Request{Uri: url}, nil)
+		return err
+	}
+
+	_, err := s.cliClient.Execute(true, []string{"--config", s.signalCliConfig, "-a", number, "addStickerPack", "--uri", url}, "")
+	return err
+}
+
+// StickerPackUpload is a temporary directory the files of a sticker pack are stored in before the pack is uploaded.
+type StickerPackUpload struct {
+	dirPath string
+	files   []string
+}
+
+func (s *SignalClient) NewStickerPackUpload() (*StickerPackUpload, error) {
+	dirNameUuid, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+
+	dirPath := s.attachmentTmpDir + dirNameUuid.String()
+	err = os.Mkdir(dirPath, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	return &StickerPackUpload{dirPath: dirPath}, nil
+}
+
+// AddFile stores a file of the sticker pack (the manifest.json, a sticker image or a zip file containing the whole pack).
+func (u *StickerPackUpload) AddFile(fileName string, reader io.Reader) error {
+	fileName = filepath.Base(fileName)
+	if fileName == "." || fileName == string(os.PathSeparator) || utils.StringInSlice(fileName, u.files) {
+		return errors.New("Invalid or duplicate file name " + fileName)
+	}
+
+	f, err := os.Create(u.dirPath + string(os.PathSeparator) + fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, reader)
+	if err != nil {
+		return err
+	}
+	u.files = append(u.files, fileName)
+	return nil
+}
+
+// path returns the path signal-cli expects: either the path of the manifest.json or of the zip file.
+func (u *StickerPackUpload) path() (string, error) {
+	if utils.StringInSlice("manifest.json", u.files) {
+		return u.dirPath + string(os.PathSeparator) + "manifest.json", nil
+	}
+
+	if len(u.files) == 1 && strings.HasSuffix(strings.ToLower(u.files[0]), ".zip") {
+		return u.dirPath + string(os.PathSeparator) + u.files[0], nil
+	}
+	return "", errors.New("Please provide either a manifest.json (together with the sticker images) or a single zip file")
+}
+
+func (u *StickerPackUpload) CleanUp() {
+	os.RemoveAll(u.dirPath)
+}
+
+// UploadStickerPack uploads a new sticker pack and returns its url.
+func (s *SignalClient) UploadStickerPack(number string, upload *StickerPackUpload) (string, error) {
+	path, err := upload.path()
+	if err != nil {
+		return "", err
+	}
+
+	var rawData string
+	if s.signalCliMode == JsonRpc {
+		type Request struct {
+			Path string `json:"path"`
+		}
+		jsonRpc2Client, err := s.getJsonRpc2Client(number)
+		if err != nil {
+			return "", err
+		}
+		rawData, err = jsonRpc2Client.getRaw("uploadStickerPack", Request{Path: path}, nil)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		rawData, err = s.cliClient.Execute(true, []string{"--config", s.signalCliConfig, "--output", "json", "-a", number, "uploadStickerPack", path}, "")
+		if err != nil {
+			return "", err
+		}
+	}
+
+	type Response struct {
+		Url string `json:"url"`
+	}
+	var resp Response
+	err = json.Unmarshal([]byte(rawData), &resp)
+	if err != nil {
+		return "", err
+	}
+	return resp.Url, nil
+}
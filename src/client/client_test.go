@@ -0,0 +1,275 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	utils "github.com/sheophe/signal-cli-rest-api/utils"
+)
+
+// testJsonRpcRequest is a request the fake signal-cli daemon received.
+type testJsonRpcRequest struct {
+	Method string                 `json:"method"`
+	Id     string                 `json:"id"`
+	Params map[string]interface{} `json:"params"`
+}
+
+// newTestJsonRpcSignalClient creates a client in json-rpc mode that is connected to a fake signal-cli daemon
+// for the number. The daemon responds to every request with the given result; the returned function returns
+// the requests it received.
+func newTestJsonRpcSignalClient(t *testing.T, number string, result string) (*SignalClient, func() []testJsonRpcRequest) {
+	clientConn, daemonConn := net.Pipe()
+	jsonRpc2Client := NewJsonRpc2Client(utils.NewSignalCliApiConfig(), number, 0, "sub", nil)
+	jsonRpc2Client.conn = clientConn
+	jsonRpc2Client.receivedMessageResponses = make(chan JsonRpc2MessageResponse)
+	jsonRpc2Client.stop = make(chan struct{})
+	go jsonRpc2Client.ReceiveData(number)
+
+	requests := []testJsonRpcRequest{}
+	var mutex sync.Mutex
+	go func() {
+		reader := bufio.NewReader(daemonConn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			var request testJsonRpcRequest
+			err = json.Unmarshal([]byte(line), &request)
+			if err != nil {
+				t.Errorf("couldn't parse request %s: %s", line, err.Error())
+				return
+			}
+			mutex.Lock()
+			requests = append(requests, request)
+			mutex.Unlock()
+			daemonConn.Write([]byte(`{"jsonrpc":"2.0","id":"` + request.Id + `","result":` + result + "}\n"))
+		}
+	}()
+	t.Cleanup(func() {
+		close(jsonRpc2Client.stop)
+		clientConn.Close()
+		daemonConn.Close()
+	})
+
+	s := &SignalClient{signalCliMode: JsonRpc, jsonRpc2Clients: map[string]*JsonRpc2Client{number: jsonRpc2Client}, sendMaxParallelism: 1}
+	return s, func() []testJsonRpcRequest {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]testJsonRpcRequest{}, requests...)
+	}
+}
+
+// newTestCliSignalClient creates a client in normal mode that runs a fake signal-cli binary, which prints
+// the given output. The returned function returns the arguments of every call.
+func newTestCliSignalClient(t *testing.T, output string) (*SignalClient, func() [][]string) {
+	dir, err := ioutil.TempDir("", "signal-cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	callsPath := filepath.Join(dir, "calls")
+	script := "#!/bin/sh\n" +
+		"echo \"$*\" >> " + callsPath + "\n" +
+		"printf '%s' '" + output + "'\n"
+	err = ioutil.WriteFile(filepath.Join(dir, "signal-cli"), []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	s := &SignalClient{signalCliConfig: dir, signalCliMode: Normal, cliClient: NewCliClient(Normal, utils.NewSignalCliApiConfig()),
+		jsonRpc2Clients: make(map[string]*JsonRpc2Client), sendMaxParallelism: 1}
+	return s, func() [][]string {
+		calls := [][]string{}
+		data, _ := ioutil.ReadFile(callsPath)
+		for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+			if line != "" {
+				calls = append(calls, strings.Fields(line))
+			}
+		}
+		return calls
+	}
+}
+
+// argValue returns the argument that follows the given flag.
+func argValue(args []string, flag string) (string, bool) {
+	for i, arg := range args {
+		if arg == flag && i+1 < len(args) {
+			return args[i+1], true
+		}
+	}
+	return "", false
+}
+
+func TestEditMessageJsonRpc(t *testing.T) {
+	s, requests := newTestJsonRpcSignalClient(t, "+490000",
+		`{"timestamp":2000,"results":[{"recipientAddress":{"number":"+491111"},"type":"SUCCESS"}]}`)
+
+	responses, err := s.EditMessage("+490000", 1000, "edited", []string{"+491111", "group.Z3JvdXAx"}, MessageMentions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*responses) != 2 || (*responses)[0].Timestamp != 2000 {
+		t.Errorf("expected one entry per recipient with the new timestamp, got %+v", *responses)
+	}
+
+	sent := requests()
+	if len(sent) != 2 {
+		t.Fatalf("expected one request for the number and one for the group, got %+v", sent)
+	}
+	for _, request := range sent {
+		if request.Method != "send" || request.Params["message"] != "edited" {
+			t.Errorf("expected the edited message to be sent, got %+v", request)
+		}
+		if editTimestamp, ok := request.Params["edit-timestamp"].(float64); !ok || editTimestamp != 1000 {
+			t.Errorf("expected edit-timestamp 1000, got %+v", request.Params)
+		}
+	}
+}
+
+func TestEditMessageCli(t *testing.T) {
+	s, calls := newTestCliSignalClient(t, "2000\n")
+
+	responses, err := s.EditMessage("+490000", 1000, "edited", []string{"+491111"}, MessageMentions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*responses) != 1 || (*responses)[0].Timestamp != 2000 {
+		t.Errorf("expected the new timestamp, got %+v", *responses)
+	}
+
+	executed := calls()
+	if len(executed) != 1 {
+		t.Fatalf("expected signal-cli to be called once, got %v", executed)
+	}
+	if editTimestamp, ok := argValue(executed[0], "--edit-timestamp"); !ok || editTimestamp != "1000" {
+		t.Errorf("expected --edit-timestamp 1000, got %v", executed[0])
+	}
+}
+
+func TestConvertRecipient(t *testing.T) {
+	tests := []struct {
+		recipient string
+		expected  string
+		isGroup   bool
+		valid     bool
+	}{
+		{"+491111", "+491111", false, true},
+		{"alice.01", "alice.01", false, true},
+		{"0b1c2d3e-4f50-6172-8394-a5b6c7d8e9f0", "0b1c2d3e-4f50-6172-8394-a5b6c7d8e9f0", false, true},
+		{"group.Z3JvdXAx", "group1", true, true},
+		{"group.not base64!", "", true, false},
+	}
+	for _, test := range tests {
+		recp, isGroup, err := convertRecipient(test.recipient)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %t, got error %v", test.recipient, test.valid, err)
+			continue
+		}
+		if test.valid && (recp != test.expected || isGroup != test.isGroup) {
+			t.Errorf("%s: expected %s (group %t), got %s (group %t)", test.recipient, test.expected, test.isGroup, recp, isGroup)
+		}
+	}
+}
+
+func TestRemoteDeleteJsonRpc(t *testing.T) {
+	s, requests := newTestJsonRpcSignalClient(t, "+490000", `{"timestamp":2000}`)
+
+	for _, recipient := range []string{"+491111", "alice.01", "group.Z3JvdXAx"} {
+		err := s.RemoteDelete("+490000", recipient, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.RemoteDelete("+490000", "group.not base64!", 1000); err == nil {
+		t.Error("expected an invalid group id to be rejected")
+	}
+
+	sent := requests()
+	if len(sent) != 3 {
+		t.Fatalf("expected three requests, got %+v", sent)
+	}
+	expected := []map[string]interface{}{
+		{"recipient": "+491111", "target-timestamp": float64(1000)},
+		{"recipient": "alice.01", "target-timestamp": float64(1000)},
+		{"group-id": "group1", "target-timestamp": float64(1000)},
+	}
+	for i, request := range sent {
+		if request.Method != "remoteDelete" || !reflect.DeepEqual(request.Params, expected[i]) {
+			t.Errorf("expected remoteDelete with %v, got %s %v", expected[i], request.Method, request.Params)
+		}
+	}
+}
+
+func TestRemoteDeleteCli(t *testing.T) {
+	s, calls := newTestCliSignalClient(t, "")
+
+	for _, recipient := range []string{"+491111", "alice.01", "group.Z3JvdXAx"} {
+		err := s.RemoteDelete("+490000", recipient, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	executed := calls()
+	expected := [][]string{
+		{"remoteDelete", "+491111", "-t", "1000"},
+		{"remoteDelete", "alice.01", "-t", "1000"},
+		{"remoteDelete", "-g", "group1", "-t", "1000"},
+	}
+	if len(executed) != len(expected) {
+		t.Fatalf("expected %d calls, got %v", len(expected), executed)
+	}
+	for i, args := range executed {
+		if !strings.HasSuffix(strings.Join(args, " "), strings.Join(expected[i], " ")) {
+			t.Errorf("expected the arguments to end with %v, got %v", expected[i], args)
+		}
+	}
+}
+
+func TestSendReactionGroupJsonRpc(t *testing.T) {
+	s, requests := newTestJsonRpcSignalClient(t, "+490000", `{"timestamp":2000}`)
+
+	err := s.SendReaction("+490000", "group.Z3JvdXAx", "👍", "+491111", 1000, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := requests()
+	if len(sent) != 1 || sent[0].Params["group-id"] != "group1" || sent[0].Params["recipient"] != nil {
+		t.Errorf("expected the reaction to be sent to the group, got %+v", sent)
+	}
+}
+
+func TestSendReceipt(t *testing.T) {
+	s, requests := newTestJsonRpcSignalClient(t, "+490000", `{}`)
+	err := s.SendReceipt("+490000", "+491111", []int64{1000, 2000}, "viewed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := requests()
+	expected := map[string]interface{}{"recipient": "+491111", "target-timestamp": []interface{}{float64(1000), float64(2000)}, "type": "viewed"}
+	if len(sent) != 1 || sent[0].Method != "sendReceipt" || !reflect.DeepEqual(sent[0].Params, expected) {
+		t.Errorf("expected sendReceipt with %v, got %+v", expected, sent)
+	}
+
+	cliClient, calls := newTestCliSignalClient(t, "")
+	err = cliClient.SendReceipt("+490000", "+491111", []int64{1000, 2000}, "read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	executed := calls()
+	if len(executed) != 1 || !strings.HasSuffix(strings.Join(executed[0], " "), "sendReceipt +491111 --type read -t 1000 -t 2000") {
+		t.Errorf("expected sendReceipt with both timestamps, got %v", executed)
+	}
+}
@@ -0,0 +1,247 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+
+	utils "github.com/sheophe/signal-cli-rest-api/utils"
+)
+
+// The following types describe the envelopes signal-cli reports for received messages (in both modes).
+// Only the fields that are needed are declared.
+
+type SignalCliReceivedMessage struct {
+	Envelope SignalCliEnvelope `json:"envelope"`
+	Account  string            `json:"account"`
+}
+
+type SignalCliEnvelope struct {
+	Source                   string                   `json:"source"`
+	SourceNumber             string                   `json:"sourceNumber"`
+	SourceUuid               string                   `json:"sourceUuid"`
+	SourceName               string                   `json:"sourceName"`
+	SourceDevice             int                      `json:"sourceDevice"`
+	Timestamp                int64                    `json:"timestamp"`
+	ServerReceivedTimestamp  int64                    `json:"serverReceivedTimestamp"`
+	ServerDeliveredTimestamp int64                    `json:"serverDeliveredTimestamp"`
+	DataMessage              *SignalCliDataMessage    `json:"dataMessage"`
+	EditMessage              *SignalCliEditMessage    `json:"editMessage"`
+	SyncMessage              *SignalCliSyncMessage    `json:"syncMessage"`
+	ReceiptMessage           *SignalCliReceiptMessage `json:"receiptMessage"`
+	TypingMessage            *SignalCliTypingMessage  `json:"typingMessage"`
+	StoryMessage             *SignalCliStoryMessage   `json:"storyMessage"`
+	CallMessage              *SignalCliCallMessage    `json:"callMessage"`
+}
+
+type SignalCliDataMessage struct {
+	Timestamp        int64                  `json:"timestamp"`
+	Message          *string                `json:"message"`
+	ExpiresInSeconds int                    `json:"expiresInSeconds"`
+	ViewOnce         bool                   `json:"viewOnce"`
+	GroupInfo        *SignalCliGroupInfo    `json:"groupInfo"`
+	Quote            *SignalCliQuote        `json:"quote"`
+	Mentions         []SignalCliMention     `json:"mentions"`
+	Attachments      []SignalCliAttachment  `json:"attachments"`
+	Sticker          *SignalCliSticker      `json:"sticker"`
+	Reaction         *SignalCliReaction     `json:"reaction"`
+	RemoteDelete     *SignalCliRemoteDelete `json:"remoteDelete"`
+}
+
+type SignalCliGroupInfo struct {
+	GroupId   string `json:"groupId"`
+	GroupName string `json:"groupName"`
+	Revision  int    `json:"revision"`
+	Type      string `json:"type"`
+}
+
+type SignalCliQuote struct {
+	Id           int64  `json:"id"`
+	Author       string `json:"author"`
+	AuthorNumber string `json:"authorNumber"`
+	AuthorUuid   string `json:"authorUuid"`
+	Text         string `json:"text"`
+}
+
+type SignalCliMention struct {
+	Name   string `json:"name"`
+	Number string `json:"number"`
+	Uuid   string `json:"uuid"`
+	Start  int    `json:"start"`
+	Length int    `json:"length"`
+}
+
+type SignalCliAttachment struct {
+	Id          string `json:"id"`
+	ContentType string `json:"contentType"`
+	Filename    string `json:"filename"`
+	Size        int64  `json:"size"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Caption     string `json:"caption"`
+}
+
+type SignalCliSticker struct {
+	PackId    string `json:"packId"`
+	StickerId int    `json:"stickerId"`
+}
+
+type SignalCliReaction struct {
+	Emoji               string `json:"emoji"`
+	TargetAuthor        string `json:"targetAuthor"`
+	TargetAuthorNumber  string `json:"targetAuthorNumber"`
+	TargetAuthorUuid    string `json:"targetAuthorUuid"`
+	TargetSentTimestamp int64  `json:"targetSentTimestamp"`
+	IsRemove            bool   `json:"isRemove"`
+}
+
+type SignalCliRemoteDelete struct {
+	Timestamp int64 `json:"timestamp"`
+}
+
+type SignalCliEditMessage struct {
+	TargetSentTimestamp int64                 `json:"targetSentTimestamp"`
+	DataMessage         *SignalCliDataMessage `json:"dataMessage"`
+}
+
+type SignalCliSyncMessage struct {
+	SentMessage *SignalCliSyncSentMessage `json:"sentMessage"`
+}
+
+// SignalCliSyncSentMessage is a message that was sent from another device of the account. signal-cli
+// reports the fields of the data message inline.
+type SignalCliSyncSentMessage struct {
+	Destination       string `json:"destination"`
+	DestinationNumber string `json:"destinationNumber"`
+	DestinationUuid   string `json:"destinationUuid"`
+	SignalCliDataMessage
+}
+
+type SignalCliReceiptMessage struct {
+	When       int64   `json:"when"`
+	IsDelivery bool    `json:"isDelivery"`
+	IsRead     bool    `json:"isRead"`
+	IsViewed   bool    `json:"isViewed"`
+	Timestamps []int64 `json:"timestamps"`
+}
+
+type SignalCliTypingMessage struct {
+	Action    string `json:"action"`
+	Timestamp int64  `json:"timestamp"`
+	GroupId   string `json:"groupId"`
+}
+
+type SignalCliStoryMessage struct {
+	AllowsReplies  bool                     `json:"allowsReplies"`
+	GroupId        string                   `json:"groupId"`
+	FileAttachment *SignalCliAttachment     `json:"fileAttachment"`
+	TextAttachment *SignalCliTextAttachment `json:"textAttachment"`
+}
+
+type SignalCliTextAttachment struct {
+	Text string `json:"text"`
+}
+
+type SignalCliCallMessage struct {
+	OfferMessage      *json.RawMessage `json:"offerMessage"`
+	AnswerMessage     *json.RawMessage `json:"answerMessage"`
+	BusyMessage       *json.RawMessage `json:"busyMessage"`
+	HangupMessage     *json.RawMessage `json:"hangupMessage"`
+	IceUpdateMessages *json.RawMessage `json:"iceUpdateMessages"`
+}
+
+// ParseReceivedMessage parses an envelope as reported by signal-cli.
+func ParseReceivedMessage(data []byte) (*SignalCliReceivedMessage, error) {
+	var received SignalCliReceivedMessage
+	err := json.Unmarshal(data, &received)
+	if err != nil {
+		return nil, err
+	}
+	if received.Envelope.Timestamp == 0 {
+		return nil, errors.New("Not an envelope")
+	}
+	return &received, nil
+}
+
+// Sender returns the phone number of the sender or, if it is unknown, the uuid.
+func (e *SignalCliEnvelope) Sender() string {
+	if e.SourceNumber != "" {
+		return e.SourceNumber
+	}
+	if e.Source != "" {
+		return e.Source
+	}
+	return e.SourceUuid
+}
+
+// MessageType returns the type of the envelope (one of the utils.MessageType* constants).
+func (e *SignalCliEnvelope) MessageType() string {
+	switch {
+	case e.EditMessage != nil:
+		return utils.MessageTypeEdit
+	case e.DataMessage != nil:
+		if e.DataMessage.Reaction != nil {
+			return utils.MessageTypeReaction
+		}
+		if e.DataMessage.RemoteDelete != nil {
+			return utils.MessageTypeRemoteDelete
+		}
+		return utils.MessageTypeMessage
+	case e.SyncMessage != nil:
+		return utils.MessageTypeSync
+	case e.ReceiptMessage != nil:
+		return utils.MessageTypeReceipt
+	case e.TypingMessage != nil:
+		return utils.MessageTypeTyping
+	case e.StoryMessage != nil:
+		return utils.MessageTypeStory
+	case e.CallMessage != nil:
+		return utils.MessageTypeCall
+	}
+	return utils.MessageTypeOther
+}
+
+// content returns the data message that carries the text of the envelope, if there is one.
+func (e *SignalCliEnvelope) content() *SignalCliDataMessage {
+	switch {
+	case e.EditMessage != nil:
+		return e.EditMessage.DataMessage
+	case e.DataMessage != nil:
+		return e.DataMessage
+	case e.SyncMessage != nil && e.SyncMessage.SentMessage != nil:
+		return &e.SyncMessage.SentMessage.SignalCliDataMessage
+	}
+	return nil
+}
+
+// GroupId returns the id of the group the envelope belongs to or an empty string, if it doesn't belong to a group.
+func (e *SignalCliEnvelope) GroupId() string {
+	if dataMessage := e.content(); dataMessage != nil {
+		if dataMessage.GroupInfo != nil && dataMessage.GroupInfo.GroupId != "" {
+			return convertInternalGroupIdToGroupId(dataMessage.GroupInfo.GroupId)
+		}
+		return ""
+	}
+	if e.TypingMessage != nil && e.TypingMessage.GroupId != "" {
+		return convertInternalGroupIdToGroupId(e.TypingMessage.GroupId)
+	}
+	if e.StoryMessage != nil && e.StoryMessage.GroupId != "" {
+		return convertInternalGroupIdToGroupId(e.StoryMessage.GroupId)
+	}
+	return ""
+}
+
+// HasText reports whether the envelope carries a text (of a message or a text story).
+func (e *SignalCliEnvelope) HasText() bool {
+	if dataMessage := e.content(); dataMessage != nil {
+		return dataMessage.Message != nil && *dataMessage.Message != ""
+	}
+	return e.StoryMessage != nil && e.StoryMessage.TextAttachment != nil && e.StoryMessage.TextAttachment.Text != ""
+}
+
+// HasAttachments reports whether the envelope carries at least one attachment.
+func (e *SignalCliEnvelope) HasAttachments() bool {
+	if dataMessage := e.content(); dataMessage != nil {
+		return len(dataMessage.Attachments) > 0
+	}
+	return e.StoryMessage != nil && e.StoryMessage.FileAttachment != nil
+}
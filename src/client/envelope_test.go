@@ -0,0 +1,99 @@
+package client
+
+import (
+	"testing"
+)
+
+func TestNormalizeReceivedMessage(t *testing.T) {
+	testCases := []struct {
+		nameTest string
+		envelope string
+		check    func(message *ReceivedMessageV2) bool
+	}{
+		{
+			"group message",
+			`{"envelope":{"sourceNumber":"+492222","sourceUuid":"uuid-2","timestamp":1000,"dataMessage":{"message":"Hello","groupInfo":{"groupId":"abc"},"attachments":[{"id":"att1","contentType":"image/png"}],"quote":{"id":900,"authorUuid":"uuid-3","text":"Hi"}}},"account":"+491111"}`,
+			func(m *ReceivedMessageV2) bool {
+				return m.Type == "message" && m.Account == "+491111" && m.Sender.Number == "+492222" &&
+					m.GroupId == convertInternalGroupIdToGroupId("abc") && m.Message.Text == "Hello" &&
+					len(m.Message.Attachments) == 1 && m.Message.Attachments[0].Id == "att1" &&
+					m.Message.Quote.Author == "uuid-3" && m.Message.Quote.Timestamp == 900
+			},
+		},
+		{
+			"reaction",
+			`{"envelope":{"source":"+492222","timestamp":1000,"dataMessage":{"reaction":{"emoji":"👍","targetAuthorNumber":"+491111","targetSentTimestamp":900,"isRemove":true}}}}`,
+			func(m *ReceivedMessageV2) bool {
+				return m.Type == "reaction" && m.Account == "+491111" && m.Sender.Number == "+492222" && m.Message == nil &&
+					m.Reaction.Emoji == "👍" && m.Reaction.TargetAuthor == "+491111" && m.Reaction.TargetTimestamp == 900 && m.Reaction.Remove
+			},
+		},
+		{
+			"remote delete",
+			`{"envelope":{"sourceNumber":"+492222","timestamp":1000,"dataMessage":{"remoteDelete":{"timestamp":900}}}}`,
+			func(m *ReceivedMessageV2) bool {
+				return m.Type == "remote_delete" && m.RemoteDelete.TargetTimestamp == 900
+			},
+		},
+		{
+			"edit",
+			`{"envelope":{"sourceNumber":"+492222","timestamp":1000,"editMessage":{"targetSentTimestamp":900,"dataMessage":{"message":"Edited"}}}}`,
+			func(m *ReceivedMessageV2) bool {
+				return m.Type == "edit" && m.Edit.TargetTimestamp == 900 && m.Message.Text == "Edited"
+			},
+		},
+		{
+			"sync sent",
+			`{"envelope":{"sourceNumber":"+491111","timestamp":1000,"syncMessage":{"sentMessage":{"destinationUuid":"uuid-2","timestamp":1000,"message":"Sent elsewhere"}}}}`,
+			func(m *ReceivedMessageV2) bool {
+				return m.Type == "sync" && m.Sync.Destination == "uuid-2" && m.Message.Text == "Sent elsewhere"
+			},
+		},
+		{
+			"read receipt",
+			`{"envelope":{"sourceNumber":"+492222","timestamp":1000,"receiptMessage":{"isRead":true,"timestamps":[900,950]}}}`,
+			func(m *ReceivedMessageV2) bool {
+				return m.Type == "receipt" && m.Receipt.Type == "read" && len(m.Receipt.Timestamps) == 2
+			},
+		},
+		{
+			"typing",
+			`{"envelope":{"sourceNumber":"+492222","timestamp":1000,"typingMessage":{"action":"STARTED","timestamp":1000}}}`,
+			func(m *ReceivedMessageV2) bool {
+				return m.Type == "typing" && m.Typing.Action == "started" && m.GroupId == ""
+			},
+		},
+		{
+			"story",
+			`{"envelope":{"sourceNumber":"+492222","timestamp":1000,"storyMessage":{"allowsReplies":true,"textAttachment":{"text":"My story"}}}}`,
+			func(m *ReceivedMessageV2) bool {
+				return m.Type == "story" && m.Story.AllowsReplies && m.Story.Text == "My story" && m.Story.Attachment == nil
+			},
+		},
+		{
+			"call",
+			`{"envelope":{"sourceNumber":"+492222","timestamp":1000,"callMessage":{"hangupMessage":{"id":1}}}}`,
+			func(m *ReceivedMessageV2) bool {
+				return m.Type == "call" && m.Call.Type == "hangup"
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		message, err := NormalizeReceivedMessage("+491111", []byte(testCase.envelope))
+		if err != nil {
+			t.Errorf("%s: %s", testCase.nameTest, err.Error())
+			continue
+		}
+		if !testCase.check(message) {
+			t.Errorf("%s: unexpected result %+v", testCase.nameTest, *message)
+		}
+	}
+}
+
+func TestNormalizeReceivedMessageNoEnvelope(t *testing.T) {
+	_, err := NormalizeReceivedMessage("+491111", []byte(`{"account":"+491111"}`))
+	if err == nil {
+		t.Error("expected an error for data without an envelope")
+	}
+}
@@ -0,0 +1,287 @@
+package client
+
+import (
+	"strings"
+
+	utils "github.com/sheophe/signal-cli-rest-api/utils"
+)
+
+// ReceivedMessageV2 is the normalized format of a received envelope (format=v2). Unlike the envelopes of
+// signal-cli, the schema doesn't change with the signal-cli version. Depending on the type, one of the
+// message specific fields is set: message (for the types message, edit and sync), edit, reaction,
+// remote_delete, sync, receipt, typing, story or call.
+type ReceivedMessageV2 struct {
+	Account                 string          `json:"account"`
+	Type                    string          `json:"type" enums:"message,edit,reaction,remote_delete,sync,receipt,typing,story,call,other"`
+	Timestamp               int64           `json:"timestamp"`
+	ServerReceivedTimestamp int64           `json:"server_received_timestamp,omitempty"`
+	Sender                  SenderV2        `json:"sender"`
+	GroupId                 string          `json:"group_id,omitempty"`
+	Message                 *MessageV2      `json:"message,omitempty"`
+	Edit                    *EditV2         `json:"edit,omitempty"`
+	Reaction                *ReactionV2     `json:"reaction,omitempty"`
+	RemoteDelete            *RemoteDeleteV2 `json:"remote_delete,omitempty"`
+	Sync                    *SyncV2         `json:"sync,omitempty"`
+	Receipt                 *ReceiptV2      `json:"receipt,omitempty"`
+	Typing                  *TypingV2       `json:"typing,omitempty"`
+	Story                   *StoryV2        `json:"story,omitempty"`
+	Call                    *CallV2         `json:"call,omitempty"`
+}
+
+type SenderV2 struct {
+	Number string `json:"number,omitempty"`
+	Uuid   string `json:"uuid,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Device int    `json:"device,omitempty"`
+}
+
+type MessageV2 struct {
+	Text             string         `json:"text,omitempty"`
+	Attachments      []AttachmentV2 `json:"attachments,omitempty"`
+	Mentions         []MentionV2    `json:"mentions,omitempty"`
+	Quote            *QuoteV2       `json:"quote,omitempty"`
+	Sticker          *StickerV2     `json:"sticker,omitempty"`
+	ExpiresInSeconds int            `json:"expires_in_seconds,omitempty"`
+	ViewOnce         bool           `json:"view_once,omitempty"`
+}
+
+type AttachmentV2 struct {
+	Id          string `json:"id"`
+	ContentType string `json:"content_type,omitempty"`
+	Filename    string `json:"filename,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	Caption     string `json:"caption,omitempty"`
+}
+
+type MentionV2 struct {
+	Recipient string `json:"recipient"`
+	Name      string `json:"name,omitempty"`
+	Start     int    `json:"start"`
+	Length    int    `json:"length"`
+}
+
+type QuoteV2 struct {
+	Timestamp int64  `json:"timestamp"`
+	Author    string `json:"author"`
+	Text      string `json:"text,omitempty"`
+}
+
+type StickerV2 struct {
+	PackId    string `json:"pack_id"`
+	StickerId int    `json:"sticker_id"`
+}
+
+// EditV2 replaces the message with the target timestamp; the new content is in message.
+type EditV2 struct {
+	TargetTimestamp int64 `json:"target_timestamp"`
+}
+
+type ReactionV2 struct {
+	Emoji           string `json:"emoji"`
+	TargetAuthor    string `json:"target_author"`
+	TargetTimestamp int64  `json:"target_timestamp"`
+	Remove          bool   `json:"remove"`
+}
+
+type RemoteDeleteV2 struct {
+	TargetTimestamp int64 `json:"target_timestamp"`
+}
+
+// SyncV2 is a message that was sent from another device of the account; the content is in message
+// (or reaction/remote_delete), the recipient is either the destination or the group.
+type SyncV2 struct {
+	Destination string `json:"destination,omitempty"`
+}
+
+type ReceiptV2 struct {
+	Type       string  `json:"type" enums:"delivery,read,viewed"`
+	Timestamps []int64 `json:"timestamps"`
+}
+
+type TypingV2 struct {
+	Action string `json:"action" enums:"started,stopped"`
+}
+
+type StoryV2 struct {
+	AllowsReplies bool          `json:"allows_replies"`
+	Text          string        `json:"text,omitempty"`
+	Attachment    *AttachmentV2 `json:"attachment,omitempty"`
+}
+
+type CallV2 struct {
+	Type string `json:"type" enums:"offer,answer,busy,hangup,ice_update"`
+}
+
+// recipient returns the phone number or, if it is unknown, the uuid (or the legacy identifier) of a recipient.
+func recipient(number string, uuid string, legacy string) string {
+	if number != "" {
+		return number
+	}
+	if uuid != "" {
+		return uuid
+	}
+	return legacy
+}
+
+func toAttachmentV2(attachment *SignalCliAttachment) AttachmentV2 {
+	return AttachmentV2{
+		Id:          attachment.Id,
+		ContentType: attachment.ContentType,
+		Filename:    attachment.Filename,
+		Size:        attachment.Size,
+		Width:       attachment.Width,
+		Height:      attachment.Height,
+		Caption:     attachment.Caption,
+	}
+}
+
+func toMessageV2(dataMessage *SignalCliDataMessage) *MessageV2 {
+	message := &MessageV2{
+		ExpiresInSeconds: dataMessage.ExpiresInSeconds,
+		ViewOnce:         dataMessage.ViewOnce,
+	}
+	if dataMessage.Message != nil {
+		message.Text = *dataMessage.Message
+	}
+	for i := range dataMessage.Attachments {
+		message.Attachments = append(message.Attachments, toAttachmentV2(&dataMessage.Attachments[i]))
+	}
+	for _, mention := range dataMessage.Mentions {
+		message.Mentions = append(message.Mentions, MentionV2{
+			Recipient: recipient(mention.Number, mention.Uuid, ""),
+			Name:      mention.Name,
+			Start:     mention.Start,
+			Length:    mention.Length,
+		})
+	}
+	if dataMessage.Quote != nil {
+		message.Quote = &QuoteV2{
+			Timestamp: dataMessage.Quote.Id,
+			Author:    recipient(dataMessage.Quote.AuthorNumber, dataMessage.Quote.AuthorUuid, dataMessage.Quote.Author),
+			Text:      dataMessage.Quote.Text,
+		}
+	}
+	if dataMessage.Sticker != nil {
+		message.Sticker = &StickerV2{PackId: dataMessage.Sticker.PackId, StickerId: dataMessage.Sticker.StickerId}
+	}
+	return message
+}
+
+// setDataMessage fills in the content of a data message (which is either a message, a reaction or a remote delete).
+func (m *ReceivedMessageV2) setDataMessage(dataMessage *SignalCliDataMessage) {
+	if dataMessage.GroupInfo != nil && dataMessage.GroupInfo.GroupId != "" {
+		m.GroupId = convertInternalGroupIdToGroupId(dataMessage.GroupInfo.GroupId)
+	}
+
+	switch {
+	case dataMessage.Reaction != nil:
+		reaction := dataMessage.Reaction
+		m.Reaction = &ReactionV2{
+			Emoji:           reaction.Emoji,
+			TargetAuthor:    recipient(reaction.TargetAuthorNumber, reaction.TargetAuthorUuid, reaction.TargetAuthor),
+			TargetTimestamp: reaction.TargetSentTimestamp,
+			Remove:          reaction.IsRemove,
+		}
+	case dataMessage.RemoteDelete != nil:
+		m.RemoteDelete = &RemoteDeleteV2{TargetTimestamp: dataMessage.RemoteDelete.Timestamp}
+	default:
+		m.Message = toMessageV2(dataMessage)
+	}
+}
+
+// ToV2 converts the envelope into the normalized format.
+func (r *SignalCliReceivedMessage) ToV2(number string) ReceivedMessageV2 {
+	envelope := &r.Envelope
+	message := ReceivedMessageV2{
+		Account:                 r.Account,
+		Type:                    envelope.MessageType(),
+		Timestamp:               envelope.Timestamp,
+		ServerReceivedTimestamp: envelope.ServerReceivedTimestamp,
+		Sender: SenderV2{
+			Number: envelope.SourceNumber,
+			Uuid:   envelope.SourceUuid,
+			Name:   envelope.SourceName,
+			Device: envelope.SourceDevice,
+		},
+	}
+	if message.Account == "" {
+		message.Account = number
+	}
+	if message.Sender.Number == "" && message.Sender.Uuid == "" {
+		message.Sender.Number = envelope.Source
+	}
+
+	switch message.Type {
+	case utils.MessageTypeEdit:
+		message.Edit = &EditV2{TargetTimestamp: envelope.EditMessage.TargetSentTimestamp}
+		if envelope.EditMessage.DataMessage != nil {
+			message.setDataMessage(envelope.EditMessage.DataMessage)
+		}
+	case utils.MessageTypeMessage, utils.MessageTypeReaction, utils.MessageTypeRemoteDelete:
+		message.setDataMessage(envelope.DataMessage)
+	case utils.MessageTypeSync:
+		if sentMessage := envelope.SyncMessage.SentMessage; sentMessage != nil {
+			message.Sync = &SyncV2{
+				Destination: recipient(sentMessage.DestinationNumber, sentMessage.DestinationUuid, sentMessage.Destination),
+			}
+			message.setDataMessage(&sentMessage.SignalCliDataMessage)
+		}
+	case utils.MessageTypeReceipt:
+		receipt := envelope.ReceiptMessage
+		message.Receipt = &ReceiptV2{Type: "delivery", Timestamps: receipt.Timestamps}
+		if receipt.IsRead {
+			message.Receipt.Type = "read"
+		} else if receipt.IsViewed {
+			message.Receipt.Type = "viewed"
+		}
+		if message.Receipt.Timestamps == nil {
+			message.Receipt.Timestamps = []int64{}
+		}
+	case utils.MessageTypeTyping:
+		message.Typing = &TypingV2{Action: strings.ToLower(envelope.TypingMessage.Action)}
+		if envelope.TypingMessage.GroupId != "" {
+			message.GroupId = convertInternalGroupIdToGroupId(envelope.TypingMessage.GroupId)
+		}
+	case utils.MessageTypeStory:
+		story := envelope.StoryMessage
+		message.Story = &StoryV2{AllowsReplies: story.AllowsReplies}
+		if story.TextAttachment != nil {
+			message.Story.Text = story.TextAttachment.Text
+		}
+		if story.FileAttachment != nil {
+			attachment := toAttachmentV2(story.FileAttachment)
+			message.Story.Attachment = &attachment
+		}
+		if story.GroupId != "" {
+			message.GroupId = convertInternalGroupIdToGroupId(story.GroupId)
+		}
+	case utils.MessageTypeCall:
+		call := envelope.CallMessage
+		message.Call = &CallV2{}
+		switch {
+		case call.OfferMessage != nil:
+			message.Call.Type = "offer"
+		case call.AnswerMessage != nil:
+			message.Call.Type = "answer"
+		case call.BusyMessage != nil:
+			message.Call.Type = "busy"
+		case call.HangupMessage != nil:
+			message.Call.Type = "hangup"
+		default:
+			message.Call.Type = "ice_update"
+		}
+	}
+	return message
+}
+
+// NormalizeReceivedMessage converts an envelope as reported by signal-cli into the normalized format.
+func NormalizeReceivedMessage(number string, data []byte) (*ReceivedMessageV2, error) {
+	received, err := ParseReceivedMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	message := received.ToV2(number)
+	return &message, nil
+}
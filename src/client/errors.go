@@ -1,5 +1,69 @@
 package client
 
+import (
+	"errors"
+	"reflect"
+	"regexp"
+	"strconv"
+)
+
+// exit codes of signal-cli (see https://github.com/AsamK/signal-cli/blob/master/man/signal-cli.1.adoc#exit-codes).
+// In json-rpc mode, the same errors are reported with the negated exit code as error code.
+const (
+	signalCliUserError         = 1
+	signalCliUnexpectedError   = 2
+	signalCliIoError           = 3
+	signalCliUntrustedKeyError = 4
+	signalCliRateLimitError    = 5
+)
+
+// json-rpc error code signal-cli uses for unexpected exceptions
+const jsonRpcInternalError = -32603
+
+// signal-cli reports a proof required failure like this:
+// CAPTCHA proof required for sending to "+49...", available options "[RECAPTCHA]" with challenge token "...", or wait "86400" seconds.
+var proofRequiredRegex = regexp.MustCompile(`proof required.*challenge token "([^"]+)"(?:, or wait "(\d+)" seconds)?`)
+
+var rateLimitRegex = regexp.MustCompile(`(?i)rate[ -]?limit`)
+
+var untrustedIdentityRegex = regexp.MustCompile(`(?i)untrusted (identity|key)`)
+
+// e.g. Untrusted Identity for "+49..."
+var untrustedIdentityRecipientRegex = regexp.MustCompile(`(?i)untrusted identity for "([^"]+)"`)
+
+var unregisteredRecipientRegex = regexp.MustCompile(`(?i)unregistered user|not a signal user`)
+
+var groupNotFoundRegex = regexp.MustCompile(`(?i)group not found|unknown group|group id .* not found`)
+
+var accountNotLoggedInRegex = regexp.MustCompile(`(?i)user \S+ is not registered|account does not exist|no local data found`)
+
+var signalCliCrashRegex = regexp.MustCompile(`Exception in thread|java\.lang\.\w+(Exception|Error)`)
+
+// SendFailedError is returned when sending failed for all recipients of a message. In case it failed
+// for all of them for the same reason (i.e. with the same type of error), it wraps the first of the
+// errors, so that the type is kept.
+type SendFailedError struct {
+	Description string
+	Err         error
+}
+
+func (e *SendFailedError) Error() string {
+	return e.Description
+}
+
+func (e *SendFailedError) Unwrap() error {
+	return e.Err
+}
+
+func newSendFailedError(description string, errs []error) *SendFailedError {
+	for _, err := range errs[1:] {
+		if reflect.TypeOf(err) != reflect.TypeOf(errs[0]) {
+			return &SendFailedError{Description: description}
+		}
+	}
+	return &SendFailedError{Description: description, Err: errs[0]}
+}
+
 type InvalidNameError struct {
 	Description string
 }
@@ -23,3 +87,119 @@ type InternalError struct {
 func (e *InternalError) Error() string {
 	return e.Description
 }
+
+type AttachmentTooLargeError struct {
+	Description string
+}
+
+func (e *AttachmentTooLargeError) Error() string {
+	return e.Description
+}
+
+// RateLimitError is returned when Signal rate limited the account. In case Signal requires a proof
+// (i.e. a captcha), ChallengeToken is set and can be submitted with SubmitRateLimitChallenge.
+// RetryAfter is the number of seconds after which it can be tried again, 0 if unknown.
+type RateLimitError struct {
+	Description    string
+	ChallengeToken string
+	RetryAfter     int
+}
+
+func (e *RateLimitError) Error() string {
+	return e.Description
+}
+
+// UnregisteredRecipientError is returned when a recipient isn't registered with Signal.
+type UnregisteredRecipientError struct {
+	Description string
+}
+
+func (e *UnregisteredRecipientError) Error() string {
+	return e.Description
+}
+
+// UntrustedIdentityError is returned when the identity of a recipient changed and isn't trusted yet.
+type UntrustedIdentityError struct {
+	Description string
+	Identities  []UntrustedIdentity
+}
+
+func (e *UntrustedIdentityError) Error() string {
+	return e.Description
+}
+
+type GroupNotFoundError struct {
+	Description string
+}
+
+func (e *GroupNotFoundError) Error() string {
+	return e.Description
+}
+
+// AccountNotLoggedInError is returned when the number isn't registered or linked with this instance.
+type AccountNotLoggedInError struct {
+	Description string
+}
+
+func (e *AccountNotLoggedInError) Error() string {
+	return e.Description
+}
+
+// TimeoutError is returned when signal-cli didn't answer in time.
+type TimeoutError struct {
+	Description string
+}
+
+func (e *TimeoutError) Error() string {
+	return e.Description
+}
+
+// SignalCliCrashError is returned when signal-cli failed unexpectedly (e.g. with an uncaught exception).
+type SignalCliCrashError struct {
+	Description string
+}
+
+func (e *SignalCliCrashError) Error() string {
+	return e.Description
+}
+
+// parseSignalCliError converts an error reported by signal-cli into one of the error types above. exitCode
+// is the exit code of signal-cli (0 if unknown); the description is matched as well, as signal-cli doesn't
+// have dedicated exit codes for all kinds of errors. Errors that can't be classified are returned as they are.
+func parseSignalCliError(description string, exitCode int) error {
+	if match := proofRequiredRegex.FindStringSubmatch(description); match != nil {
+		retryAfter, _ := strconv.Atoi(match[2])
+		return &RateLimitError{Description: description, ChallengeToken: match[1], RetryAfter: retryAfter}
+	}
+
+	switch {
+	case exitCode == signalCliRateLimitError || rateLimitRegex.MatchString(description):
+		return &RateLimitError{Description: description}
+	case exitCode == signalCliUntrustedKeyError || untrustedIdentityRegex.MatchString(description):
+		identities := []UntrustedIdentity{}
+		for _, match := range untrustedIdentityRecipientRegex.FindAllStringSubmatch(description, -1) {
+			identities = append(identities, UntrustedIdentity{Recipient: match[1]})
+		}
+		return &UntrustedIdentityError{Description: description, Identities: identities}
+	case unregisteredRecipientRegex.MatchString(description):
+		return &UnregisteredRecipientError{Description: description}
+	case groupNotFoundRegex.MatchString(description):
+		return &GroupNotFoundError{Description: description}
+	case accountNotLoggedInRegex.MatchString(description):
+		return &AccountNotLoggedInError{Description: description}
+	case exitCode == signalCliUnexpectedError || signalCliCrashRegex.MatchString(description):
+		return &SignalCliCrashError{Description: description}
+	}
+	return errors.New(description)
+}
+
+// parseJsonRpcError converts an error response of the signal-cli json-rpc daemon into a typed error.
+func parseJsonRpcError(e Error) error {
+	exitCode := 0
+	if e.Code < 0 && e.Code >= -signalCliRateLimitError {
+		exitCode = -e.Code
+	} else if e.Code == jsonRpcInternalError {
+		exitCode = signalCliUnexpectedError
+	}
+	return parseSignalCliError(e.Message, exitCode)
+}
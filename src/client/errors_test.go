@@ -0,0 +1,77 @@
+package client
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseSignalCliErrorProofRequired(t *testing.T) {
+	err := parseSignalCliError(`CAPTCHA proof required for sending to "+4912345678", available options "[RECAPTCHA, PUSH_CHALLENGE]" with challenge token "c8f3e1d2-token", or wait "86400" seconds.`, signalCliRateLimitError)
+
+	var rateLimitError *RateLimitError
+	if !errors.As(err, &rateLimitError) {
+		t.Fatalf("expected a RateLimitError, got %v", err)
+	}
+	if rateLimitError.ChallengeToken != "c8f3e1d2-token" {
+		t.Errorf("expected challenge token c8f3e1d2-token, got %s", rateLimitError.ChallengeToken)
+	}
+	if rateLimitError.RetryAfter != 86400 {
+		t.Errorf("expected retry after 86400, got %d", rateLimitError.RetryAfter)
+	}
+}
+
+func TestParseSignalCliErrorRateLimited(t *testing.T) {
+	err := parseSignalCliError("Failed to send message due to rate limiting", 0)
+
+	var rateLimitError *RateLimitError
+	if !errors.As(err, &rateLimitError) {
+		t.Fatalf("expected a RateLimitError, got %v", err)
+	}
+	if rateLimitError.ChallengeToken != "" || rateLimitError.RetryAfter != 0 {
+		t.Errorf("expected no challenge token and retry after, got %+v", rateLimitError)
+	}
+}
+
+func TestParseSignalCliError(t *testing.T) {
+	tests := []struct {
+		description string
+		exitCode    int
+		expected    error
+	}{
+		{`Failed to send message: Unregistered user "+4912345678"`, signalCliUserError, &UnregisteredRecipientError{}},
+		{`Untrusted Identity for "+4912345678"`, 0, &UntrustedIdentityError{}},
+		{"Failed to send message", signalCliUntrustedKeyError, &UntrustedIdentityError{}},
+		{"Failed to send message", signalCliRateLimitError, &RateLimitError{}},
+		{"Group not found: abc", signalCliUserError, &GroupNotFoundError{}},
+		{"User +4912345678 is not registered.", signalCliUserError, &AccountNotLoggedInError{}},
+		{"Error while sending", signalCliUnexpectedError, &SignalCliCrashError{}},
+		{`Exception in thread "main" java.lang.NullPointerException`, 0, &SignalCliCrashError{}},
+	}
+
+	for _, test := range tests {
+		err := parseSignalCliError(test.description, test.exitCode)
+		if reflect.TypeOf(err) != reflect.TypeOf(test.expected) {
+			t.Errorf("%q (exit code %d): expected %T, got %T", test.description, test.exitCode, test.expected, err)
+		}
+		if err.Error() != test.description {
+			t.Errorf("%q: expected the description to be kept, got %q", test.description, err.Error())
+		}
+	}
+}
+
+func TestParseSignalCliErrorOtherError(t *testing.T) {
+	err := parseSignalCliError("Invalid group id", signalCliUserError)
+	if reflect.TypeOf(err) != reflect.TypeOf(errors.New("")) || err.Error() != "Invalid group id" {
+		t.Errorf("expected an untyped error, got %T: %v", err, err)
+	}
+}
+
+func TestParseJsonRpcError(t *testing.T) {
+	if _, ok := parseJsonRpcError(Error{Code: -signalCliUntrustedKeyError, Message: "Failed to send message"}).(*UntrustedIdentityError); !ok {
+		t.Error("expected an UntrustedIdentityError for error code -4")
+	}
+	if _, ok := parseJsonRpcError(Error{Code: jsonRpcInternalError, Message: "Unexpected error"}).(*SignalCliCrashError); !ok {
+		t.Error("expected a SignalCliCrashError for an internal error")
+	}
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// receiveInbox buffers the messages that are received in json-rpc mode while nobody listens on the
+// websocket, so that they can be fetched later on. In case the inbox is full, the oldest message is dropped.
+type receiveInbox struct {
+	number   string
+	maxSize  int
+	messages []JsonRpc2ReceivedMessage
+	// closed (and replaced) whenever a new message arrives
+	notify chan struct{}
+	mutex  sync.Mutex
+}
+
+func newReceiveInbox(number string, maxSize int) *receiveInbox {
+	return &receiveInbox{
+		number:  number,
+		maxSize: maxSize,
+		notify:  make(chan struct{}),
+	}
+}
+
+func (i *receiveInbox) push(message JsonRpc2ReceivedMessage) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if len(i.messages) >= i.maxSize {
+		log.Warn("Receive inbox of ", i.number, " is full - dropping the oldest message")
+		i.messages = i.messages[1:]
+	}
+	i.messages = append(i.messages, message)
+
+	close(i.notify)
+	i.notify = make(chan struct{})
+}
+
+// drain takes the messages out of the inbox the same way signal-cli's receive command does: it returns once
+// no new message arrived for timeout (a negative timeout waits forever) or maxMessages messages were
+// received (0 means no limit). If match is set, only the matching messages are returned and counted; the
+// other ones are taken out of the inbox as well (i.e. they are discarded).
+func (i *receiveInbox) drain(ctx context.Context, timeout time.Duration, maxMessages int, match func(message *JsonRpc2ReceivedMessage) bool) []JsonRpc2ReceivedMessage {
+	messages := []JsonRpc2ReceivedMessage{}
+
+	var timeoutChannel <-chan time.Time
+	var timer *time.Timer
+	if timeout >= 0 {
+		timer = time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutChannel = timer.C
+	}
+
+	for {
+		i.mutex.Lock()
+		n := 0
+		for n < len(i.messages) && (maxMessages <= 0 || len(messages) < maxMessages) {
+			if match == nil || match(&i.messages[n]) {
+				messages = append(messages, i.messages[n])
+			}
+			n++
+		}
+		i.messages = i.messages[n:]
+		notify := i.notify
+		i.mutex.Unlock()
+
+		if maxMessages > 0 && len(messages) >= maxMessages {
+			return messages
+		}
+
+		if n > 0 && timer != nil {
+			// the timeout starts again after every received message
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(timeout)
+		}
+
+		select {
+		case <-notify:
+		case <-timeoutChannel:
+			return messages
+		case <-ctx.Done():
+			return messages
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func inboxMessage(i int) JsonRpc2ReceivedMessage {
+	params, _ := json.Marshal(map[string]int{"i": i})
+	return JsonRpc2ReceivedMessage{Method: "receive", Params: params}
+}
+
+func TestReceiveInboxDropsOldestMessage(t *testing.T) {
+	inbox := newReceiveInbox("+4912345678", 2)
+	for i := 0; i < 3; i++ {
+		inbox.push(inboxMessage(i))
+	}
+
+	messages := inbox.drain(context.Background(), 0, 0, nil)
+	if len(messages) != 2 || string(messages[0].Params) != `{"i":1}` || string(messages[1].Params) != `{"i":2}` {
+		t.Errorf("expected the two newest messages, got %v", messages)
+	}
+}
+
+func TestReceiveInboxMaxMessages(t *testing.T) {
+	inbox := newReceiveInbox("+4912345678", 10)
+	for i := 0; i < 3; i++ {
+		inbox.push(inboxMessage(i))
+	}
+
+	messages := inbox.drain(context.Background(), time.Second, 2, nil)
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+
+	messages = inbox.drain(context.Background(), 0, 0, nil)
+	if len(messages) != 1 || string(messages[0].Params) != `{"i":2}` {
+		t.Errorf("expected the remaining message, got %v", messages)
+	}
+}
+
+func TestReceiveInboxMatch(t *testing.T) {
+	inbox := newReceiveInbox("+4912345678", 10)
+	for i := 0; i < 5; i++ {
+		inbox.push(inboxMessage(i))
+	}
+
+	odd := func(message *JsonRpc2ReceivedMessage) bool {
+		var params map[string]int
+		json.Unmarshal(message.Params, &params)
+		return params["i"]%2 == 1
+	}
+	messages := inbox.drain(context.Background(), time.Second, 2, odd)
+	if len(messages) != 2 || string(messages[0].Params) != `{"i":1}` || string(messages[1].Params) != `{"i":3}` {
+		t.Fatalf("expected the two matching messages, got %v", messages)
+	}
+
+	// the messages that didn't match were consumed as well
+	messages = inbox.drain(context.Background(), 0, 0, nil)
+	if len(messages) != 1 || string(messages[0].Params) != `{"i":4}` {
+		t.Errorf("expected the message after the last match only, got %v", messages)
+	}
+}
+
+func TestReceiveInboxWaitsForNewMessages(t *testing.T) {
+	inbox := newReceiveInbox("+4912345678", 10)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		inbox.push(inboxMessage(0))
+	}()
+
+	messages := inbox.drain(context.Background(), time.Second, 1, nil)
+	if len(messages) != 1 {
+		t.Errorf("expected the message that arrived while waiting, got %v", messages)
+	}
+}
+
+func TestReceiveInboxTimeout(t *testing.T) {
+	inbox := newReceiveInbox("+4912345678", 10)
+
+	start := time.Now()
+	messages := inbox.drain(context.Background(), 50*time.Millisecond, 0, nil)
+	if len(messages) != 0 {
+		t.Errorf("expected no messages, got %v", messages)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("expected drain to wait for the timeout")
+	}
+}
+
+func TestReceiveInboxCancel(t *testing.T) {
+	inbox := newReceiveInbox("+4912345678", 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	messages := inbox.drain(ctx, -1, 0, nil)
+	if len(messages) != 0 {
+		t.Errorf("expected no messages, got %v", messages)
+	}
+}
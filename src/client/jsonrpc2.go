@@ -37,20 +37,45 @@ type JsonRpc2Client struct {
 	sub                      string
 	stop                     chan struct{}
 	receivedMessageResponses chan JsonRpc2MessageResponse
-	receivedMessages         chan JsonRpc2ReceivedMessage
 	lastTimeErrorMessageSent time.Time
 	signalCliApiConfig       *utils.SignalCliApiConfig
 	number                   string
 	tcpPort                  int64
 	loggedIn                 bool
+	inbox                    *receiveInbox
+	hub                      *receiveHub
+	// called for every received envelope
+	onReceive func(number string, data []byte)
 }
 
-func NewJsonRpc2Client(signalCliApiConfig *utils.SignalCliApiConfig, number string, tcpPort int64, sub string) *JsonRpc2Client {
+func NewJsonRpc2Client(signalCliApiConfig *utils.SignalCliApiConfig, number string, tcpPort int64, sub string,
+	onReceive func(number string, data []byte)) *JsonRpc2Client {
+	inboxSize, err := utils.GetIntEnv("RECEIVE_INBOX_SIZE", 1000)
+	if err != nil || inboxSize < 1 {
+		log.Error("Env variable 'RECEIVE_INBOX_SIZE' contains an invalid value...falling back to default (1000)")
+		inboxSize = 1000
+	}
+
+	replayBufferSize, err := utils.GetIntEnv("RECEIVE_REPLAY_BUFFER_SIZE", 1000)
+	if err != nil || replayBufferSize < 1 {
+		log.Error("Env variable 'RECEIVE_REPLAY_BUFFER_SIZE' contains an invalid value...falling back to default (1000)")
+		replayBufferSize = 1000
+	}
+
+	subscriberBufferSize, err := utils.GetIntEnv("RECEIVE_SUBSCRIBER_BUFFER_SIZE", 100)
+	if err != nil || subscriberBufferSize < 1 {
+		log.Error("Env variable 'RECEIVE_SUBSCRIBER_BUFFER_SIZE' contains an invalid value...falling back to default (100)")
+		subscriberBufferSize = 100
+	}
+
 	return &JsonRpc2Client{
 		signalCliApiConfig: signalCliApiConfig,
 		number:             number,
 		tcpPort:            tcpPort,
 		sub:                sub,
+		inbox:              newReceiveInbox(number, inboxSize),
+		hub:                newReceiveHub(number, replayBufferSize, subscriberBufferSize),
+		onReceive:          onReceive,
 	}
 }
 
@@ -62,7 +87,6 @@ func (r *JsonRpc2Client) Dial() error {
 	}
 
 	r.receivedMessageResponses = make(chan JsonRpc2MessageResponse)
-	r.receivedMessages = make(chan JsonRpc2ReceivedMessage)
 
 	return nil
 }
@@ -137,7 +161,7 @@ func (r *JsonRpc2Client) getRaw(command string, args interface{}, ctx context.Co
 	}
 
 	if resp.Err.Code != 0 {
-		return "", errors.New(resp.Err.Message)
+		return "", parseJsonRpcError(resp.Err)
 	}
 	return string(resp.Result), nil
 }
@@ -148,7 +172,7 @@ func (r *JsonRpc2Client) ReceiveData(number string) {
 		select {
 		case <-r.stop:
 			close(r.receivedMessageResponses)
-			close(r.receivedMessages)
+			r.hub.closeSubscriptions()
 			return
 		default:
 			str, err := connbuf.ReadString('\n')
@@ -164,11 +188,12 @@ func (r *JsonRpc2Client) ReceiveData(number string) {
 			var resp1 JsonRpc2ReceivedMessage
 			json.Unmarshal([]byte(str), &resp1)
 			if resp1.Method == "receive" {
-				select {
-				case r.receivedMessages <- resp1:
-					log.Debug("Message sent to golang channel")
-				default:
-					log.Debug("Couldn't send message to golang channel, as there's no receiver")
+				if resp1.Err.Code == 0 && r.onReceive != nil {
+					r.onReceive(number, resp1.Params)
+				}
+				if r.hub.publish(resp1) == 0 {
+					r.inbox.push(resp1)
+					log.Debug("No subscriber connected, message stored in inbox")
 				}
 				continue
 			}
@@ -186,8 +211,14 @@ func (r *JsonRpc2Client) ReceiveData(number string) {
 	}
 }
 
-func (r *JsonRpc2Client) GetReceiveChannel() chan JsonRpc2ReceivedMessage {
-	return r.receivedMessages
+// Subscribe subscribes to the received messages; see receiveHub.subscribe.
+func (r *JsonRpc2Client) Subscribe(cursor *uint64) (*ReceiveSubscription, bool) {
+	return r.hub.subscribe(cursor)
+}
+
+// ReceiveFromInbox returns the messages that were received while no subscriber was connected; see receiveInbox.drain.
+func (r *JsonRpc2Client) ReceiveFromInbox(ctx context.Context, timeout time.Duration, maxMessages int, match func(message *JsonRpc2ReceivedMessage) bool) []JsonRpc2ReceivedMessage {
+	return r.inbox.drain(ctx, timeout, maxMessages, match)
 }
 
 func (r *JsonRpc2Client) Start() error {
@@ -0,0 +1,210 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/html"
+
+	utils "github.com/sheophe/signal-cli-rest-api/utils"
+)
+
+// maximum number of bytes of a web page that are parsed for Open Graph metadata
+const linkPreviewMaxPageSize = 1024 * 1024
+
+var linkPreviewUrlRegex = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+type LinkPreview struct {
+	Url         string `json:"url"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Base64Image string `json:"base64_image" example:"<BASE64 ENCODED DATA>,data:<MIME-TYPE>;base64<comma><BASE64 ENCODED DATA>"`
+}
+
+type linkPreviewEntry struct {
+	Url         string
+	Title       string
+	Description string
+	Image       *AttachmentEntry
+}
+
+func (l *linkPreviewEntry) cleanUp() {
+	if l != nil && l.Image != nil {
+		l.Image.cleanUp()
+	}
+}
+
+// prepareLinkPreview stores the image of the given link preview as temporary file. If no link preview is
+// given and AUTO_LINK_PREVIEW is enabled, the preview is built from the Open Graph metadata of the first
+// url in the message instead. The returned entry (if any) needs to be cleaned up by the caller.
+func (s *SignalClient) prepareLinkPreview(message string, linkPreview *LinkPreview) (*linkPreviewEntry, error) {
+	if linkPreview == nil {
+		if utils.GetEnv("AUTO_LINK_PREVIEW", "false") != "true" {
+			return nil, nil
+		}
+
+		previewUrl := linkPreviewUrlRegex.FindString(message)
+		if previewUrl == "" {
+			return nil, nil
+		}
+
+		entry, err := s.fetchLinkPreview(previewUrl)
+		if err != nil {
+			// a missing preview shouldn't prevent the message from being sent
+			log.Warn("Couldn't create link preview for ", previewUrl, ": ", err.Error())
+			return nil, nil
+		}
+		return entry, nil
+	}
+
+	if linkPreview.Url == "" {
+		return nil, errors.New("Please provide the url of the link preview")
+	}
+
+	if !strings.Contains(message, linkPreview.Url) {
+		return nil, errors.New("The url of the link preview needs to be part of the message")
+	}
+
+	entry := &linkPreviewEntry{Url: linkPreview.Url, Title: linkPreview.Title, Description: linkPreview.Description}
+	if linkPreview.Base64Image != "" {
+		image := NewAttachmentEntry(linkPreview.Base64Image, s.attachmentTmpDir)
+		err := image.storeBase64AsTemporaryFile()
+		if err != nil {
+			return nil, err
+		}
+		entry.Image = image
+	}
+	return entry, nil
+}
+
+func (s *SignalClient) fetchLinkPreview(previewUrl string) (*linkPreviewEntry, error) {
+	u, err := url.Parse(previewUrl)
+	if err != nil || u.Host == "" {
+		return nil, errors.New("Invalid url")
+	}
+
+	fetcher := newAttachmentUrlFetcher()
+	err = fetcher.checkUrl(u)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := fetcher.client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Unexpected status code " + resp.Status)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, errors.New("No html page")
+	}
+
+	entry := parseOpenGraphMetadata(io.LimitReader(resp.Body, linkPreviewMaxPageSize))
+	if entry.Title == "" {
+		return nil, errors.New("No title found")
+	}
+	entry.Url = previewUrl
+
+	if imageUrl, ok := entry.imageUrl(resp.Request.URL); ok {
+		image, err := fetcher.fetch(imageUrl, s.attachmentTmpDir)
+		if err != nil {
+			log.Warn("Couldn't fetch link preview image ", imageUrl, ": ", err.Error())
+		} else {
+			entry.Image = image
+		}
+	}
+	return &entry.linkPreviewEntry, nil
+}
+
+type openGraphMetadata struct {
+	linkPreviewEntry
+	rawImageUrl string
+}
+
+// imageUrl resolves the (possibly relative) og:image url against the url of the page.
+func (o *openGraphMetadata) imageUrl(pageUrl *url.URL) (string, bool) {
+	if o.rawImageUrl == "" {
+		return "", false
+	}
+	u, err := pageUrl.Parse(o.rawImageUrl)
+	if err != nil {
+		return "", false
+	}
+	return u.String(), true
+}
+
+// parseOpenGraphMetadata extracts og:title, og:description and og:image from the head of a html page.
+// In case there are no Open Graph tags, the title element and the description meta tag are used.
+func parseOpenGraphMetadata(reader io.Reader) openGraphMetadata {
+	var o openGraphMetadata
+	var fallbackTitle, fallbackDescription string
+	inTitle := false
+
+	tokenizer := html.NewTokenizer(reader)
+parse:
+	for {
+		tokenType := tokenizer.Next()
+		switch tokenType {
+		case html.ErrorToken:
+			break parse
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.Data {
+			case "title":
+				inTitle = tokenType == html.StartTagToken
+			case "body":
+				// all relevant metadata is in the head
+				break parse
+			case "meta":
+				var property, content string
+				for _, attr := range token.Attr {
+					switch strings.ToLower(attr.Key) {
+					case "property", "name":
+						property = strings.ToLower(attr.Val)
+					case "content":
+						content = strings.TrimSpace(attr.Val)
+					}
+				}
+				switch property {
+				case "og:title":
+					o.Title = content
+				case "og:description":
+					o.Description = content
+				case "og:image", "og:image:url":
+					if o.rawImageUrl == "" {
+						o.rawImageUrl = content
+					}
+				case "description":
+					fallbackDescription = content
+				}
+			}
+		case html.EndTagToken:
+			if tokenizer.Token().Data == "title" {
+				inTitle = false
+			}
+		case html.TextToken:
+			if inTitle && fallbackTitle == "" {
+				fallbackTitle = string(tokenizer.Text())
+			}
+		}
+	}
+
+	if o.Title == "" {
+		o.Title = strings.TrimSpace(fallbackTitle)
+	}
+	if o.Description == "" {
+		o.Description = fallbackDescription
+	}
+	return o
+}
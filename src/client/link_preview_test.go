@@ -0,0 +1,50 @@
+package client
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_parseOpenGraphMetadata(t *testing.T) {
+	testCases := []struct {
+		nameTest            string
+		page                string
+		titleExpected       string
+		descriptionExpected string
+		imageExpected       string
+	}{
+		{
+			"open graph tags",
+			`<html><head><title>Fallback</title><meta property="og:title" content="Dashboard"><meta property="og:description" content="CPU usage"><meta property="og:image" content="/img/cpu.png"></head></html>`,
+			"Dashboard", "CPU usage", "/img/cpu.png",
+		},
+		{
+			"fallback to title and description",
+			`<html><head><title> Fallback </title><meta name="description" content="Some page"></head><body></body></html>`,
+			"Fallback", "Some page", "",
+		},
+		{
+			"tags in body are ignored",
+			`<html><head></head><body><meta property="og:title" content="Body"></body></html>`,
+			"", "", "",
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.nameTest, func(t *testing.T) {
+			o := parseOpenGraphMetadata(strings.NewReader(tt.page))
+
+			if o.Title != tt.titleExpected {
+				t.Errorf("Title got \"%v\", want \"%v\"", o.Title, tt.titleExpected)
+			}
+
+			if o.Description != tt.descriptionExpected {
+				t.Errorf("Description got \"%v\", want \"%v\"", o.Description, tt.descriptionExpected)
+			}
+
+			if o.rawImageUrl != tt.imageExpected {
+				t.Errorf("rawImageUrl got \"%v\", want \"%v\"", o.rawImageUrl, tt.imageExpected)
+			}
+		})
+	}
+}
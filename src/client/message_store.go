@@ -0,0 +1,132 @@
+package client
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	utils "github.com/sheophe/signal-cli-rest-api/utils"
+)
+
+// size of the queue of received messages that still need to be stored; if it is full, receiving waits
+const messageStoreQueueSize = 1024
+
+// maximum number of messages that are stored in one transaction
+const messageStoreBatchSize = 100
+
+// newStoredMessage converts an envelope (as reported by signal-cli) into a message that can be stored.
+func newStoredMessage(number string, data []byte) (*utils.StoredMessage, error) {
+	received, err := ParseReceivedMessage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := &received.Envelope
+	message := &utils.StoredMessage{
+		Account:   received.Account,
+		Sender:    envelope.Sender(),
+		Timestamp: envelope.Timestamp,
+		Type:      envelope.MessageType(),
+		GroupId:   envelope.GroupId(),
+		Envelope:  string(data),
+	}
+	if message.Account == "" {
+		message.Account = number
+	}
+
+	if dataMessage := envelope.content(); dataMessage != nil {
+		if dataMessage.Message != nil {
+			message.Message = *dataMessage.Message
+		}
+	}
+	return message, nil
+}
+
+// storeReceivedMessage persists a received envelope. Failures are only logged, as they mustn't
+// prevent the message from being delivered.
+func (s *SignalClient) storeReceivedMessage(number string, data []byte) {
+	message, err := newStoredMessage(number, data)
+	if err != nil {
+		log.Debug("Not storing received data of ", number, ": ", err.Error())
+		return
+	}
+	s.storeMessage(message)
+}
+
+// storeMessage hands a received message over to the goroutine that stores the messages, so that
+// receiving doesn't wait for the database.
+func (s *SignalClient) storeMessage(message *utils.StoredMessage) {
+	if s.messageStoreQueue == nil {
+		return
+	}
+	s.messageStoreQueue <- message
+}
+
+// storeMessages stores the queued messages. All messages that are queued at once are stored in one
+// transaction, up to messageStoreBatchSize.
+func (s *SignalClient) storeMessages() {
+	for message := range s.messageStoreQueue {
+		messages := []*utils.StoredMessage{message}
+	batch:
+		for len(messages) < messageStoreBatchSize {
+			select {
+			case message := <-s.messageStoreQueue:
+				messages = append(messages, message)
+			default:
+				break batch
+			}
+		}
+
+		err := s.messageStorage.StoreMessages(messages)
+		if err != nil {
+			log.Error("Couldn't store ", len(messages), " received message(s): ", err.Error())
+		}
+	}
+}
+
+// GetMessages returns the stored messages of a number.
+func (s *SignalClient) GetMessages(filter utils.MessageFilter) ([]utils.StoredMessage, string, error) {
+	if s.messageStorage == nil {
+		return nil, "", &InternalError{Description: "message storage not available"}
+	}
+	return s.messageStorage.GetMessages(filter)
+}
+
+// GetMessagesSince returns the stored messages of a number that come after the given timestamp (in milliseconds)
+// and id (see utils.MessageStorage.GetMessagesSince), oldest first.
+func (s *SignalClient) GetMessagesSince(number string, timestamp int64, id uint, limit int) ([]utils.StoredMessage, error) {
+	if s.messageStorage == nil {
+		return nil, &InternalError{Description: "message storage not available"}
+	}
+	return s.messageStorage.GetMessagesSince(number, timestamp, id, limit)
+}
+
+// DeleteExpiredMessages deletes the stored messages that are older than the retention period of their number.
+// The retention period (in days) can be set per number; defaultRetentionDays is used for all other numbers.
+// A retention period of 0 keeps the messages forever.
+func (s *SignalClient) DeleteExpiredMessages(defaultRetentionDays int) error {
+	accounts, err := s.messageStorage.GetAccounts()
+	if err != nil {
+		return err
+	}
+
+	for _, account := range accounts {
+		retentionDays := defaultRetentionDays
+		if days, ok := s.signalCliApiConfig.GetMessageRetentionForNumber(account); ok {
+			retentionDays = days
+		}
+		if retentionDays <= 0 {
+			continue
+		}
+
+		before := time.Now().AddDate(0, 0, -retentionDays).UnixNano() / int64(time.Millisecond)
+		deleted, err := s.messageStorage.DeleteMessagesBefore(account, before)
+		if err != nil {
+			return err
+		}
+		if deleted > 0 {
+			log.Info("Deleted ", deleted, " stored message(s) of ", account, " older than ", retentionDays, " days")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ReceiveEvent is a message received in json-rpc mode together with its cursor. Cursors increase with every
+// received message; as they are based on the start time of the hub, they also increase across restarts.
+type ReceiveEvent struct {
+	Cursor  uint64
+	Message JsonRpc2ReceivedMessage
+}
+
+// ReceiveSubscription delivers the received messages of a number to one subscriber. The channel is closed
+// when the subscription ends; Dropped reports whether this happened because the subscriber was too slow.
+type ReceiveSubscription struct {
+	Events <-chan ReceiveEvent
+	events chan ReceiveEvent
+	hub    *receiveHub
+	// guarded by the mutex of the hub
+	dropped bool
+}
+
+// Close ends the subscription.
+func (s *ReceiveSubscription) Close() {
+	s.hub.unsubscribe(s, false)
+}
+
+func (s *ReceiveSubscription) Dropped() bool {
+	s.hub.mutex.Lock()
+	defer s.hub.mutex.Unlock()
+	return s.dropped
+}
+
+// receiveHub fans out the messages a number receives in json-rpc mode to all subscribers. The last messages
+// are kept in a ring buffer, so that subscribers can resume from a cursor. Publishing never blocks: a
+// subscriber whose buffer is full is disconnected.
+type receiveHub struct {
+	number string
+	// cursor of the next message
+	nextCursor uint64
+	// the last messages, oldest first
+	ring                 []ReceiveEvent
+	ringSize             int
+	subscriberBufferSize int
+	subscribers          map[*ReceiveSubscription]struct{}
+	mutex                sync.Mutex
+}
+
+func newReceiveHub(number string, ringSize int, subscriberBufferSize int) *receiveHub {
+	return &receiveHub{
+		number:               number,
+		nextCursor:           uint64(time.Now().UnixNano() / int64(time.Microsecond)),
+		ringSize:             ringSize,
+		subscriberBufferSize: subscriberBufferSize,
+		subscribers:          make(map[*ReceiveSubscription]struct{}),
+	}
+}
+
+// publish delivers the message to all subscribers and returns their number.
+func (h *receiveHub) publish(message JsonRpc2ReceivedMessage) int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	event := ReceiveEvent{Cursor: h.nextCursor, Message: message}
+	h.nextCursor += 1
+
+	if len(h.ring) >= h.ringSize {
+		h.ring = h.ring[1:]
+	}
+	h.ring = append(h.ring, event)
+
+	delivered := 0
+	for subscription := range h.subscribers {
+		select {
+		case subscription.events <- event:
+			delivered += 1
+		default:
+			log.Warn("Receive subscriber of ", h.number, " can't keep up - disconnecting it")
+			h.remove(subscription, true)
+		}
+	}
+	return delivered
+}
+
+// subscribe creates a new subscription. If a cursor is given, the buffered messages after it are delivered
+// first; complete reports whether all messages after the cursor were still buffered.
+func (h *receiveHub) subscribe(cursor *uint64) (*ReceiveSubscription, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	replay := []ReceiveEvent{}
+	complete := true
+	if cursor != nil {
+		for _, event := range h.ring {
+			if event.Cursor > *cursor {
+				replay = append(replay, event)
+			}
+		}
+		// messages between the cursor and the oldest buffered message are lost
+		oldest := h.nextCursor
+		if len(h.ring) > 0 {
+			oldest = h.ring[0].Cursor
+		}
+		complete = *cursor+1 >= oldest && *cursor < h.nextCursor
+	}
+
+	events := make(chan ReceiveEvent, h.subscriberBufferSize+len(replay))
+	for _, event := range replay {
+		events <- event
+	}
+
+	subscription := &ReceiveSubscription{Events: events, events: events, hub: h}
+	h.subscribers[subscription] = struct{}{}
+	return subscription, complete
+}
+
+func (h *receiveHub) unsubscribe(subscription *ReceiveSubscription, dropped bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.remove(subscription, dropped)
+}
+
+// remove needs to be called with the mutex held.
+func (h *receiveHub) remove(subscription *ReceiveSubscription, dropped bool) {
+	if _, ok := h.subscribers[subscription]; !ok {
+		return
+	}
+	delete(h.subscribers, subscription)
+	subscription.dropped = dropped
+	close(subscription.events)
+}
+
+// closeSubscriptions ends all subscriptions, e.g. because the connection to signal-cli was closed.
+func (h *receiveHub) closeSubscriptions() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for subscription := range h.subscribers {
+		h.remove(subscription, false)
+	}
+}
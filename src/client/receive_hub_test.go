@@ -0,0 +1,96 @@
+package client
+
+import (
+	"testing"
+)
+
+func receiveEvents(subscription *ReceiveSubscription, n int) []ReceiveEvent {
+	events := []ReceiveEvent{}
+	for i := 0; i < n; i++ {
+		select {
+		case event, ok := <-subscription.Events:
+			if !ok {
+				return events
+			}
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+	return events
+}
+
+func TestReceiveHubFansOut(t *testing.T) {
+	hub := newReceiveHub("+4912345678", 10, 10)
+	first, _ := hub.subscribe(nil)
+	second, _ := hub.subscribe(nil)
+
+	if delivered := hub.publish(inboxMessage(0)); delivered != 2 {
+		t.Errorf("expected the message to be delivered to 2 subscribers, got %d", delivered)
+	}
+	for _, subscription := range []*ReceiveSubscription{first, second} {
+		events := receiveEvents(subscription, 2)
+		if len(events) != 1 || string(events[0].Message.Params) != `{"i":0}` {
+			t.Errorf("expected every subscriber to receive the message, got %v", events)
+		}
+	}
+
+	first.Close()
+	if delivered := hub.publish(inboxMessage(1)); delivered != 1 {
+		t.Errorf("expected the message to be delivered to 1 subscriber, got %d", delivered)
+	}
+	if _, ok := <-first.Events; ok {
+		t.Error("expected the channel of a closed subscription to be closed")
+	}
+}
+
+func TestReceiveHubResumesFromCursor(t *testing.T) {
+	hub := newReceiveHub("+4912345678", 3, 10)
+	subscription, _ := hub.subscribe(nil)
+	for i := 0; i < 5; i++ {
+		hub.publish(inboxMessage(i))
+	}
+	events := receiveEvents(subscription, 5)
+
+	// the last three messages are buffered
+	resumed, complete := hub.subscribe(&events[2].Cursor)
+	replay := receiveEvents(resumed, 5)
+	if !complete || len(replay) != 2 || replay[0].Cursor != events[3].Cursor || replay[1].Cursor != events[4].Cursor {
+		t.Errorf("expected the two messages after the cursor, got %v (complete: %v)", replay, complete)
+	}
+
+	resumed, complete = hub.subscribe(&events[0].Cursor)
+	replay = receiveEvents(resumed, 5)
+	if complete || len(replay) != 3 {
+		t.Errorf("expected an incomplete replay of the 3 buffered messages, got %v (complete: %v)", replay, complete)
+	}
+
+	resumed, complete = hub.subscribe(&events[4].Cursor)
+	if !complete || len(receiveEvents(resumed, 5)) != 0 {
+		t.Error("expected nothing to replay after the latest cursor")
+	}
+}
+
+func TestReceiveHubDropsSlowSubscriber(t *testing.T) {
+	hub := newReceiveHub("+4912345678", 10, 2)
+	slow, _ := hub.subscribe(nil)
+	fast, _ := hub.subscribe(nil)
+
+	for i := 0; i < 3; i++ {
+		hub.publish(inboxMessage(i))
+		receiveEvents(fast, 1)
+	}
+
+	if !slow.Dropped() {
+		t.Error("expected the slow subscriber to be dropped")
+	}
+	if fast.Dropped() {
+		t.Error("expected the fast subscriber to stay connected")
+	}
+	if events := receiveEvents(slow, 3); len(events) != 2 {
+		t.Errorf("expected the buffered messages to be kept, got %v", events)
+	}
+	if _, ok := <-slow.Events; ok {
+		t.Error("expected the channel of the slow subscriber to be closed")
+	}
+}
@@ -0,0 +1,33 @@
+package client
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// ReceiveListener is called for every envelope that is received in json-rpc mode. The message type is one
+// of the utils.MessageType* constants, data is the envelope as reported by signal-cli.
+type ReceiveListener func(number string, messageType string, data []byte)
+
+// AddReceiveListener registers a listener that is notified about every received envelope.
+func (s *SignalClient) AddReceiveListener(listener ReceiveListener) {
+	s.receiveListenersMutex.Lock()
+	defer s.receiveListenersMutex.Unlock()
+	s.receiveListeners = append(s.receiveListeners, listener)
+}
+
+// handleReceivedEnvelope stores an envelope that was received in json-rpc mode and notifies the listeners.
+func (s *SignalClient) handleReceivedEnvelope(number string, data []byte) {
+	message, err := newStoredMessage(number, data)
+	if err != nil {
+		log.Debug("Ignoring received data of ", number, ": ", err.Error())
+		return
+	}
+	s.storeMessage(message)
+
+	s.receiveListenersMutex.RLock()
+	listeners := s.receiveListeners
+	s.receiveListenersMutex.RUnlock()
+	for _, listener := range listeners {
+		listener(number, message.Type, data)
+	}
+}
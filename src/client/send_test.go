@@ -0,0 +1,146 @@
+package client
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type sendCall struct {
+	recipients []string
+	isGroup    bool
+}
+
+// fakeSend records the calls and fails for the recipients/groups in failures.
+func fakeSend(failures map[string]error) (func(recipients []string, isGroup bool) (*SendResponse, error), *[]sendCall) {
+	calls := []sendCall{}
+	var mutex sync.Mutex
+	return func(recipients []string, isGroup bool) (*SendResponse, error) {
+		mutex.Lock()
+		calls = append(calls, sendCall{recipients: recipients, isGroup: isGroup})
+		mutex.Unlock()
+
+		if err, ok := failures[strings.Join(recipients, ",")]; ok {
+			return nil, err
+		}
+		resp := &SendResponse{Timestamp: int64(len(recipients))}
+		for _, recipient := range recipients {
+			resp.Results = append(resp.Results, SendResults{RecepientAddress: SendAddress{Number: recipient}, Type: "SUCCESS"})
+		}
+		return resp, nil
+	}, &calls
+}
+
+func TestSendToTargets(t *testing.T) {
+	s := &SignalClient{sendMaxParallelism: 2}
+	sendFunc, calls := fakeSend(map[string]error{"Z3JvdXAy": errors.New("group failed")})
+
+	recps := []string{"+491111", "group.Z3JvdXAx", "+492222", "group.Z3JvdXAy", "+491111"}
+	responses, err := s.sendToTargets(recps, sendFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*calls) != 3 {
+		t.Fatalf("expected one call for the numbers and one per group, got %v", *calls)
+	}
+	for _, call := range *calls {
+		if !call.isGroup && strings.Join(call.recipients, ",") != "+491111,+492222" {
+			t.Errorf("expected all numbers to be sent to at once, got %v", call.recipients)
+		}
+	}
+
+	expected := []string{"+491111", "group.Z3JvdXAx", "+492222", "group.Z3JvdXAy"}
+	if len(*responses) != len(expected) {
+		t.Fatalf("expected %d entries, got %+v", len(expected), *responses)
+	}
+	for i, resp := range *responses {
+		if resp.Recipient != expected[i] {
+			t.Errorf("entry %d: expected recipient %s, got %s", i, expected[i], resp.Recipient)
+		}
+	}
+
+	first, second := (*responses)[0], (*responses)[2]
+	if first.Timestamp != 2 || second.Timestamp != first.Timestamp {
+		t.Errorf("expected the numbers to share the timestamp, got %d and %d", first.Timestamp, second.Timestamp)
+	}
+	if len(first.Results) != 1 || first.Results[0].RecepientAddress.Number != "+491111" {
+		t.Errorf("expected the results of the recipient only, got %+v", first.Results)
+	}
+	if (*responses)[3].Error != "group failed" || (*responses)[1].Error != "" {
+		t.Errorf("expected only the second group to fail, got %+v", *responses)
+	}
+}
+
+func TestSendToTargetsAllFailed(t *testing.T) {
+	s := &SignalClient{sendMaxParallelism: 4}
+
+	sendFunc, _ := fakeSend(map[string]error{
+		"+491111,+492222": &RateLimitError{Description: "rate limit exceeded", RetryAfter: 10},
+		"Z3JvdXAx":        errors.New("group failed"),
+	})
+	_, err := s.sendToTargets([]string{"+491111", "+492222", "group.Z3JvdXAx"}, sendFunc)
+	var rateLimitError *RateLimitError
+	if !errors.As(err, &rateLimitError) || rateLimitError.RetryAfter != 10 {
+		t.Errorf("expected a rate limit error, got %v", err)
+	}
+
+	sendFunc, _ = fakeSend(map[string]error{"+491111": &UnregisteredRecipientError{Description: "unregistered user"}})
+	_, err = s.sendToTargets([]string{"+491111"}, sendFunc)
+	var unregisteredRecipientError *UnregisteredRecipientError
+	if !errors.As(err, &unregisteredRecipientError) {
+		t.Errorf("expected the error of the only target, got %v", err)
+	}
+	sendFunc, _ = fakeSend(map[string]error{
+		"+491111":  &GroupNotFoundError{Description: "group not found"},
+		"Z3JvdXAx": &GroupNotFoundError{Description: "group not found"},
+	})
+	_, err = s.sendToTargets([]string{"+491111", "group.Z3JvdXAx"}, sendFunc)
+	var groupNotFoundError *GroupNotFoundError
+	if !errors.As(err, &groupNotFoundError) {
+		t.Errorf("expected the common type of the errors to be kept, got %v", err)
+	}
+
+	sendFunc, _ = fakeSend(map[string]error{
+		"+491111":  &UnregisteredRecipientError{Description: "unregistered user"},
+		"Z3JvdXAx": &GroupNotFoundError{Description: "group not found"},
+	})
+	_, err = s.sendToTargets([]string{"+491111", "group.Z3JvdXAx"}, sendFunc)
+	if errors.As(err, &unregisteredRecipientError) || errors.As(err, &groupNotFoundError) {
+		t.Errorf("expected an untyped error for different failures, got %v", err)
+	}
+}
+
+func TestSendToTargetsPartialFailure(t *testing.T) {
+	s := &SignalClient{sendMaxParallelism: 2}
+	identities := []UntrustedIdentity{{Recipient: "+492222"}}
+	sendFunc, _ := fakeSend(map[string]error{
+		"+491111,+492222": &UntrustedIdentityError{Description: "untrusted identity", Identities: identities},
+	})
+
+	responses, err := s.sendToTargets([]string{"+491111", "group.Z3JvdXAx", "+492222"}, sendFunc)
+	if err != nil {
+		t.Fatalf("expected no error as the group succeeded, got %v", err)
+	}
+
+	expected := []string{"+491111", "group.Z3JvdXAx", "+492222"}
+	if len(*responses) != len(expected) {
+		t.Fatalf("expected %d entries, got %+v", len(expected), *responses)
+	}
+	for i, resp := range *responses {
+		if resp.Recipient != expected[i] {
+			t.Errorf("entry %d: expected recipient %s, got %s", i, expected[i], resp.Recipient)
+		}
+	}
+
+	for _, failed := range []SendResponse{(*responses)[0], (*responses)[2]} {
+		if failed.Error != "untrusted identity" || failed.Timestamp != 0 || len(failed.UntrustedIdentities) != 1 {
+			t.Errorf("expected the number to fail with its untrusted identities, got %+v", failed)
+		}
+	}
+	group := (*responses)[1]
+	if group.Error != "" || group.Timestamp == 0 || len(group.Results) != 1 {
+		t.Errorf("expected the group to be sent to, got %+v", group)
+	}
+}
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// signal-cli keeps the decrypted stickers of the installed sticker packs in the data directory of the
+// account (<data dir>/<account path>.d/stickers/<pack id>/<sticker id>). The getSticker command that
+// returns them only exists since signal-cli 0.13, so the stickers are read from there directly.
+
+type signalCliAccount struct {
+	Path   string `json:"path"`
+	Number string `json:"number"`
+}
+
+type signalCliAccounts struct {
+	Accounts []signalCliAccount `json:"accounts"`
+}
+
+// accountDataDirs returns the data directories of the account in the signal-cli config directory. In
+// json-rpc mode every account may have its own config directory (<config dir>/<n>/data).
+func accountDataDirs(signalCliConfig string, number string) []string {
+	dataDirs := []string{filepath.Join(signalCliConfig, "data")}
+	subDataDirs, _ := filepath.Glob(filepath.Join(signalCliConfig, "*", "data"))
+	dataDirs = append(dataDirs, subDataDirs...)
+
+	accountDirs := []string{}
+	for _, dataDir := range dataDirs {
+		accountPath := number
+		accountsJson, err := ioutil.ReadFile(filepath.Join(dataDir, "accounts.json"))
+		if err == nil {
+			var accounts signalCliAccounts
+			if json.Unmarshal(accountsJson, &accounts) == nil {
+				for _, account := range accounts.Accounts {
+					if account.Number == number && account.Path != "" {
+						accountPath = account.Path
+						break
+					}
+				}
+			}
+		}
+		accountDirs = append(accountDirs, filepath.Join(dataDir, filepath.Base(accountPath)+".d"))
+	}
+	return accountDirs
+}
+
+// GetSticker returns the image of a sticker of an installed sticker pack.
+func (s *SignalClient) GetSticker(number string, packId string, stickerId int) ([]byte, error) {
+	packId = strings.ToLower(packId)
+	if _, err := hex.DecodeString(packId); err != nil || packId == "" {
+		return nil, &InvalidNameError{Description: "Please provide a valid sticker pack id"}
+	}
+
+	for _, accountDir := range accountDataDirs(s.signalCliConfig, number) {
+		path := filepath.Join(accountDir, "stickers", packId, strconv.Itoa(stickerId))
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+
+		stickerBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, &InternalError{Description: "Couldn't read sticker - please try again later"}
+		}
+		return stickerBytes, nil
+	}
+	return nil, &NotFoundError{Description: "No sticker with that id found - is the sticker pack installed?"}
+}
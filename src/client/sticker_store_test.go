@@ -0,0 +1,131 @@
+package client
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, path string, data string) {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetSticker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stickers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	// account with an accounts.json entry
+	writeTestFile(t, filepath.Join(dir, "data", "accounts.json"), `{"accounts":[{"path":"123456","number":"+491111"}],"version":2}`)
+	writeTestFile(t, filepath.Join(dir, "data", "123456.d", "stickers", "abcd", "1"), "sticker of +491111")
+	// legacy account without an accounts.json entry
+	writeTestFile(t, filepath.Join(dir, "data", "+492222.d", "stickers", "abcd", "0"), "sticker of +492222")
+	// account with its own config directory (json-rpc mode)
+	writeTestFile(t, filepath.Join(dir, "1", "data", "accounts.json"), `{"accounts":[{"path":"654321","number":"+493333"}],"version":2}`)
+	writeTestFile(t, filepath.Join(dir, "1", "data", "654321.d", "stickers", "abcd", "2"), "sticker of +493333")
+
+	s := &SignalClient{signalCliConfig: dir}
+
+	tests := []struct {
+		number    string
+		packId    string
+		stickerId int
+		expected  string
+		err       error
+	}{
+		{"+491111", "abcd", 1, "sticker of +491111", nil},
+		{"+491111", "ABCD", 1, "sticker of +491111", nil},
+		{"+492222", "abcd", 0, "sticker of +492222", nil},
+		{"+493333", "abcd", 2, "sticker of +493333", nil},
+		{"+491111", "abcd", 2, "", &NotFoundError{}},
+		{"+491111", "ef01", 1, "", &NotFoundError{}},
+		{"+494444", "abcd", 1, "", &NotFoundError{}},
+		{"+491111", "", 1, "", &InvalidNameError{}},
+		{"+491111", "../abcd", 1, "", &InvalidNameError{}},
+	}
+	for _, test := range tests {
+		sticker, err := s.GetSticker(test.number, test.packId, test.stickerId)
+		switch expected := test.err.(type) {
+		case nil:
+			if err != nil || string(sticker) != test.expected {
+				t.Errorf("%s %s/%d: expected %q, got %q (%v)", test.number, test.packId, test.stickerId, test.expected, sticker, err)
+			}
+		case *NotFoundError:
+			if !errors.As(err, &expected) {
+				t.Errorf("%s %s/%d: expected a not found error, got %v", test.number, test.packId, test.stickerId, err)
+			}
+		case *InvalidNameError:
+			if !errors.As(err, &expected) {
+				t.Errorf("%s %s/%d: expected an invalid name error, got %v", test.number, test.packId, test.stickerId, err)
+			}
+		}
+	}
+}
+
+func TestStickerPackUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sticker-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	s := &SignalClient{attachmentTmpDir: dir + string(os.PathSeparator)}
+
+	upload, err := s.NewStickerPackUpload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := upload.path(); err == nil {
+		t.Error("expected an empty upload to be rejected")
+	}
+
+	err = upload.AddFile("../pack.zip", strings.NewReader("zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, err := upload.path()
+	if err != nil || filepath.Base(path) != "pack.zip" || filepath.Dir(path) != upload.dirPath {
+		t.Errorf("expected the zip file inside the upload directory, got %s (%v)", path, err)
+	}
+
+	if err := upload.AddFile("pack.zip", strings.NewReader("zip")); err == nil {
+		t.Error("expected a duplicate file name to be rejected")
+	}
+	if err := upload.AddFile("/", strings.NewReader("")); err == nil {
+		t.Error("expected an invalid file name to be rejected")
+	}
+
+	err = upload.AddFile("1.webp", strings.NewReader("sticker"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := upload.path(); err == nil {
+		t.Error("expected a zip file together with other files to be rejected")
+	}
+
+	err = upload.AddFile("manifest.json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, err = upload.path()
+	if err != nil || filepath.Base(path) != "manifest.json" {
+		t.Errorf("expected the path of the manifest, got %s (%v)", path, err)
+	}
+
+	upload.CleanUp()
+	if _, err := os.Stat(upload.dirPath); !os.IsNotExist(err) {
+		t.Error("expected the upload directory to be removed")
+	}
+}
@@ -0,0 +1,174 @@
+package client
+
+import (
+	"errors"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	utils "github.com/sheophe/signal-cli-rest-api/utils"
+)
+
+// result type signal-cli reports for recipients whose identity key changed and isn't trusted yet
+const sendResultIdentityFailure = "IDENTITY_FAILURE"
+
+// UntrustedIdentity is a recipient the message couldn't be sent to, because its identity key changed
+// (e.g. because Signal was reinstalled). The new safety number can be verified and trusted with the
+// identities endpoint.
+type UntrustedIdentity struct {
+	Recipient    string `json:"recipient"`
+	SafetyNumber string `json:"safety_number,omitempty"`
+	Fingerprint  string `json:"fingerprint,omitempty"`
+}
+
+// send sends the message and takes care of recipients with untrusted identities: if the trust mode of the
+// number is "always", the new identity keys are trusted and the message is sent again (once) to the
+// recipients it couldn't be delivered to; their results replace the failed ones in the response (which
+// keeps the timestamp of the first send). Otherwise an UntrustedIdentityError with the new safety numbers
+// is returned, or, if the message was delivered to some of the recipients, the untrusted identities are
+// listed in the response. Messages to groups are never sent again, as the other members already received
+// them.
+func (s *SignalClient) send(number string, message string,
+	recipients []string, base64Attachments []string, attachments []AttachmentEntry, isGroup bool, sticker string, messageMentions MessageMentions,
+	quoteTimestamp *int64, quoteAuthor *string, quoteMessage *string, quoteMessageMentions MessageMentions, textMode *string,
+	editTimestamp *int64, linkPreview *linkPreviewEntry, displayName func(author string) string) (*SendResponse, error) {
+
+	sendTo := func(recipients []string) (*SendResponse, error) {
+		return s.sendOnce(number, message, recipients, base64Attachments, attachments, isGroup, sticker, messageMentions,
+			quoteTimestamp, quoteAuthor, quoteMessage, quoteMessageMentions, textMode, editTimestamp, linkPreview, displayName)
+	}
+	trust := func(identities []UntrustedIdentity) bool {
+		trustMode, err := s.signalCliApiConfig.GetTrustModeForNumber(number)
+		return err == nil && trustMode == utils.AlwaysTrust && s.trustIdentities(number, identities)
+	}
+
+	resp, identities, err := sendTrustingIdentities(recipients, isGroup, sendTo, trust)
+	if len(identities) == 0 {
+		return resp, err
+	}
+
+	s.addSafetyNumbers(number, identities)
+	if err != nil {
+		return nil, &UntrustedIdentityError{Description: err.Error(), Identities: identities}
+	}
+	resp.UntrustedIdentities = identities
+	return resp, nil
+}
+
+// sendTrustingIdentities sends the message with sendTo. In case of untrusted identities, trust is called and,
+// if it trusted them, the message is sent again (see send). The identities that are still untrusted are returned.
+func sendTrustingIdentities(recipients []string, isGroup bool, sendTo func(recipients []string) (*SendResponse, error),
+	trust func(identities []UntrustedIdentity) bool) (*SendResponse, []UntrustedIdentity, error) {
+	resp, err := sendTo(recipients)
+	identities := untrustedIdentities(resp, err, recipients, isGroup)
+	if len(identities) == 0 || !trust(identities) {
+		return resp, identities, err
+	}
+
+	if err != nil {
+		// the message wasn't sent at all
+		resp, err = sendTo(recipients)
+		return resp, untrustedIdentities(resp, err, recipients, isGroup), err
+	}
+
+	if isGroup {
+		return resp, identities, nil
+	}
+
+	failedRecipients := []string{}
+	for _, identity := range identities {
+		failedRecipients = append(failedRecipients, identity.Recipient)
+	}
+	retryResp, retryErr := sendTo(failedRecipients)
+	if retryErr != nil {
+		log.Error("Couldn't send message again to ", strings.Join(failedRecipients, ", "), ": ", retryErr.Error())
+		var untrustedIdentityError *UntrustedIdentityError
+		if errors.As(retryErr, &untrustedIdentityError) && len(untrustedIdentityError.Identities) > 0 {
+			identities = untrustedIdentityError.Identities
+		}
+		return resp, identities, nil
+	}
+
+	mergeSendResults(resp, retryResp)
+	return resp, untrustedIdentities(resp, nil, recipients, isGroup), nil
+}
+
+// mergeSendResults replaces the results of resp with the ones of the same recipients in retryResp.
+func mergeSendResults(resp *SendResponse, retryResp *SendResponse) {
+	for i, result := range resp.Results {
+		for _, retryResult := range retryResp.Results {
+			if sameSendAddress(result.RecepientAddress, retryResult.RecepientAddress) {
+				resp.Results[i] = retryResult
+				break
+			}
+		}
+	}
+}
+
+func sameSendAddress(a SendAddress, b SendAddress) bool {
+	return (a.Number != "" && a.Number == b.Number) || (a.UUID != "" && a.UUID == b.UUID)
+}
+
+// untrustedIdentities returns the recipients the message couldn't be sent to because of an untrusted identity.
+func untrustedIdentities(resp *SendResponse, err error, recipients []string, isGroup bool) []UntrustedIdentity {
+	identities := []UntrustedIdentity{}
+	var untrustedIdentityError *UntrustedIdentityError
+	if errors.As(err, &untrustedIdentityError) {
+		identities = append(identities, untrustedIdentityError.Identities...)
+		if len(identities) == 0 && !isGroup && len(recipients) == 1 {
+			identities = append(identities, UntrustedIdentity{Recipient: recipients[0]})
+		}
+		return identities
+	}
+
+	if resp == nil {
+		return identities
+	}
+	for _, result := range resp.Results {
+		if result.Type != sendResultIdentityFailure {
+			continue
+		}
+		recipient := result.RecepientAddress.Number
+		if recipient == "" {
+			recipient = result.RecepientAddress.UUID
+		}
+		identities = append(identities, UntrustedIdentity{Recipient: recipient})
+	}
+	return identities
+}
+
+// trustIdentities trusts the new identity keys of the given recipients and reports whether all of them are trusted now.
+func (s *SignalClient) trustIdentities(number string, identities []UntrustedIdentity) bool {
+	trustAllKnownKeys := true
+	for _, identity := range identities {
+		err := s.TrustIdentity(number, identity.Recipient, nil, &trustAllKnownKeys)
+		if err != nil {
+			log.Error("Couldn't trust new identity of ", identity.Recipient, ": ", err.Error())
+			return false
+		}
+		log.Info("Trusted new identity of ", identity.Recipient, " (trust mode of ", number, " is 'always')")
+	}
+	return true
+}
+
+// addSafetyNumbers looks up the (new) safety numbers of the untrusted identities.
+func (s *SignalClient) addSafetyNumbers(number string, identities []UntrustedIdentity) {
+	identityEntries, err := s.ListIdentities(number)
+	if err != nil {
+		log.Error("Couldn't look up safety numbers of untrusted identities: ", err.Error())
+		return
+	}
+
+	for i := range identities {
+		for _, identityEntry := range *identityEntries {
+			if identityEntry.Number != identities[i].Recipient {
+				continue
+			}
+			identities[i].SafetyNumber = identityEntry.SafetyNumber
+			identities[i].Fingerprint = identityEntry.Fingerprint
+			if identityEntry.Status == "UNTRUSTED" {
+				break
+			}
+		}
+	}
+}
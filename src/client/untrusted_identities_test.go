@@ -0,0 +1,117 @@
+package client
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestUntrustedIdentitiesFromResults(t *testing.T) {
+	resp := &SendResponse{Results: []SendResults{
+		{RecepientAddress: SendAddress{Number: "+4911111111"}, Type: "SUCCESS"},
+		{RecepientAddress: SendAddress{Number: "+4922222222"}, Type: sendResultIdentityFailure},
+		{RecepientAddress: SendAddress{UUID: "a5f6a3b2-uuid"}, Type: sendResultIdentityFailure},
+	}}
+
+	identities := untrustedIdentities(resp, nil, []string{"group-id"}, true)
+	expected := []UntrustedIdentity{{Recipient: "+4922222222"}, {Recipient: "a5f6a3b2-uuid"}}
+	if !reflect.DeepEqual(identities, expected) {
+		t.Errorf("expected %v, got %v", expected, identities)
+	}
+}
+
+func TestUntrustedIdentitiesFromError(t *testing.T) {
+	err := parseSignalCliError(`Failed to send message: Untrusted Identity for "+4922222222"`, signalCliUntrustedKeyError)
+	identities := untrustedIdentities(nil, err, []string{"+4922222222"}, false)
+	expected := []UntrustedIdentity{{Recipient: "+4922222222"}}
+	if !reflect.DeepEqual(identities, expected) {
+		t.Errorf("expected %v, got %v", expected, identities)
+	}
+
+	// the recipient isn't part of the error message, but it is the only one
+	err = parseSignalCliError("Failed to send message", signalCliUntrustedKeyError)
+	identities = untrustedIdentities(nil, err, []string{"+4933333333"}, false)
+	expected = []UntrustedIdentity{{Recipient: "+4933333333"}}
+	if !reflect.DeepEqual(identities, expected) {
+		t.Errorf("expected %v, got %v", expected, identities)
+	}
+}
+
+func TestUntrustedIdentitiesOtherError(t *testing.T) {
+	identities := untrustedIdentities(nil, errors.New("Failed to send message"), []string{"+4933333333"}, false)
+	if len(identities) != 0 {
+		t.Errorf("expected no untrusted identities, got %v", identities)
+	}
+}
+
+func sendResult(number string, resultType string) SendResults {
+	return SendResults{RecepientAddress: SendAddress{Number: number}, Type: resultType}
+}
+
+func TestSendTrustingIdentitiesResendsToFailedRecipients(t *testing.T) {
+	calls := [][]string{}
+	sendTo := func(recipients []string) (*SendResponse, error) {
+		calls = append(calls, recipients)
+		if len(calls) == 1 {
+			return &SendResponse{Timestamp: 1, Results: []SendResults{
+				sendResult("+4911111111", "SUCCESS"),
+				sendResult("+4922222222", sendResultIdentityFailure),
+			}}, nil
+		}
+		return &SendResponse{Timestamp: 2, Results: []SendResults{sendResult("+4922222222", "SUCCESS")}}, nil
+	}
+	trust := func(identities []UntrustedIdentity) bool { return true }
+
+	resp, identities, err := sendTrustingIdentities([]string{"+4911111111", "+4922222222"}, false, sendTo, trust)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(calls, [][]string{{"+4911111111", "+4922222222"}, {"+4922222222"}}) {
+		t.Errorf("expected the message to be sent again to the failed recipient only, got %v", calls)
+	}
+	if len(identities) != 0 {
+		t.Errorf("expected no untrusted identities, got %v", identities)
+	}
+	expected := []SendResults{sendResult("+4911111111", "SUCCESS"), sendResult("+4922222222", "SUCCESS")}
+	if resp.Timestamp != 1 || !reflect.DeepEqual(resp.Results, expected) {
+		t.Errorf("expected the merged results %v, got %+v", expected, resp)
+	}
+}
+
+func TestSendTrustingIdentitiesGroup(t *testing.T) {
+	calls := 0
+	sendTo := func(recipients []string) (*SendResponse, error) {
+		calls++
+		return &SendResponse{Results: []SendResults{
+			sendResult("+4911111111", "SUCCESS"),
+			sendResult("+4922222222", sendResultIdentityFailure),
+		}}, nil
+	}
+	trusted := false
+	trust := func(identities []UntrustedIdentity) bool { trusted = true; return true }
+
+	_, identities, err := sendTrustingIdentities([]string{"Z3JvdXAx"}, true, sendTo, trust)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 || !trusted {
+		t.Errorf("expected the identity to be trusted without sending again, got %d call(s)", calls)
+	}
+	if !reflect.DeepEqual(identities, []UntrustedIdentity{{Recipient: "+4922222222"}}) {
+		t.Errorf("expected the untrusted identity to be reported, got %v", identities)
+	}
+}
+
+func TestSendTrustingIdentitiesNotTrusted(t *testing.T) {
+	calls := 0
+	sendTo := func(recipients []string) (*SendResponse, error) {
+		calls++
+		return &SendResponse{Results: []SendResults{sendResult("+4922222222", sendResultIdentityFailure)}}, nil
+	}
+	trust := func(identities []UntrustedIdentity) bool { return false }
+
+	_, identities, _ := sendTrustingIdentities([]string{"+4922222222"}, false, sendTo, trust)
+	if calls != 1 || len(identities) != 1 {
+		t.Errorf("expected one call and one untrusted identity, got %d call(s) and %v", calls, identities)
+	}
+}
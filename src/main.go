@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -30,6 +31,9 @@ import (
 // @tag.name Devices
 // @tag.description Register and link Devices.
 
+// @tag.name Accounts
+// @tag.description Manage Signal accounts.
+
 // @tag.name Groups
 // @tag.description Create, List and Delete Signal Groups.
 
@@ -48,9 +52,24 @@ import (
 // @tag.name Reactions
 // @tag.description React to messages.
 
+// @tag.name Receipts
+// @tag.description Send read and viewed receipts.
+
 // @tag.name Search
 // @tag.description Search the Signal Service.
 
+// @tag.name Schedules
+// @tag.description Send messages at a given time or on a recurring schedule.
+
+// @tag.name Sticker Packs
+// @tag.description List, install and upload sticker packs.
+
+// @tag.name Templates
+// @tag.description Manage message templates.
+
+// @tag.name Webhooks
+// @tag.description Deliver received messages to webhooks.
+
 // @BasePath /
 func main() {
 	signalCliConfig := flag.String("signal-cli-config", "/home/.local/share/signal-cli/", "Config directory where signal-cli config is stored")
@@ -157,18 +176,164 @@ func main() {
 	jsonRpc2ClientConfigPathPath := *signalCliConfig + "/jsonrpc2.yml"
 	signalCliApiConfigPath := *signalCliConfig + "/api-config.yml"
 	subDBPath := *signalCliConfig + "/subs.db"
+	jobDBPath := *signalCliConfig + "/jobs.db"
+	scheduleDBPath := *signalCliConfig + "/schedules.db"
+	templateDBPath := *signalCliConfig + "/templates.db"
+	messageDBPath := *signalCliConfig + "/messages.db"
+	webhookDBPath := *signalCliConfig + "/webhooks.db"
 
 	subStorage, err := utils.NewSubStorage(subDBPath)
 	if err != nil {
 		log.Fatal("Couldn't init Sub Storage: ", err.Error())
 	}
-	signalClient := client.NewSignalClient(*signalCliConfig, *attachmentTmpDir, *avatarTmpDir, signalCliMode, jsonRpc2ClientConfigPathPath, signalCliApiConfigPath, subStorage)
+	messageStorage, err := utils.NewMessageStorage(messageDBPath)
+	if err != nil {
+		log.Fatal("Couldn't init Message Storage: ", err.Error())
+	}
+	signalClient := client.NewSignalClient(*signalCliConfig, *attachmentTmpDir, *avatarTmpDir, signalCliMode, jsonRpc2ClientConfigPathPath, signalCliApiConfigPath, subStorage, messageStorage)
 	err = signalClient.Init()
 	if err != nil {
 		log.Fatal("Couldn't init Signal Client: ", err.Error())
 	}
 
-	api := api.NewApi(signalClient, signalCliMode)
+	jobStorage, err := utils.NewJobStorage(jobDBPath)
+	if err != nil {
+		log.Fatal("Couldn't init Job Storage: ", err.Error())
+	}
+
+	sendQueueWorkers, err := utils.GetIntEnv("SEND_QUEUE_WORKERS", 1)
+	if err != nil || sendQueueWorkers < 1 {
+		log.Fatal("Invalid SEND_QUEUE_WORKERS set. SEND_QUEUE_WORKERS needs to be a positive number")
+	}
+
+	sendQueueMaxAttempts, err := utils.GetIntEnv("SEND_QUEUE_MAX_ATTEMPTS", 5)
+	if err != nil || sendQueueMaxAttempts < 1 {
+		log.Fatal("Invalid SEND_QUEUE_MAX_ATTEMPTS set. SEND_QUEUE_MAX_ATTEMPTS needs to be a positive number")
+	}
+
+	sendQueueRetryBaseDelay, err := utils.GetIntEnv("SEND_QUEUE_RETRY_BASE_DELAY", 2)
+	if err != nil || sendQueueRetryBaseDelay < 1 {
+		log.Fatal("Invalid SEND_QUEUE_RETRY_BASE_DELAY set. SEND_QUEUE_RETRY_BASE_DELAY needs to be a positive number")
+	}
+
+	sendQueueRetryMaxDelay, err := utils.GetIntEnv("SEND_QUEUE_RETRY_MAX_DELAY", 300)
+	if err != nil || sendQueueRetryMaxDelay < sendQueueRetryBaseDelay {
+		log.Fatal("Invalid SEND_QUEUE_RETRY_MAX_DELAY set. SEND_QUEUE_RETRY_MAX_DELAY needs to be a number >= SEND_QUEUE_RETRY_BASE_DELAY")
+	}
+
+	sendQueue := api.NewSendQueue(jobStorage, sendQueueWorkers, sendQueueMaxAttempts,
+		time.Duration(sendQueueRetryBaseDelay)*time.Second, time.Duration(sendQueueRetryMaxDelay)*time.Second)
+
+	scheduleStorage, err := utils.NewScheduleStorage(scheduleDBPath)
+	if err != nil {
+		log.Fatal("Couldn't init Schedule Storage: ", err.Error())
+	}
+	scheduler := api.NewScheduler(scheduleStorage)
+
+	templateStorage, err := utils.NewTemplateStorage(templateDBPath)
+	if err != nil {
+		log.Fatal("Couldn't init Template Storage: ", err.Error())
+	}
+
+	webhookStorage, err := utils.NewWebhookStorage(webhookDBPath)
+	if err != nil {
+		log.Fatal("Couldn't init Webhook Storage: ", err.Error())
+	}
+
+	webhookTimeout, err := utils.GetIntEnv("WEBHOOK_TIMEOUT", 10)
+	if err != nil || webhookTimeout < 1 {
+		log.Fatal("Invalid WEBHOOK_TIMEOUT set. WEBHOOK_TIMEOUT needs to be a positive number")
+	}
+
+	webhookMaxAttempts, err := utils.GetIntEnv("WEBHOOK_MAX_ATTEMPTS", 5)
+	if err != nil || webhookMaxAttempts < 1 {
+		log.Fatal("Invalid WEBHOOK_MAX_ATTEMPTS set. WEBHOOK_MAX_ATTEMPTS needs to be a positive number")
+	}
+
+	webhookRetryBaseDelay, err := utils.GetIntEnv("WEBHOOK_RETRY_BASE_DELAY", 2)
+	if err != nil || webhookRetryBaseDelay < 1 {
+		log.Fatal("Invalid WEBHOOK_RETRY_BASE_DELAY set. WEBHOOK_RETRY_BASE_DELAY needs to be a positive number")
+	}
+
+	webhookRetryMaxDelay, err := utils.GetIntEnv("WEBHOOK_RETRY_MAX_DELAY", 300)
+	if err != nil || webhookRetryMaxDelay < webhookRetryBaseDelay {
+		log.Fatal("Invalid WEBHOOK_RETRY_MAX_DELAY set. WEBHOOK_RETRY_MAX_DELAY needs to be a number >= WEBHOOK_RETRY_BASE_DELAY")
+	}
+
+	webhookAllowPrivateNetworks := utils.GetEnv("WEBHOOK_ALLOW_PRIVATE_NETWORKS", "false") == "true"
+
+	webhookDispatcher := api.NewWebhookDispatcher(webhookStorage, time.Duration(webhookTimeout)*time.Second, webhookMaxAttempts,
+		time.Duration(webhookRetryBaseDelay)*time.Second, time.Duration(webhookRetryMaxDelay)*time.Second, webhookAllowPrivateNetworks)
+
+	maxUploadSize, err := utils.GetIntEnv("MAX_UPLOAD_SIZE", 100*1024*1024)
+	if err != nil || maxUploadSize < 1 {
+		log.Fatal("Invalid MAX_UPLOAD_SIZE set. MAX_UPLOAD_SIZE needs to be a positive number")
+	}
+
+	sendBatchParallelism, err := utils.GetIntEnv("SEND_BATCH_PARALLELISM", 2)
+	if err != nil || sendBatchParallelism < 1 {
+		log.Fatal("Invalid SEND_BATCH_PARALLELISM set. SEND_BATCH_PARALLELISM needs to be a positive number")
+	}
+
+	idempotencyKeyTtl, err := utils.GetIntEnv("IDEMPOTENCY_KEY_TTL", 24*60*60)
+	if err != nil || idempotencyKeyTtl < 1 {
+		log.Fatal("Invalid IDEMPOTENCY_KEY_TTL set. IDEMPOTENCY_KEY_TTL needs to be a positive number")
+	}
+
+	rateLimitPerNumber, err := utils.GetIntEnv("RATE_LIMIT_PER_NUMBER", 0)
+	if err != nil || rateLimitPerNumber < 0 {
+		log.Fatal("Invalid RATE_LIMIT_PER_NUMBER set. RATE_LIMIT_PER_NUMBER needs to be a number >= 0")
+	}
+
+	rateLimitPerNumberBurst, err := utils.GetIntEnv("RATE_LIMIT_PER_NUMBER_BURST", rateLimitPerNumber)
+	if err != nil || rateLimitPerNumberBurst < 0 {
+		log.Fatal("Invalid RATE_LIMIT_PER_NUMBER_BURST set. RATE_LIMIT_PER_NUMBER_BURST needs to be a number >= 0")
+	}
+
+	rateLimitPerSub, err := utils.GetIntEnv("RATE_LIMIT_PER_SUB", 0)
+	if err != nil || rateLimitPerSub < 0 {
+		log.Fatal("Invalid RATE_LIMIT_PER_SUB set. RATE_LIMIT_PER_SUB needs to be a number >= 0")
+	}
+
+	rateLimitPerSubBurst, err := utils.GetIntEnv("RATE_LIMIT_PER_SUB_BURST", rateLimitPerSub)
+	if err != nil || rateLimitPerSubBurst < 0 {
+		log.Fatal("Invalid RATE_LIMIT_PER_SUB_BURST set. RATE_LIMIT_PER_SUB_BURST needs to be a number >= 0")
+	}
+
+	api := api.NewApi(signalClient, signalCliMode, sendQueue, scheduler, templateStorage, int64(maxUploadSize), sendBatchParallelism,
+		subStorage, time.Duration(idempotencyKeyTtl)*time.Second,
+		api.NewRateLimiter(rateLimitPerNumber, rateLimitPerNumberBurst), api.NewRateLimiter(rateLimitPerSub, rateLimitPerSubBurst),
+		webhookDispatcher)
+	err = sendQueue.Start()
+	if err != nil {
+		log.Fatal("Couldn't start send queue: ", err.Error())
+	}
+
+	err = scheduler.Start()
+	if err != nil {
+		log.Fatal("Couldn't start scheduler: ", err.Error())
+	}
+
+	err = webhookDispatcher.Start()
+	if err != nil {
+		log.Fatal("Couldn't start webhook dispatcher: ", err.Error())
+	}
+	signalClient.AddReceiveListener(webhookDispatcher.Dispatch)
+
+	messageRetentionDays, err := utils.GetIntEnv("MESSAGE_RETENTION_DAYS", 0)
+	if err != nil || messageRetentionDays < 0 {
+		log.Fatal("Invalid MESSAGE_RETENTION_DAYS set. MESSAGE_RETENTION_DAYS needs to be a number >= 0")
+	}
+
+	messageRetention := cron.New()
+	messageRetention.AddFunc("@hourly", func() {
+		err := signalClient.DeleteExpiredMessages(messageRetentionDays)
+		if err != nil {
+			log.Error("Couldn't delete expired messages: ", err.Error())
+		}
+	})
+	messageRetention.Start()
+
 	v1 := router.Group("/v1")
 	{
 		about := v1.Group("/about")
@@ -200,9 +365,20 @@ func main() {
 		// 	unregister.POST(":number", api.UnregisterNumber)
 		// }
 
+		accounts := v1.Group("/accounts")
+		{
+			accounts.POST(":number/rate-limit-challenge", api.SubmitRateLimitChallenge)
+		}
+
+		send := v1.Group("/send")
+		{
+			send.GET("jobs/:id", api.GetSendJob)
+		}
+
 		receive := v1.Group("/receive")
 		{
 			receive.GET(":number", api.Receive)
+			receive.GET(":number/events", api.ReceiveEvents)
 		}
 
 		groups := v1.Group("/groups")
@@ -257,6 +433,17 @@ func main() {
 			typingIndicator.DELETE(":number", api.SendStopTyping)
 		}
 
+		messages := v1.Group("/messages")
+		{
+			messages.GET(":number", api.GetMessages)
+			messages.DELETE(":number/:timestamp", api.RemoteDelete)
+		}
+
+		receipts := v1.Group("/receipts")
+		{
+			receipts.POST(":number", api.SendReceipt)
+		}
+
 		reactions := v1.Group("/reactions")
 		{
 			reactions.POST(":number", api.SendReaction)
@@ -276,6 +463,44 @@ func main() {
 			contacts.POST(":number/sync", api.SendContacts)
 		}
 
+		schedules := v1.Group("/schedules")
+		{
+			schedules.POST(":number", api.CreateSchedule)
+			schedules.GET(":number", api.GetSchedules)
+			schedules.GET(":number/:id", api.GetSchedule)
+			schedules.PUT(":number/:id", api.UpdateSchedule)
+			schedules.DELETE(":number/:id", api.DeleteSchedule)
+			schedules.GET(":number/:id/runs", api.GetScheduleRuns)
+		}
+
+		stickerPacks := v1.Group("/sticker-packs")
+		{
+			stickerPacks.GET(":number", api.ListStickerPacks)
+			stickerPacks.POST(":number", api.AddStickerPack)
+			stickerPacks.POST(":number/upload", api.UploadStickerPack)
+			stickerPacks.GET(":number/:packid/:stickerid", api.GetSticker)
+		}
+
+		templates := v1.Group("/templates")
+		{
+			templates.POST("", api.CreateTemplate)
+			templates.GET("", api.GetTemplates)
+			templates.GET(":id", api.GetTemplate)
+			templates.PUT(":id", api.UpdateTemplate)
+			templates.DELETE(":id", api.DeleteTemplate)
+		}
+
+		webhooks := v1.Group("/webhooks")
+		{
+			webhooks.POST(":number", api.CreateWebhook)
+			webhooks.GET(":number", api.GetWebhooks)
+			webhooks.DELETE(":number/:id", api.DeleteWebhook)
+			webhooks.GET(":number/:id/dead-letters", api.GetWebhookDeadLetters)
+			webhooks.POST(":number/:id/dead-letters/replay", api.ReplayWebhookDeadLetters)
+			webhooks.POST(":number/:id/dead-letters/:deliveryid/replay", api.ReplayWebhookDeadLetter)
+			webhooks.DELETE(":number/:id/dead-letters/:deliveryid", api.DeleteWebhookDeadLetter)
+		}
+
 		auth := v1.Group("/auth")
 		{
 			auth.GET("login/:number", api.Login)
@@ -287,8 +512,11 @@ func main() {
 	v2 := router.Group("/v2")
 	{
 		sendV2 := v2.Group("/send")
+		sendV2.Use(api.IdempotencyMiddleware())
 		{
 			sendV2.POST("", api.SendV2)
+			sendV2.POST("batch", api.SendBatch)
+			sendV2.PUT(":number/:timestamp", api.EditMessage)
 		}
 	}
 
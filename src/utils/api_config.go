@@ -39,6 +39,8 @@ func StringToTrustMode(trustMode string) (SignalCliTrustMode, error) {
 
 type SignalCliApiConfigEntry struct {
 	TrustMode      SignalCliTrustMode  `yaml:"trust_mode"`
+	// number of days received messages are stored; nil means the default applies
+	MessageRetentionDays *int `yaml:"message_retention_days,omitempty"`
 }
 
 type SignalCliApiConfigEntries struct {
@@ -83,7 +85,25 @@ func (c *SignalCliApiConfig) SetTrustModeForNumber(number string, trustMode Sign
 	if c.config.Entries == nil {
 		c.config.Entries = make(map[string]SignalCliApiConfigEntry)
 	}
-	c.config.Entries[number] = SignalCliApiConfigEntry{TrustMode: trustMode}
+	entry := c.config.Entries[number]
+	entry.TrustMode = trustMode
+	c.config.Entries[number] = entry
+}
+
+func (c *SignalCliApiConfig) GetMessageRetentionForNumber(number string) (int, bool) {
+	if val, ok := c.config.Entries[number]; ok && val.MessageRetentionDays != nil {
+		return *val.MessageRetentionDays, true
+	}
+	return 0, false
+}
+
+func (c *SignalCliApiConfig) SetMessageRetentionForNumber(number string, days int) {
+	if c.config.Entries == nil {
+		c.config.Entries = make(map[string]SignalCliApiConfigEntry)
+	}
+	entry := c.config.Entries[number]
+	entry.MessageRetentionDays = &days
+	c.config.Entries[number] = entry
 }
 
 func (c *SignalCliApiConfig) Persist() error {
@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"time"
+)
+
+// IdempotencyKey is the stored result of a request that was sent with an Idempotency-Key header.
+// While the request is still being processed, Status is 0 and RequestHash is empty.
+type IdempotencyKey struct {
+	Sub         string `gorm:"not null;unique_index:idx_idempotency_key_sub_key"`
+	Key         string `gorm:"not null;unique_index:idx_idempotency_key_sub_key"`
+	RequestHash string
+	Status      int
+	ContentType string
+	Response    []byte
+	CreatedAt   time.Time
+}
+
+// ReserveIdempotencyKey stores the key for the given sub as in progress. In case the key was already used
+// (and didn't expire yet), the existing entry is returned and reserved is false.
+func (s *SubStorage) ReserveIdempotencyKey(sub string, key string, ttl time.Duration) (*IdempotencyKey, bool, error) {
+	err := s.DB.Where("created_at < ?", time.Now().Add(-ttl)).Delete(&IdempotencyKey{}).Error
+	if err != nil {
+		return nil, false, err
+	}
+
+	if existing, ok := s.getIdempotencyKey(sub, key); ok {
+		return existing, false, nil
+	}
+
+	entry := IdempotencyKey{Sub: sub, Key: key}
+	err = s.Create(&entry).Error
+	if err != nil {
+		// the unique index makes sure that only one of two concurrent requests gets the key
+		if existing, ok := s.getIdempotencyKey(sub, key); ok {
+			return existing, false, nil
+		}
+		return nil, false, err
+	}
+	return &entry, true, nil
+}
+
+func (s *SubStorage) getIdempotencyKey(sub string, key string) (*IdempotencyKey, bool) {
+	entry := IdempotencyKey{}
+	err := s.DB.Model(&IdempotencyKey{}).Where("sub = ? AND key = ?", sub, key).First(&entry).Error
+	if err != nil {
+		return nil, false
+	}
+	return &entry, true
+}
+
+// CompleteIdempotencyKey stores the response of a request together with the hash of the request.
+func (s *SubStorage) CompleteIdempotencyKey(sub string, key string, requestHash string, status int, contentType string, response []byte) error {
+	return s.DB.Model(&IdempotencyKey{}).Where("sub = ? AND key = ?", sub, key).
+		Updates(map[string]interface{}{"request_hash": requestHash, "status": status, "content_type": contentType, "response": response}).Error
+}
+
+// ReleaseIdempotencyKey removes the key again, so that the request can be retried with it.
+func (s *SubStorage) ReleaseIdempotencyKey(sub string, key string) error {
+	return s.DB.Where("sub = ? AND key = ?", sub, key).Delete(&IdempotencyKey{}).Error
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+const (
+	SendJobQueued   = "queued"
+	SendJobSending  = "sending"
+	SendJobRetrying = "retrying"
+	SendJobSent     = "sent"
+	SendJobFailed   = "failed"
+)
+
+type SendJob struct {
+	ID            string `gorm:"primaryKey"`
+	Sub           string `gorm:"not null;index"`
+	Number        string `gorm:"not null;index"`
+	Status        string `gorm:"not null;index"`
+	Payload       string `gorm:"not null"`
+	Attempts      int    `gorm:"not null"`
+	LastError     string
+	Response      string
+	NextAttemptAt time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+type JobStorage struct {
+	*gorm.DB
+}
+
+func NewJobStorage(dbFile string) (*JobStorage, error) {
+	db, err := gorm.Open("sqlite3", dbFile)
+	if err != nil {
+		return nil, err
+	}
+	db = db.AutoMigrate(&SendJob{})
+	return &JobStorage{db}, nil
+}
+
+func (s *JobStorage) CreateJob(job *SendJob) error {
+	return s.Create(job).Error
+}
+
+func (s *JobStorage) SaveJob(job *SendJob) error {
+	return s.Save(job).Error
+}
+
+func (s *JobStorage) GetJob(id string) (*SendJob, bool) {
+	job := SendJob{}
+	err := s.DB.Model(&SendJob{}).Where("id = ?", id).First(&job).Error
+	if err != nil {
+		return nil, false
+	}
+	return &job, true
+}
+
+// GetUnfinishedJobs returns all jobs that haven't been delivered or given up on yet,
+// oldest first. Jobs that were in flight when the process stopped are included.
+func (s *JobStorage) GetUnfinishedJobs() ([]SendJob, error) {
+	jobs := []SendJob{}
+	err := s.DB.Model(&SendJob{}).
+		Where("status IN (?)", []string{SendJobQueued, SendJobSending, SendJobRetrying}).
+		Order("created_at asc").
+		Find(&jobs).Error
+	return jobs, err
+}
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"regexp"
+	"strings"
+)
+
+// placeholder the mention placeholders are replaced with while the markdown is parsed
+const mentionSentinel = '\uFFFC'
+
+var mentionPlaceholderRegex = regexp.MustCompile(`@\{([^{}\s]+)\}`)
+
+// Mention is a mention in a message. Start and Length are in UTF-16 code units.
+type Mention struct {
+	Start  int
+	Length int
+	Author string
+}
+
+// ParseMessage prepares a message for sending. If resolveMentions is set, placeholders like @{+491234567}
+// or @{uuid} are replaced with "@" followed by the display name returned by displayName, and a mention
+// is generated for each of them. If styled is set, the markdown formatting is parsed (see ParseMarkdown).
+// The offsets of the text styles and mentions refer to the final message.
+func ParseMessage(message string, styled bool, resolveMentions bool, displayName func(author string) string) (string, []TextStyle, []Mention) {
+	textStyles := []TextStyle{}
+	mentions := []Mention{}
+
+	// authors of the placeholders by the index of the sentinel (messages could contain sentinels already)
+	authors := map[int]string{}
+	if resolveMentions {
+		var sb strings.Builder
+		last := 0
+		numSentinels := 0
+		for _, match := range mentionPlaceholderRegex.FindAllStringSubmatchIndex(message, -1) {
+			sb.WriteString(message[last:match[0]])
+			numSentinels += strings.Count(message[last:match[0]], string(mentionSentinel))
+			authors[numSentinels] = message[match[2]:match[3]]
+			sb.WriteRune(mentionSentinel)
+			numSentinels++
+			last = match[1]
+		}
+		sb.WriteString(message[last:])
+		message = sb.String()
+	}
+
+	if styled {
+		message, textStyles = ParseMarkdown(message)
+	}
+
+	if len(authors) == 0 {
+		return message, textStyles, mentions
+	}
+
+	// replace the sentinels with the display names; the sentinels are one UTF-16 code unit long,
+	// so everything after a sentinel moves by the length of the display name minus one.
+	var sb strings.Builder
+	type shift struct {
+		offset int
+		delta  int
+	}
+	shifts := []shift{}
+	offset := 0
+	numSentinels := 0
+	for _, r := range message {
+		author, isPlaceholder := authors[numSentinels]
+		if r == mentionSentinel && isPlaceholder {
+			text := "@" + displayName(author)
+			length := utf16Length(text)
+			mentions = append(mentions, Mention{Start: offset, Length: length, Author: author})
+			shifts = append(shifts, shift{offset: offset, delta: length - 1})
+			sb.WriteString(text)
+		} else {
+			sb.WriteRune(r)
+		}
+		if r == mentionSentinel {
+			numSentinels++
+		}
+		offset += utf16Length(string(r))
+	}
+
+	newOffset := func(offset int) int {
+		newOffset := offset
+		for _, s := range shifts {
+			if s.offset < offset {
+				newOffset += s.delta
+			}
+		}
+		return newOffset
+	}
+
+	for i := range mentions {
+		mentions[i].Start = newOffset(mentions[i].Start)
+	}
+
+	for i := range textStyles {
+		start := newOffset(textStyles[i].Start)
+		end := newOffset(textStyles[i].Start + textStyles[i].Length)
+		textStyles[i].Start = start
+		textStyles[i].Length = end - start
+	}
+
+	return sb.String(), textStyles, mentions
+}
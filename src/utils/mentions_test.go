@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMessageMentions(t *testing.T) {
+	displayNames := map[string]string{"+491234567": "Alice", "b2c9e0a4-1234-4f5e-9abc-0123456789ab": "Bob 👋"}
+	displayName := func(author string) string {
+		if name, ok := displayNames[author]; ok {
+			return name
+		}
+		return author
+	}
+
+	testCases := []struct {
+		nameTest           string
+		input              string
+		styled             bool
+		messageExpected    string
+		textStylesExpected []TextStyle
+		mentionsExpected   []Mention
+	}{
+		{
+			"number", "Hi @{+491234567}!", false,
+			"Hi @Alice!", []TextStyle{}, []Mention{{3, 6, "+491234567"}},
+		},
+		{
+			"uuid with emoji in display name", "@{b2c9e0a4-1234-4f5e-9abc-0123456789ab} and @{+491234567}", false,
+			"@Bob 👋 and @Alice", []TextStyle{}, []Mention{{0, 7, "b2c9e0a4-1234-4f5e-9abc-0123456789ab"}, {12, 6, "+491234567"}},
+		},
+		{
+			"unknown contact", "ping @{+4900000}", false,
+			"ping @+4900000", []TextStyle{}, []Mention{{5, 9, "+4900000"}},
+		},
+		{
+			"styles are shifted", "*hey* @{+491234567} **look**", true,
+			"hey @Alice look", []TextStyle{{0, 3, Italic}, {11, 4, Bold}}, []Mention{{4, 6, "+491234567"}},
+		},
+		{
+			"mention inside style", "**hey @{+491234567}**", true,
+			"hey @Alice", []TextStyle{{0, 10, Bold}}, []Mention{{4, 6, "+491234567"}},
+		},
+		{
+			"existing object replacement character", "￼ @{+491234567}", false,
+			"￼ @Alice", []TextStyle{}, []Mention{{2, 6, "+491234567"}},
+		},
+		{
+			"no placeholders", "*plain*", false,
+			"*plain*", []TextStyle{}, []Mention{},
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.nameTest, func(t *testing.T) {
+			message, textStyles, mentions := ParseMessage(tt.input, tt.styled, true, displayName)
+
+			if message != tt.messageExpected {
+				t.Errorf("message got %q, want %q", message, tt.messageExpected)
+			}
+
+			if !reflect.DeepEqual(textStyles, tt.textStylesExpected) {
+				t.Errorf("text styles got %v, want %v", textStyles, tt.textStylesExpected)
+			}
+
+			if !reflect.DeepEqual(mentions, tt.mentionsExpected) {
+				t.Errorf("mentions got %v, want %v", mentions, tt.mentionsExpected)
+			}
+		})
+	}
+}
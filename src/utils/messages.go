@@ -0,0 +1,246 @@
+package utils
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	log "github.com/sirupsen/logrus"
+)
+
+// types of the stored messages
+const (
+	MessageTypeMessage      = "message"
+	MessageTypeEdit         = "edit"
+	MessageTypeReaction     = "reaction"
+	MessageTypeRemoteDelete = "remote_delete"
+	MessageTypeSync         = "sync"
+	MessageTypeReceipt      = "receipt"
+	MessageTypeTyping       = "typing"
+	MessageTypeStory        = "story"
+	MessageTypeCall         = "call"
+	MessageTypeOther        = "other"
+)
+
+func IsValidMessageType(messageType string) bool {
+	switch messageType {
+	case MessageTypeMessage, MessageTypeEdit, MessageTypeReaction, MessageTypeRemoteDelete, MessageTypeSync,
+		MessageTypeReceipt, MessageTypeTyping, MessageTypeStory, MessageTypeCall, MessageTypeOther:
+		return true
+	}
+	return false
+}
+
+// StoredMessage is a received envelope. The timestamp is the one of the envelope (in milliseconds), the
+// group id is in the format of the REST API (group.xxx).
+type StoredMessage struct {
+	ID        uint   `gorm:"primary_key"`
+	Account   string `gorm:"not null;index:idx_message_account_timestamp,idx_message_sender,idx_message_group,idx_message_type"`
+	Sender    string `gorm:"index:idx_message_sender"`
+	GroupId   string `gorm:"index:idx_message_group"`
+	Type      string `gorm:"index:idx_message_type"`
+	Timestamp int64  `gorm:"not null;index:idx_message_account_timestamp,idx_message_sender,idx_message_group,idx_message_type"`
+	Message   string
+	Envelope  string `gorm:"not null"`
+	CreatedAt time.Time
+}
+
+type MessageFilter struct {
+	Account string
+	Sender  string
+	GroupId string
+	Type    string
+	// only messages with a timestamp in [From, To] are returned; 0 means no limit
+	From int64
+	To   int64
+	// full text search in the message text
+	Query  string
+	Limit  int
+	Cursor string
+}
+
+type MessageStorage struct {
+	*gorm.DB
+	// whether the sqlite library was built with FTS5; if not, the full text search falls back to LIKE
+	fullTextSearch bool
+}
+
+func NewMessageStorage(dbFile string) (*MessageStorage, error) {
+	db, err := gorm.Open("sqlite3", dbFile)
+	if err != nil {
+		return nil, err
+	}
+	db = db.AutoMigrate(&StoredMessage{})
+	s := &MessageStorage{DB: db}
+
+	err = s.createFullTextIndex()
+	if err != nil {
+		log.Info("Full text search of stored messages falls back to LIKE queries (FTS5 not available: ", err.Error(), ")")
+	} else {
+		s.fullTextSearch = true
+	}
+	return s, nil
+}
+
+// createFullTextIndex creates a FTS5 index of the message texts that is kept up to date by triggers.
+func (s *MessageStorage) createFullTextIndex() error {
+	var count int
+	err := s.DB.Raw("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'stored_messages_fts'").Row().Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	statements := []string{
+		"CREATE VIRTUAL TABLE stored_messages_fts USING fts5(message, content='stored_messages', content_rowid='id')",
+		`CREATE TRIGGER IF NOT EXISTS stored_messages_fts_insert AFTER INSERT ON stored_messages BEGIN
+			INSERT INTO stored_messages_fts(rowid, message) VALUES (new.id, new.message);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS stored_messages_fts_delete AFTER DELETE ON stored_messages BEGIN
+			INSERT INTO stored_messages_fts(stored_messages_fts, rowid, message) VALUES ('delete', old.id, old.message);
+		END`,
+		// index the messages that were stored before the index existed
+		"INSERT INTO stored_messages_fts(stored_messages_fts) VALUES ('rebuild')",
+	}
+	for _, statement := range statements {
+		err = s.DB.Exec(statement).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MessageStorage) StoreMessage(message *StoredMessage) error {
+	return s.Create(message).Error
+}
+
+// StoreMessages stores several messages in one transaction.
+func (s *MessageStorage) StoreMessages(messages []*StoredMessage) error {
+	tx := s.Begin()
+	for _, message := range messages {
+		err := tx.Create(message).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+func encodeMessageCursor(message *StoredMessage) string {
+	cursor := strconv.FormatInt(message.Timestamp, 10) + ":" + strconv.FormatUint(uint64(message.ID), 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(cursor))
+}
+
+func decodeMessageCursor(cursor string) (int64, uint, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, 0, errors.New("Invalid cursor")
+	}
+	parts := strings.Split(string(data), ":")
+	if len(parts) != 2 {
+		return 0, 0, errors.New("Invalid cursor")
+	}
+	timestamp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, errors.New("Invalid cursor")
+	}
+	id, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return 0, 0, errors.New("Invalid cursor")
+	}
+	return timestamp, uint(id), nil
+}
+
+// GetMessages returns the messages that match the filter, newest first. In case there are more messages,
+// the cursor of the next page is returned as well.
+func (s *MessageStorage) GetMessages(filter MessageFilter) ([]StoredMessage, string, error) {
+	query := s.DB.Model(&StoredMessage{}).Where("account = ?", filter.Account)
+	if filter.Sender != "" {
+		query = query.Where("sender = ?", filter.Sender)
+	}
+	if filter.GroupId != "" {
+		query = query.Where("group_id = ?", filter.GroupId)
+	}
+	if filter.Type != "" {
+		query = query.Where("type = ?", filter.Type)
+	}
+	if filter.From != 0 {
+		query = query.Where("timestamp >= ?", filter.From)
+	}
+	if filter.To != 0 {
+		query = query.Where("timestamp <= ?", filter.To)
+	}
+
+	terms := strings.Fields(filter.Query)
+	if len(terms) > 0 {
+		if s.fullTextSearch {
+			// every term is quoted, so that the FTS5 query syntax doesn't need to be known
+			quotedTerms := []string{}
+			for _, term := range terms {
+				quotedTerms = append(quotedTerms, `"`+strings.Replace(term, `"`, `""`, -1)+`"`)
+			}
+			query = query.Where("id IN (SELECT rowid FROM stored_messages_fts WHERE stored_messages_fts MATCH ?)", strings.Join(quotedTerms, " "))
+		} else {
+			escaper := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+			for _, term := range terms {
+				query = query.Where(`message LIKE ? ESCAPE '\'`, "%"+escaper.Replace(term)+"%")
+			}
+		}
+	}
+
+	if filter.Cursor != "" {
+		timestamp, id, err := decodeMessageCursor(filter.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		query = query.Where("timestamp < ? OR (timestamp = ? AND id < ?)", timestamp, timestamp, id)
+	}
+
+	messages := []StoredMessage{}
+	err := query.Order("timestamp desc").Order("id desc").Limit(filter.Limit + 1).Find(&messages).Error
+	if err != nil {
+		return nil, "", err
+	}
+
+	nextCursor := ""
+	if len(messages) > filter.Limit {
+		messages = messages[:filter.Limit]
+		nextCursor = encodeMessageCursor(&messages[len(messages)-1])
+	}
+	return messages, nextCursor, nil
+}
+
+// GetMessagesSince returns the messages of the account that come after the given timestamp (in milliseconds)
+// and id, oldest first. Messages with the same timestamp are ordered by their id; with an id of 0, all
+// messages with the given timestamp are returned.
+func (s *MessageStorage) GetMessagesSince(account string, timestamp int64, id uint, limit int) ([]StoredMessage, error) {
+	messages := []StoredMessage{}
+	err := s.DB.Model(&StoredMessage{}).
+		Where("account = ?", account).
+		Where("timestamp > ? OR (timestamp = ? AND id > ?)", timestamp, timestamp, id).
+		Order("timestamp asc").Order("id asc").
+		Limit(limit).
+		Find(&messages).Error
+	return messages, err
+}
+
+// GetAccounts returns all numbers messages were stored for.
+func (s *MessageStorage) GetAccounts() ([]string, error) {
+	accounts := []string{}
+	err := s.DB.Model(&StoredMessage{}).Pluck("DISTINCT account", &accounts).Error
+	return accounts, err
+}
+
+// DeleteMessagesBefore deletes the messages of the account that are older than the given timestamp (in milliseconds).
+func (s *MessageStorage) DeleteMessagesBefore(account string, timestamp int64) (int64, error) {
+	result := s.DB.Where("account = ? AND timestamp < ?", account, timestamp).Delete(&StoredMessage{})
+	return result.RowsAffected, result.Error
+}
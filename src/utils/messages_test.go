@@ -0,0 +1,209 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestMessageStorage(t *testing.T) *MessageStorage {
+	dir, err := ioutil.TempDir("", "messages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	s, err := NewMessageStorage(filepath.Join(dir, "messages.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	messages := []StoredMessage{
+		{Account: "+491111", Sender: "+492222", Type: MessageTypeMessage, Timestamp: 1000, Message: "Hello world"},
+		{Account: "+491111", Sender: "+493333", Type: MessageTypeMessage, Timestamp: 2000, Message: "100% sure", GroupId: "group.abc"},
+		{Account: "+491111", Sender: "+492222", Type: MessageTypeReceipt, Timestamp: 3000},
+		{Account: "+491111", Sender: "+492222", Type: MessageTypeMessage, Timestamp: 3000, Message: "hello again"},
+		{Account: "+494444", Sender: "+492222", Type: MessageTypeMessage, Timestamp: 4000, Message: "Hello other account"},
+	}
+	for i := range messages {
+		messages[i].Envelope = "{}"
+		if err := s.StoreMessage(&messages[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func messageTimestamps(messages []StoredMessage) []int64 {
+	timestamps := []int64{}
+	for _, message := range messages {
+		timestamps = append(timestamps, message.Timestamp)
+	}
+	return timestamps
+}
+
+func TestGetMessagesFilter(t *testing.T) {
+	s := newTestMessageStorage(t)
+
+	testCases := []struct {
+		nameTest string
+		filter   MessageFilter
+		expected int
+	}{
+		{"account", MessageFilter{Account: "+491111"}, 4},
+		{"sender", MessageFilter{Account: "+491111", Sender: "+493333"}, 1},
+		{"group", MessageFilter{Account: "+491111", GroupId: "group.abc"}, 1},
+		{"type", MessageFilter{Account: "+491111", Type: MessageTypeReceipt}, 1},
+		{"time range", MessageFilter{Account: "+491111", From: 2000, To: 2999}, 1},
+		{"search", MessageFilter{Account: "+491111", Query: "hello"}, 2},
+		{"search all terms", MessageFilter{Account: "+491111", Query: "hello again"}, 1},
+		{"search special characters", MessageFilter{Account: "+491111", Query: "100%"}, 1},
+	}
+
+	for _, testCase := range testCases {
+		testCase.filter.Limit = 10
+		messages, nextCursor, err := s.GetMessages(testCase.filter)
+		if err != nil {
+			t.Fatalf("%s: %s", testCase.nameTest, err.Error())
+		}
+		if len(messages) != testCase.expected {
+			t.Errorf("%s: expected %d messages, got %d", testCase.nameTest, testCase.expected, len(messages))
+		}
+		if nextCursor != "" {
+			t.Errorf("%s: expected no cursor, got %s", testCase.nameTest, nextCursor)
+		}
+	}
+}
+
+func TestGetMessagesPagination(t *testing.T) {
+	s := newTestMessageStorage(t)
+
+	timestamps := []int64{}
+	filter := MessageFilter{Account: "+491111", Limit: 3}
+	for page := 0; ; page++ {
+		if page > 2 {
+			t.Fatal("expected the last page to have no cursor")
+		}
+		messages, nextCursor, err := s.GetMessages(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		timestamps = append(timestamps, messageTimestamps(messages)...)
+		if nextCursor == "" {
+			break
+		}
+		filter.Cursor = nextCursor
+	}
+
+	expected := []int64{3000, 3000, 2000, 1000}
+	if len(timestamps) != len(expected) {
+		t.Fatalf("expected timestamps %v, got %v", expected, timestamps)
+	}
+	for i := range expected {
+		if timestamps[i] != expected[i] {
+			t.Fatalf("expected timestamps %v, got %v", expected, timestamps)
+		}
+	}
+}
+
+func TestGetMessagesInvalidCursor(t *testing.T) {
+	s := newTestMessageStorage(t)
+
+	_, _, err := s.GetMessages(MessageFilter{Account: "+491111", Limit: 10, Cursor: "invalid"})
+	if err == nil {
+		t.Error("expected an error for an invalid cursor")
+	}
+}
+
+func TestDeleteMessagesBefore(t *testing.T) {
+	s := newTestMessageStorage(t)
+
+	deleted, err := s.DeleteMessagesBefore("+491111", 2500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 {
+		t.Errorf("expected 2 deleted messages, got %d", deleted)
+	}
+
+	accounts, err := s.GetAccounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 2 {
+		t.Errorf("expected 2 accounts, got %v", accounts)
+	}
+}
+
+func TestGetMessagesSince(t *testing.T) {
+	s := newTestMessageStorage(t)
+
+	messages, err := s.GetMessagesSince("+491111", 1500, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamps := messageTimestamps(messages)
+	expected := []int64{2000, 3000, 3000}
+	if len(timestamps) != len(expected) || timestamps[0] != 2000 || timestamps[2] != 3000 {
+		t.Errorf("expected timestamps %v, got %v", expected, timestamps)
+	}
+
+	messages, err = s.GetMessagesSince("+491111", 1500, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].Timestamp != 2000 {
+		t.Errorf("expected the oldest message only, got %v", messageTimestamps(messages))
+	}
+
+	// without an id, all messages with the timestamp are returned
+	messages, err = s.GetMessagesSince("+491111", 3000, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 {
+		t.Errorf("expected both messages with timestamp 3000, got %v", messageTimestamps(messages))
+	}
+
+	// paging through messages with the same timestamp
+	messages, err = s.GetMessagesSince("+491111", 2500, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0].Timestamp != 3000 || messages[1].Timestamp != 3000 {
+		t.Fatalf("expected both messages with timestamp 3000, got %v", messageTimestamps(messages))
+	}
+	next, err := s.GetMessagesSince("+491111", messages[0].Timestamp, messages[0].ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(next) != 1 || next[0].ID != messages[1].ID {
+		t.Errorf("expected the second message with timestamp 3000, got %v", next)
+	}
+}
+
+func TestStoreMessages(t *testing.T) {
+	s := newTestMessageStorage(t)
+
+	messages := []*StoredMessage{
+		{Account: "+495555", Type: MessageTypeMessage, Timestamp: 1000, Envelope: "{}"},
+		{Account: "+495555", Type: MessageTypeReceipt, Timestamp: 2000, Envelope: "{}"},
+	}
+	err := s.StoreMessages(messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messages[0].ID == 0 || messages[1].ID == 0 {
+		t.Error("expected the ids of the stored messages to be set")
+	}
+
+	stored, err := s.GetMessagesSince("+495555", 0, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 2 {
+		t.Errorf("expected 2 stored messages, got %v", messageTimestamps(stored))
+	}
+}
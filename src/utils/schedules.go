@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+type Schedule struct {
+	ID        string `gorm:"primaryKey"`
+	Sub       string `gorm:"not null;index"`
+	Number    string `gorm:"not null;index"`
+	Payload   string `gorm:"not null"`
+	SendAt    *time.Time
+	Cron      string
+	Active    bool `gorm:"not null"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+type ScheduleRun struct {
+	ID         uint   `gorm:"primaryKey"`
+	ScheduleID string `gorm:"not null;index"`
+	RunAt      time.Time
+	Success    bool
+	Error      string
+	Response   string
+}
+
+type ScheduleStorage struct {
+	*gorm.DB
+}
+
+func NewScheduleStorage(dbFile string) (*ScheduleStorage, error) {
+	db, err := gorm.Open("sqlite3", dbFile)
+	if err != nil {
+		return nil, err
+	}
+	db = db.AutoMigrate(&Schedule{}, &ScheduleRun{})
+	return &ScheduleStorage{db}, nil
+}
+
+func (s *ScheduleStorage) CreateSchedule(schedule *Schedule) error {
+	return s.Create(schedule).Error
+}
+
+func (s *ScheduleStorage) SaveSchedule(schedule *Schedule) error {
+	return s.Save(schedule).Error
+}
+
+// DeactivateSchedule marks a schedule as inactive, unless it was changed after updatedAt. It reports
+// whether the schedule was deactivated.
+func (s *ScheduleStorage) DeactivateSchedule(id string, updatedAt time.Time) (bool, error) {
+	result := s.DB.Model(&Schedule{}).Where("id = ? AND updated_at = ?", id, updatedAt).Update("active", false)
+	return result.RowsAffected > 0, result.Error
+}
+
+func (s *ScheduleStorage) GetSchedule(id string) (*Schedule, bool) {
+	schedule := Schedule{}
+	err := s.DB.Model(&Schedule{}).Where("id = ?", id).First(&schedule).Error
+	if err != nil {
+		return nil, false
+	}
+	return &schedule, true
+}
+
+func (s *ScheduleStorage) GetSchedulesByNumber(number string) ([]Schedule, error) {
+	schedules := []Schedule{}
+	err := s.DB.Model(&Schedule{}).Where("number = ?", number).Order("created_at asc").Find(&schedules).Error
+	return schedules, err
+}
+
+func (s *ScheduleStorage) GetActiveSchedules() ([]Schedule, error) {
+	schedules := []Schedule{}
+	err := s.DB.Model(&Schedule{}).Where("active = ?", true).Find(&schedules).Error
+	return schedules, err
+}
+
+func (s *ScheduleStorage) DeleteSchedule(id string) error {
+	err := s.DB.Where("schedule_id = ?", id).Delete(&ScheduleRun{}).Error
+	if err != nil {
+		return err
+	}
+	return s.DB.Where("id = ?", id).Delete(&Schedule{}).Error
+}
+
+func (s *ScheduleStorage) AddScheduleRun(run *ScheduleRun) error {
+	return s.Create(run).Error
+}
+
+// GetScheduleRuns returns the run history of a schedule, most recent run first.
+func (s *ScheduleStorage) GetScheduleRuns(id string, limit int) ([]ScheduleRun, error) {
+	runs := []ScheduleRun{}
+	err := s.DB.Model(&ScheduleRun{}).Where("schedule_id = ?", id).Order("run_at desc").Limit(limit).Find(&runs).Error
+	return runs, err
+}
@@ -41,7 +41,7 @@ func NewSubStorage(dbFile string) (*SubStorage, error) {
 	if err != nil {
 		return nil, err
 	}
-	db = db.AutoMigrate(&LinkedNumber{})
+	db = db.AutoMigrate(&LinkedNumber{}, &IdempotencyKey{})
 	return &SubStorage{db}, nil
 }
 
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+type Template struct {
+	ID                string `gorm:"primaryKey"`
+	Sub               string `gorm:"not null;unique_index:idx_template_sub_name"`
+	Name              string `gorm:"not null;unique_index:idx_template_sub_name"`
+	Body              string `gorm:"not null"`
+	TextMode          string
+	Mentions          string
+	Base64Attachments string
+	AttachmentUrls    string
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+}
+
+type TemplateStorage struct {
+	*gorm.DB
+}
+
+func NewTemplateStorage(dbFile string) (*TemplateStorage, error) {
+	db, err := gorm.Open("sqlite3", dbFile)
+	if err != nil {
+		return nil, err
+	}
+	db = db.AutoMigrate(&Template{})
+	return &TemplateStorage{db}, nil
+}
+
+func (s *TemplateStorage) CreateTemplate(template *Template) error {
+	return s.Create(template).Error
+}
+
+func (s *TemplateStorage) SaveTemplate(template *Template) error {
+	return s.Save(template).Error
+}
+
+// GetTemplate returns the template with the given id, if it belongs to the given sub.
+func (s *TemplateStorage) GetTemplate(sub string, id string) (*Template, bool) {
+	template := Template{}
+	err := s.DB.Model(&Template{}).Where("id = ? AND sub = ?", id, sub).First(&template).Error
+	if err != nil {
+		return nil, false
+	}
+	return &template, true
+}
+
+func (s *TemplateStorage) GetTemplateByName(sub string, name string) (*Template, bool) {
+	template := Template{}
+	err := s.DB.Model(&Template{}).Where("sub = ? AND name = ?", sub, name).First(&template).Error
+	if err != nil {
+		return nil, false
+	}
+	return &template, true
+}
+
+func (s *TemplateStorage) GetTemplates(sub string) ([]Template, error) {
+	templates := []Template{}
+	err := s.DB.Model(&Template{}).Where("sub = ?", sub).Order("name asc").Find(&templates).Error
+	return templates, err
+}
+
+func (s *TemplateStorage) DeleteTemplate(sub string, id string) error {
+	return s.DB.Where("id = ? AND sub = ?", id, sub).Delete(&Template{}).Error
+}
@@ -1,116 +1,296 @@
 package utils
 
 import (
+	"sort"
 	"strconv"
+	"strings"
+	"unicode"
 )
 
 const (
-	Normal string = "NORMAL"
-	Bold          = "BOLD"
-	Italic        = "ITALIC"
-	Monospace     = "MONOSPACE"
-	Strikethrough = "STRIKETHROUGH"
+	Normal        string = "NORMAL"
+	Bold                 = "BOLD"
+	Italic               = "ITALIC"
+	Monospace            = "MONOSPACE"
+	Strikethrough        = "STRIKETHROUGH"
+	Spoiler              = "SPOILER"
 )
 
-const (
-	None        int    = 0
-	ItalicBegin        = 1
-	ItalicEnd          = 2
-	BoldBegin          = 3
-	BoldEnd1           = 4
-	BoldEnd2           = 5
-	MonoSpaceBegin     = 6
-	MonoSpaceEnd       = 7
-	StrikethroughBegin = 8
-	StrikethroughEnd   = 9
-)
+// characters that can be escaped with a backslash to be taken literally (the formatting characters and the backslash itself)
+const escapableCharacters = "\\*~`|"
+
+// TextStyle is a styled range of a message. Start and Length are in UTF-16 code units,
+// which is what Signal expects.
+type TextStyle struct {
+	Start  int
+	Length int
+	Style  string
+}
+
+// String returns the text style in the format signal-cli expects (start:length:STYLE).
+func (t TextStyle) String() string {
+	return strconv.Itoa(t.Start) + ":" + strconv.Itoa(t.Length) + ":" + t.Style
+}
+
+type markdownToken struct {
+	text    string // the literal text (for delimiters: the delimiter itself)
+	marker  string // the delimiter; empty for plain text
+	partner int    // index of the matching delimiter, -1 if unmatched
+	// set for both halves of an opening *** run as long as it isn't known yet which of them is
+	// the bold and which the italic delimiter (see decide)
+	undecided bool
+}
 
-func getUtf16CharacterCount(s string) int {
-	stringLength := len(s)
-	if stringLength == 1 {
-		return 1
+type markdownParser struct {
+	runes  []rune
+	tokens []markdownToken
+	// indices of the delimiter tokens that were opened, but not closed yet
+	openers []int
+}
+
+func styleForMarker(marker string) string {
+	switch marker {
+	case "*":
+		return Italic
+	case "**":
+		return Bold
+	case "~", "~~":
+		return Strikethrough
+	case "||":
+		return Spoiler
+	case "`":
+		return Monospace
 	}
-	return stringLength/2
+	return Normal
 }
 
-func getAdditionalCharacterCount(characterCount int) int {
-	additionalCharacterCount := characterCount - 1
-	if additionalCharacterCount > 0 {
-		return additionalCharacterCount
+func utf16Length(s string) int {
+	length := 0
+	for _, r := range s {
+		if r >= 0x10000 {
+			length += 2
+		} else {
+			length += 1
+		}
 	}
-	return 0
+	return length
 }
 
-func ParseMarkdownMessage(message string) (string, []string) {
-	textFormat := Normal
-	textFormatBegin := 0
-	textFormatLength := 0
-	numOfControlChars := 0
-	state := None
-	signalCliFormatStrings := []string{}
-	fullString := ""
-	lastChar := ""
-	additionalCharacterCount := 0
-
-	runes := []rune(message) //turn string to slice
-
-	for i, v := range runes { //iterate through rune
-		if v == '*' {
-			if state == ItalicBegin {
-				if lastChar == "*" {
-					state = BoldBegin
-					textFormat = Bold
-					textFormatBegin = i - numOfControlChars + additionalCharacterCount
-					textFormatLength = 0
+func (p *markdownParser) addText(text string) {
+	if n := len(p.tokens); n > 0 && p.tokens[n-1].marker == "" && !p.tokens[n-1].undecided {
+		p.tokens[n-1].text += text
+		return
+	}
+	p.tokens = append(p.tokens, markdownToken{text: text, partner: -1})
+}
+
+func (p *markdownParser) isSpaceAt(i int) bool {
+	return i < 0 || i >= len(p.runes) || unicode.IsSpace(p.runes[i])
+}
+
+func (p *markdownParser) findOpener(marker string) int {
+	for i := len(p.openers) - 1; i >= 0; i-- {
+		token := p.tokens[p.openers[i]]
+		if token.marker == marker || (token.undecided && (marker == "*" || marker == "**")) {
+			return i
+		}
+	}
+	return -1
+}
+
+// decide splits an opening *** run once its inner half (at index inner) is closed by marker: the
+// inner half becomes that delimiter, the outer half the other one (like CommonMark does).
+func (p *markdownParser) decide(inner int, marker string) {
+	outerMarker := "**"
+	if marker == "**" {
+		outerMarker = "*"
+	}
+	p.tokens[inner] = markdownToken{text: marker, marker: marker, partner: -1}
+	p.tokens[inner-1] = markdownToken{text: outerMarker, marker: outerMarker, partner: -1}
+}
+
+// addDelimiter adds a delimiter that starts at rune index start and ends before rune index end.
+// It either closes the innermost open delimiter of the same kind, opens a new one or ends up as literal text.
+func (p *markdownParser) addDelimiter(marker string, start int, end int) {
+	canOpen := !p.isSpaceAt(end)
+	canClose := !p.isSpaceAt(start - 1)
+
+	if canClose {
+		if i := p.findOpener(marker); i != -1 && p.openers[i] != len(p.tokens)-1 {
+			opener := p.openers[i]
+			if p.tokens[opener].undecided {
+				p.decide(opener, marker)
+			}
+			p.tokens[opener].partner = len(p.tokens)
+			p.tokens = append(p.tokens, markdownToken{text: marker, marker: marker, partner: opener})
+			// delimiters that were opened in between can't be closed anymore (no overlapping styles)
+			p.openers = p.openers[:i]
+			return
+		}
+	}
+
+	if canOpen {
+		p.openers = append(p.openers, len(p.tokens))
+		p.tokens = append(p.tokens, markdownToken{text: marker, marker: marker, partner: -1})
+		return
+	}
+
+	p.addText(marker)
+}
+
+// addTripleOpener adds a *** run that starts at rune index start and can't close anything.
+func (p *markdownParser) addTripleOpener(start int) {
+	if p.isSpaceAt(start + 3) {
+		p.addText("***")
+		return
+	}
+	p.openers = append(p.openers, len(p.tokens), len(p.tokens)+1)
+	p.tokens = append(p.tokens, markdownToken{text: "**", partner: -1, undecided: true})
+	p.tokens = append(p.tokens, markdownToken{text: "*", partner: -1, undecided: true})
+}
+
+func (p *markdownParser) runLength(i int, r rune) int {
+	n := 0
+	for i+n < len(p.runes) && p.runes[i+n] == r {
+		n++
+	}
+	return n
+}
+
+// findCodeSpanEnd returns the rune index of the backtick run of exactly length n that closes the code span, or -1.
+func (p *markdownParser) findCodeSpanEnd(from int, n int) int {
+	for i := from; i < len(p.runes); {
+		if p.runes[i] != '`' {
+			i++
+			continue
+		}
+		runLength := p.runLength(i, '`')
+		if runLength == n {
+			return i
+		}
+		i += runLength
+	}
+	return -1
+}
+
+func (p *markdownParser) parse() {
+	for i := 0; i < len(p.runes); {
+		r := p.runes[i]
+		switch r {
+		case '\\':
+			if i+1 < len(p.runes) && strings.ContainsRune(escapableCharacters, p.runes[i+1]) {
+				p.addText(string(p.runes[i+1]))
+				i += 2
+				continue
+			}
+			p.addText(string(r))
+			i++
+		case '`':
+			n := p.runLength(i, '`')
+			end := p.findCodeSpanEnd(i+n, n)
+			if end == -1 || end == i+n {
+				p.addText(strings.Repeat("`", n))
+				i += n
+				continue
+			}
+			// the content of a code span is taken literally
+			opener := len(p.tokens)
+			p.tokens = append(p.tokens, markdownToken{text: "`", marker: "`", partner: opener + 2})
+			p.tokens = append(p.tokens, markdownToken{text: string(p.runes[i+n : end]), partner: -1})
+			p.tokens = append(p.tokens, markdownToken{text: "`", marker: "`", partner: opener})
+			i = end + n
+		case '*':
+			n := p.runLength(i, '*')
+			switch n {
+			case 1:
+				p.addDelimiter("*", i, i+1)
+			case 2:
+				p.addDelimiter("**", i, i+2)
+			case 3:
+				// ***text*** is bold and italic; close the delimiter that was opened last first.
+				// An opening run is split by the delimiter that closes it first.
+				italic, bold := p.findOpener("*"), p.findOpener("**")
+				if italic == -1 && bold == -1 {
+					p.addTripleOpener(i)
+				} else if italic >= bold {
+					p.addDelimiter("*", i, i+1)
+					p.addDelimiter("**", i+1, i+3)
 				} else {
-					state = ItalicEnd
+					p.addDelimiter("**", i, i+2)
+					p.addDelimiter("*", i+2, i+3)
 				}
-			} else if state == None {
-				state = ItalicBegin
-				textFormat = Italic
-				textFormatBegin = i - numOfControlChars + additionalCharacterCount
-				textFormatLength = 0
-			} else if state == BoldBegin {
-				state = BoldEnd1
-			} else if state == BoldEnd1 {
-				state = BoldEnd2
+			default:
+				p.addText(strings.Repeat("*", n))
 			}
-			numOfControlChars += 1
-		} else if v == '`' {
-			if state == None {
-				state = MonoSpaceBegin
-				textFormat = Monospace
-				textFormatBegin = i - numOfControlChars + additionalCharacterCount
-				textFormatLength = 0
-			} else if state == MonoSpaceBegin {
-				state = MonoSpaceEnd
+			i += n
+		case '~':
+			n := p.runLength(i, '~')
+			if n <= 2 {
+				p.addDelimiter(strings.Repeat("~", n), i, i+n)
+			} else {
+				p.addText(strings.Repeat("~", n))
 			}
-			numOfControlChars += 1
-		} else if v == '~' {
-			if state == None {
-				state = StrikethroughBegin
-				textFormat = Strikethrough
-				textFormatBegin = i - numOfControlChars + additionalCharacterCount
-				textFormatLength = 0
-			} else if state == StrikethroughBegin {
-				state = StrikethroughEnd
+			i += n
+		case '|':
+			n := p.runLength(i, '|')
+			if n == 2 {
+				p.addDelimiter("||", i, i+n)
+			} else {
+				p.addText(strings.Repeat("|", n))
 			}
-			numOfControlChars += 1
-		} else {
-			textFormatLength += 1
-			fullString += string(v)
-			additionalCharacterCount += getAdditionalCharacterCount(getUtf16CharacterCount(string(v)))
+			i += n
+		default:
+			p.addText(string(r))
+			i++
+		}
+	}
+}
+
+// ParseMarkdown converts a message with markdown like formatting into the plain message and the
+// text styles Signal needs to render it. Supported are **bold**, *italic*, ~strikethrough~,
+// ||spoiler||, `monospace` (the content of a code span is not parsed any further) and nested
+// combinations of them. A backslash escapes the following formatting character.
+func ParseMarkdown(message string) (string, []TextStyle) {
+	p := markdownParser{runes: []rune(message)}
+	p.parse()
+
+	var sb strings.Builder
+	textStyles := []TextStyle{}
+	starts := make([]int, len(p.tokens))
+	offset := 0
+	for i, token := range p.tokens {
+		if token.marker == "" || token.partner == -1 {
+			sb.WriteString(token.text)
+			offset += utf16Length(token.text)
+			continue
 		}
-		lastChar = string(v)
-
-		if state == ItalicEnd || state == BoldEnd2 || state == MonoSpaceEnd || state == StrikethroughEnd {
-			signalCliFormatStrings = append(signalCliFormatStrings, strconv.Itoa(textFormatBegin)+":"+strconv.Itoa(textFormatLength + additionalCharacterCount)+":"+textFormat)
-			state = None
-			textFormatBegin = 0
-			textFormatLength = 0
-			textFormat = Normal
+
+		if token.partner > i {
+			starts[i] = offset
+			continue
 		}
+
+		start := starts[token.partner]
+		textStyles = append(textStyles, TextStyle{Start: start, Length: offset - start, Style: styleForMarker(token.marker)})
 	}
 
-	return fullString, signalCliFormatStrings
+	sort.SliceStable(textStyles, func(i, j int) bool {
+		if textStyles[i].Start != textStyles[j].Start {
+			return textStyles[i].Start < textStyles[j].Start
+		}
+		return textStyles[i].Length > textStyles[j].Length
+	})
+
+	return sb.String(), textStyles
+}
+
+// ParseMarkdownMessage is like ParseMarkdown, but returns the text styles in the format signal-cli expects.
+func ParseMarkdownMessage(message string) (string, []string) {
+	message, textStyles := ParseMarkdown(message)
+
+	signalCliFormatStrings := []string{}
+	for _, textStyle := range textStyles {
+		signalCliFormatStrings = append(signalCliFormatStrings, textStyle.String())
+	}
+	return message, signalCliFormatStrings
 }
@@ -1,76 +1,70 @@
 package utils
 
-import "testing"
-import "reflect"
+import (
+	"reflect"
+	"testing"
+)
 
-func expectMessageEqual(t *testing.T, message1 string, message2 string) {
-	if message1 != message2 {
-		t.Errorf("got %q, wanted %q", message1, message2)
-	}
-}
-
-func expectFormatStringsEqual(t *testing.T, formatStrings1 []string, formatStrings2 []string) {
-	if !reflect.DeepEqual(formatStrings1, formatStrings2) {
-		t.Errorf("got %q, wanted %q", formatStrings1, formatStrings2)
-	}
-}
-
-func TestSimpleMessage1(t *testing.T) {
-    message, signalCliFormatStrings := ParseMarkdownMessage("*italic*")
-	expectMessageEqual(t, message, "italic")
-	expectFormatStringsEqual(t, signalCliFormatStrings, []string{"0:6:ITALIC"})
-}
-
-func TestSimpleMessage(t *testing.T) {
-    message, signalCliFormatStrings := ParseMarkdownMessage("*This is a italic message*")
-	expectMessageEqual(t, message, "This is a italic message")
-	expectFormatStringsEqual(t, signalCliFormatStrings, []string{"0:24:ITALIC"})
-}
+func TestParseMarkdownMessage(t *testing.T) {
+	testCases := []struct {
+		nameTest              string
+		input                 string
+		messageExpected       string
+		formatStringsExpected []string
+	}{
+		{"italic", "*italic*", "italic", []string{"0:6:ITALIC"}},
+		{"italic message", "*This is a italic message*", "This is a italic message", []string{"0:24:ITALIC"}},
+		{"bold and italic", "This is a **bold** and *italic* message", "This is a bold and italic message", []string{"10:4:BOLD", "19:6:ITALIC"}},
+		{"two bold strings", "This is a **bold** and another **bold** message", "This is a bold and another bold message", []string{"10:4:BOLD", "27:4:BOLD"}},
+		{"strikethrough", "This is a ~strikethrough~ and a **bold** message", "This is a strikethrough and a bold message", []string{"10:13:STRIKETHROUGH", "30:4:BOLD"}},
+		{"double tilde strikethrough", "~~gone~~", "gone", []string{"0:4:STRIKETHROUGH"}},
+		{"monospace", "This is a `monospace` and a **bold** message", "This is a monospace and a bold message", []string{"10:9:MONOSPACE", "26:4:BOLD"}},
+		{"spoiler", "The answer is ||42||", "The answer is 42", []string{"14:2:SPOILER"}},
 
-func TestBoldAndItalicMessage(t *testing.T) {
-    message, signalCliFormatStrings := ParseMarkdownMessage("This is a **bold** and *italic* message")
-	expectMessageEqual(t, message, "This is a bold and italic message")
-	expectFormatStringsEqual(t, signalCliFormatStrings, []string{"10:4:BOLD", "19:6:ITALIC"})
-}
+		{"bold inside italic", "*italic **bold** italic*", "italic bold italic", []string{"0:18:ITALIC", "7:4:BOLD"}},
+		{"italic inside bold", "**bold *italic* bold**", "bold italic bold", []string{"0:16:BOLD", "5:6:ITALIC"}},
+		{"bold and italic combined", "***both***", "both", []string{"0:4:ITALIC", "0:4:BOLD"}},
+		{"bold and italic combined, italic opened last", "**bold *both***", "bold both", []string{"0:9:BOLD", "5:4:ITALIC"}},
+		{"bold and italic opened together, bold closed first", "***a** b*", "a b", []string{"0:3:ITALIC", "0:1:BOLD"}},
+		{"bold and italic opened together, italic closed first", "***a* b**", "a b", []string{"0:3:BOLD", "0:1:ITALIC"}},
+		{"bold and italic opened together, only bold closed", "***a**", "*a", []string{"1:1:BOLD"}},
+		{"unclosed bold and italic", "***a", "***a", []string{}},
+		{"spoiler inside strikethrough", "~old ||secret||~", "old secret", []string{"0:10:STRIKETHROUGH", "4:6:SPOILER"}},
 
-func TestTwoBoldFormattedStrings(t *testing.T) {
-	message, signalCliFormatStrings := ParseMarkdownMessage("This is a **bold** and another **bold** message")
-	expectMessageEqual(t, message, "This is a bold and another bold message")
-	expectFormatStringsEqual(t, signalCliFormatStrings, []string{"10:4:BOLD", "27:4:BOLD"})
-}
+		{"code span content is literal", "`a **b** c`", "a **b** c", []string{"0:9:MONOSPACE"}},
+		{"code span with double backticks", "``a ` b``", "a ` b", []string{"0:5:MONOSPACE"}},
+		{"unclosed code span", "a ` b", "a ` b", []string{}},
 
-func TestStrikethrough(t *testing.T) {
-	message, signalCliFormatStrings := ParseMarkdownMessage("This is a ~strikethrough~ and a **bold** message")
-	expectMessageEqual(t, message, "This is a strikethrough and a bold message")
-	expectFormatStringsEqual(t, signalCliFormatStrings, []string{"10:13:STRIKETHROUGH", "30:4:BOLD"})
-}
+		{"escaped asterisks", `\*not italic\*`, "*not italic*", []string{}},
+		{"escaped backslash", `a\\b`, `a\b`, []string{}},
+		{"escape inside bold", `**a\*b**`, "a*b", []string{"0:3:BOLD"}},
+		{"backslash before normal character", `C:\path`, `C:\path`, []string{}},
+		{"backslash before underscore", `a\_b`, `a\_b`, []string{}},
 
-func TestMonospace(t *testing.T) {
-	message, signalCliFormatStrings := ParseMarkdownMessage("This is a `monospace` and a **bold** message")
-	expectMessageEqual(t, message, "This is a monospace and a bold message")
-	expectFormatStringsEqual(t, signalCliFormatStrings, []string{"10:9:MONOSPACE", "26:4:BOLD"})
-}
+		{"unmatched delimiter", "a *b", "a *b", []string{}},
+		{"delimiters surrounded by whitespace", "2 * 3 * 4", "2 * 3 * 4", []string{}},
+		{"empty delimiters", "****", "****", []string{}},
+		{"overlapping styles", "*a **b* c**", "a **b c**", []string{"0:5:ITALIC"}},
 
-func TestMulticharacterEmoji(t *testing.T) {
-	message, signalCliFormatStrings := ParseMarkdownMessage("👋abcdefg")
-	expectMessageEqual(t, message, "👋abcdefg")
-	expectFormatStringsEqual(t, signalCliFormatStrings, []string{})
-}
+		{"emoji", "👋abcdefg", "👋abcdefg", []string{}},
+		{"emoji with bold text", "👋**abcdefg**", "👋abcdefg", []string{"2:7:BOLD"}},
+		{"emoji with skin tone", "👋🏾abcdefg", "👋🏾abcdefg", []string{}},
+		{"emoji with skin tone and bold text", "👋🏾**abcdefg**", "👋🏾abcdefg", []string{"4:7:BOLD"}},
+		{"bold emoji", "a **👋** b", "a 👋 b", []string{"2:2:BOLD"}},
+		{"non BMP characters before and in style", "𝔘 *𝔘𝔘* ä", "𝔘 𝔘𝔘 ä", []string{"3:4:ITALIC"}},
+	}
 
-func TestMulticharacterEmojiWithBoldText(t *testing.T) {
-	message, signalCliFormatStrings := ParseMarkdownMessage("👋**abcdefg**")
-	expectMessageEqual(t, message, "👋abcdefg")
-	expectFormatStringsEqual(t, signalCliFormatStrings, []string{"2:8:BOLD"})
-}
+	for _, tt := range testCases {
+		t.Run(tt.nameTest, func(t *testing.T) {
+			message, signalCliFormatStrings := ParseMarkdownMessage(tt.input)
 
-func TestMultipleMulticharacterEmoji(t *testing.T) {
-	message, signalCliFormatStrings := ParseMarkdownMessage("👋🏾abcdefg")
-	expectMessageEqual(t, message, "👋🏾abcdefg")
-	expectFormatStringsEqual(t, signalCliFormatStrings, []string{})
-}
+			if message != tt.messageExpected {
+				t.Errorf("message got %q, want %q", message, tt.messageExpected)
+			}
 
-func TestMultipleMulticharacterEmojiWithBoldText(t *testing.T) {
-	message, signalCliFormatStrings := ParseMarkdownMessage("👋🏾**abcdefg**")
-	expectMessageEqual(t, message, "👋🏾abcdefg")
-	expectFormatStringsEqual(t, signalCliFormatStrings, []string{"4:9:BOLD"})
+			if !reflect.DeepEqual(signalCliFormatStrings, tt.formatStringsExpected) {
+				t.Errorf("format strings got %q, want %q", signalCliFormatStrings, tt.formatStringsExpected)
+			}
+		})
+	}
 }
@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+const (
+	WebhookDeliveryPending  = "pending"
+	WebhookDeliveryRetrying = "retrying"
+	WebhookDeliveryDead     = "dead"
+)
+
+type Webhook struct {
+	ID     string `gorm:"primary_key"`
+	Sub    string `gorm:"not null;index"`
+	Number string `gorm:"not null;index"`
+	Url    string `gorm:"not null"`
+	Secret string `gorm:"not null"`
+	// comma separated list of the message types that are delivered; empty means all types
+	MessageTypes string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// Matches reports whether envelopes of the given message type are delivered to the webhook.
+func (w *Webhook) Matches(messageType string) bool {
+	if w.MessageTypes == "" {
+		return true
+	}
+	for _, t := range strings.Split(w.MessageTypes, ",") {
+		if t == messageType {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is a received envelope that still needs to be delivered to a webhook. Successful
+// deliveries are deleted; deliveries that failed too often are kept as dead letters.
+type WebhookDelivery struct {
+	ID             string `gorm:"primary_key"`
+	WebhookID      string `gorm:"not null;index"`
+	MessageType    string
+	Status         string `gorm:"not null;index"`
+	Payload        string `gorm:"not null"`
+	Attempts       int    `gorm:"not null"`
+	LastError      string
+	LastStatusCode int
+	NextAttemptAt  time.Time
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+type WebhookStorage struct {
+	*gorm.DB
+}
+
+func NewWebhookStorage(dbFile string) (*WebhookStorage, error) {
+	db, err := gorm.Open("sqlite3", dbFile)
+	if err != nil {
+		return nil, err
+	}
+	db = db.AutoMigrate(&Webhook{}, &WebhookDelivery{})
+	return &WebhookStorage{db}, nil
+}
+
+func (s *WebhookStorage) CreateWebhook(webhook *Webhook) error {
+	return s.Create(webhook).Error
+}
+
+func (s *WebhookStorage) GetWebhook(id string) (*Webhook, bool) {
+	webhook := Webhook{}
+	err := s.DB.Model(&Webhook{}).Where("id = ?", id).First(&webhook).Error
+	if err != nil {
+		return nil, false
+	}
+	return &webhook, true
+}
+
+func (s *WebhookStorage) GetWebhooksByNumber(number string) ([]Webhook, error) {
+	webhooks := []Webhook{}
+	err := s.DB.Model(&Webhook{}).Where("number = ?", number).Order("created_at asc").Find(&webhooks).Error
+	return webhooks, err
+}
+
+func (s *WebhookStorage) DeleteWebhook(id string) error {
+	err := s.DB.Where("webhook_id = ?", id).Delete(&WebhookDelivery{}).Error
+	if err != nil {
+		return err
+	}
+	return s.DB.Where("id = ?", id).Delete(&Webhook{}).Error
+}
+
+func (s *WebhookStorage) CreateDelivery(delivery *WebhookDelivery) error {
+	return s.Create(delivery).Error
+}
+
+func (s *WebhookStorage) SaveDelivery(delivery *WebhookDelivery) error {
+	return s.Save(delivery).Error
+}
+
+func (s *WebhookStorage) DeleteDelivery(id string) error {
+	return s.DB.Where("id = ?", id).Delete(&WebhookDelivery{}).Error
+}
+
+func (s *WebhookStorage) GetDelivery(id string) (*WebhookDelivery, bool) {
+	delivery := WebhookDelivery{}
+	err := s.DB.Model(&WebhookDelivery{}).Where("id = ?", id).First(&delivery).Error
+	if err != nil {
+		return nil, false
+	}
+	return &delivery, true
+}
+
+// GetUnfinishedDeliveries returns all deliveries that are neither delivered nor dead yet, oldest first.
+func (s *WebhookStorage) GetUnfinishedDeliveries() ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	err := s.DB.Model(&WebhookDelivery{}).
+		Where("status IN (?)", []string{WebhookDeliveryPending, WebhookDeliveryRetrying}).
+		Order("created_at asc").
+		Find(&deliveries).Error
+	return deliveries, err
+}
+
+// GetDeadDeliveries returns the dead letters of a webhook, oldest first.
+func (s *WebhookStorage) GetDeadDeliveries(webhookId string) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	err := s.DB.Model(&WebhookDelivery{}).
+		Where("webhook_id = ? AND status = ?", webhookId, WebhookDeliveryDead).
+		Order("created_at asc").
+		Find(&deliveries).Error
+	return deliveries, err
+}